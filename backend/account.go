@@ -0,0 +1,430 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// パスワードを持たないアカウント (OIDC で作成) は、この時間内にログインしたセッションからだけ削除できる
+	accountDeleteReauthWindow = 10 * time.Minute
+	// エクスポートで 1 回のトランザクションに読むメッセージの件数
+	messageExportPageSize = 500
+)
+
+// エクスポートに含めないものの説明。ZIP の README.txt として書き出す
+const accountExportReadme = `futto-note account export
+
+profile.json            プロフィール
+settings.json           設定
+messages.json           メッセージ
+attachments.json        添付ファイルの一覧 (file が ZIP 内のパス)
+attachments/            添付ファイルの本体 (処理が完了したもののみ)
+archives.json           リンク先のアーカイブ (本文のテキスト)
+reminders.json          リマインダー
+push_subscriptions.json 通知を登録した端末のエンドポイント
+audit_events.json       監査ログ (新しいものから最大 %d 件)
+
+含まれないもの:
+- アーカイブしたページの画像 (元のページから取得し直せるため)
+- Web Push の暗号鍵 (端末ごとの秘密情報のため)
+- パスワードのハッシュとログイン中のセッション
+`
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type exportedAttachment struct {
+	attachment
+	File string `json:"file,omitempty"`
+}
+
+type exportedArchive struct {
+	MessageID int `json:"message_id"`
+	messageArchive
+}
+
+type exportedPushSubscription struct {
+	Endpoint  string    `json:"endpoint"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type accountRecords struct {
+	Attachments       []attachment
+	Archives          []exportedArchive
+	Reminders         []reminder
+	PushSubscriptions []exportedPushSubscription
+}
+
+type userProfile struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var findUserProfile = func(userID string) (userProfile, error) {
+	var profile userProfile
+	var email sql.NullString
+	err := db.QueryRow(
+		"SELECT id, username, email, created_at FROM users WHERE id = $1",
+		userID,
+	).Scan(&profile.ID, &profile.Username, &email, &profile.CreatedAt)
+	if err != nil {
+		return userProfile{}, err
+	}
+	profile.Email = email.String
+	return profile, nil
+}
+
+// sessions / messages などは ON DELETE CASCADE で一緒に消える
+// 添付ファイルとアーカイブ画像のブロブはカスケードで消えないので、キーを控えてから削除する
+var deleteUser = func(userID string) error {
+	var blobKeys []string
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		blobKeys, err = listMessageBlobKeys(tx, "user_id = $1", userID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("DELETE FROM users WHERE id = $1", userID); err != nil {
+		return err
+	}
+
+	removeBlobs(blobKeys)
+	return nil
+}
+
+var findSessionCreatedAt = func(tokenHash string) (time.Time, error) {
+	var createdAt time.Time
+	err := withSessionScope(tokenHash, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			"SELECT created_at FROM sessions WHERE token_hash = $1 AND expires_at > NOW()",
+			tokenHash,
+		).Scan(&createdAt)
+	})
+	return createdAt, err
+}
+
+// エクスポート用に、メッセージ以外のユーザーのデータをまとめて読む
+var loadAccountRecords = func(userID string) (accountRecords, error) {
+	var records accountRecords
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		records.Attachments, err = collectRows(tx, scanAttachment,
+			`SELECT `+attachmentColumns+` FROM attachments WHERE user_id = $1 ORDER BY id`, userID)
+		if err != nil {
+			return err
+		}
+		records.Archives, err = collectRows(tx, func(row rowScanner) (exportedArchive, error) {
+			var a exportedArchive
+			err := row.Scan(&a.MessageID, &a.ID, &a.URL, &a.Status, &a.FinalURL, &a.Title, &a.Text, &a.imageKey,
+				&a.imageContentType, &a.Error, &a.ArchivedAt)
+			a.HasImage = a.imageKey != ""
+			return a, err
+		}, `SELECT message_id, `+messageArchiveColumns+` FROM message_archives WHERE user_id = $1 ORDER BY id`, userID)
+		if err != nil {
+			return err
+		}
+		records.Reminders, err = collectRows(tx, scanReminder,
+			`SELECT `+reminderColumns+` FROM reminders WHERE user_id = $1 ORDER BY remind_at, id`, userID)
+		if err != nil {
+			return err
+		}
+		records.PushSubscriptions, err = collectRows(tx, func(row rowScanner) (exportedPushSubscription, error) {
+			var p exportedPushSubscription
+			err := row.Scan(&p.Endpoint, &p.CreatedAt)
+			return p, err
+		}, "SELECT endpoint, created_at FROM web_push_subscriptions WHERE user_id = $1 ORDER BY id", userID)
+		return err
+	})
+	return records, err
+}
+
+var openAttachmentBlob = func(ctx context.Context, key string) (io.ReadCloser, error) {
+	return blobStore.Open(ctx, key)
+}
+
+func collectRows[T any](tx *sql.Tx, scan func(rowScanner) (T, error), query string, args ...any) ([]T, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]T, 0)
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// (created_at, id) が after より後のメッセージを created_at 昇順で最大 limit 件返す。after が nil なら先頭から
+var listUserMessagesAfter = func(userID string, filter messageFilter, after *messageListItem, limit int) ([]messageListItem, error) {
+	where, args := messageFilterClause(userID, filter)
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		where += fmt.Sprintf(" AND (created_at, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit)
+
+	messages := make([]messageListItem, 0, limit)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		messages, err = collectRows(tx, scanMessage,
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE `+where+`
+			 ORDER BY created_at ASC, id ASC
+			 LIMIT $`+strconv.Itoa(len(args)),
+			args...,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// 全件をメモリに載せずに created_at 昇順で 1 件ずつ渡す。
+// ページごとに短いトランザクションで読み、fn (レスポンスへの書き出しなど) はトランザクションの外で呼ぶので、
+// 受け取りの遅いクライアントが DB の接続を握り続けることはない
+var eachUserMessage = func(userID string, filter messageFilter, fn func(messageListItem) error) error {
+	var after *messageListItem
+	for {
+		page, err := listUserMessagesAfter(userID, filter, after, messageExportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range page {
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		if len(page) < messageExportPageSize {
+			return nil
+		}
+		after = &page[len(page)-1]
+	}
+}
+
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var req deleteAccountRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	passwordHash, err := findPasswordHashByUserID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if passwordHash == unusablePasswordHash {
+		// パスワードの代わりに、IdP で認証し直した直後であることを確かめる
+		if !isRecentLogin(r) {
+			recordAudit(r, userID, auditEventAccountDelete, auditOutcomeFailure, nil)
+			writeError(w, http.StatusForbidden, "sign in again to delete this account")
+			return
+		}
+	} else {
+		if req.Password == "" {
+			writeError(w, http.StatusBadRequest, "password is required")
+			return
+		}
+		if ok, _ := verifyPassword(passwordHash, req.Password); !ok {
+			recordAudit(r, userID, auditEventAccountDelete, auditOutcomeFailure, nil)
+			writeError(w, http.StatusForbidden, "password is incorrect")
+			return
+		}
+	}
+
+	if err := deleteUser(userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	log.Printf("account deleted: user_id=%s ip=%s", userID, clientIP(r))
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isRecentLogin(r *http.Request) bool {
+	token, err := readSessionToken(r)
+	if err != nil {
+		return false
+	}
+	createdAt, err := findSessionCreatedAt(hashSessionToken(token))
+	if err != nil {
+		return false
+	}
+	return time.Since(createdAt) <= accountDeleteReauthWindow
+}
+
+// ZIP をレスポンスへ直接書き出すので、ヘッダー送信後のエラーはログに残すだけになる
+func exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	profile, err := findUserProfile(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	filename := fmt.Sprintf("futto-note-%s-%s.zip", profile.Username, time.Now().UTC().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	if err := writeAccountArchive(r.Context(), archive, userID, profile); err != nil {
+		log.Printf("failed to write account export: %v", err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("failed to finish account export: %v", err)
+	}
+}
+
+func writeAccountArchive(ctx context.Context, archive *zip.Writer, userID string, profile userProfile) error {
+	readme, err := archive.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(readme, accountExportReadme, maxAuditExportEvents); err != nil {
+		return err
+	}
+
+	if err := writeArchiveJSON(archive, "profile.json", profile); err != nil {
+		return err
+	}
+
+	settings, err := getUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveJSON(archive, "settings.json", settings); err != nil {
+		return err
+	}
+
+	messagesFile, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	if _, err := messagesFile.Write([]byte("[")); err != nil {
+		return err
+	}
+
+	separator := "\n  "
+	err = eachUserMessage(userID, messageFilter{}, func(message messageListItem) error {
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if _, err := messagesFile.Write(append([]byte(separator), encoded...)); err != nil {
+			return err
+		}
+		separator = ",\n  "
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	closing := "\n]\n"
+	if separator == "\n  " {
+		closing = "]\n"
+	}
+	if _, err := messagesFile.Write([]byte(closing)); err != nil {
+		return err
+	}
+
+	records, err := loadAccountRecords(userID)
+	if err != nil {
+		return err
+	}
+	attachments := make([]exportedAttachment, 0, len(records.Attachments))
+	for _, a := range records.Attachments {
+		exported := exportedAttachment{attachment: a}
+		if a.Status == attachmentStatusReady {
+			exported.File = fmt.Sprintf("attachments/%d-%s", a.ID, a.Filename)
+			if err := copyBlobToArchive(ctx, archive, exported.File, a.StorageKey); err != nil {
+				return err
+			}
+		}
+		attachments = append(attachments, exported)
+	}
+	if err := writeArchiveJSON(archive, "attachments.json", attachments); err != nil {
+		return err
+	}
+	if err := writeArchiveJSON(archive, "archives.json", records.Archives); err != nil {
+		return err
+	}
+	if err := writeArchiveJSON(archive, "reminders.json", records.Reminders); err != nil {
+		return err
+	}
+	if err := writeArchiveJSON(archive, "push_subscriptions.json", records.PushSubscriptions); err != nil {
+		return err
+	}
+
+	events, err := listAuditEvents(userID, 0, maxAuditExportEvents)
+	if err != nil {
+		return err
+	}
+	return writeArchiveJSON(archive, "audit_events.json", events)
+}
+
+func writeArchiveJSON(archive *zip.Writer, name string, value any) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func copyBlobToArchive(ctx context.Context, archive *zip.Writer, name string, key string) error {
+	blob, err := openAttachmentBlob(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, blob)
+	return err
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccountHandler_RequiresCorrectPassword(t *testing.T) {
+	originalFind := findPasswordHashByUserID
+	originalVerify := verifyPassword
+	originalDelete := deleteUser
+	t.Cleanup(func() {
+		findPasswordHashByUserID = originalFind
+		verifyPassword = originalVerify
+		deleteUser = originalDelete
+	})
+
+	findPasswordHashByUserID = func(userID string) (string, error) {
+		return "stored-hash", nil
+	}
+	verifyPassword = func(hash string, password string) (bool, bool) {
+		return password == "correct-password", false
+	}
+	wasCalled := false
+	deleteUser = func(userID string) error {
+		wasCalled = true
+		return nil
+	}
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/me", strings.NewReader(`{"password":"wrong-password"}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	deleteAccountHandler(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	if wasCalled {
+		t.Fatalf("deleteUser should not be called for incorrect password")
+	}
+}
+
+func TestDeleteAccountHandler_DeletesUserAndClearsCookie(t *testing.T) {
+	originalFind := findPasswordHashByUserID
+	originalVerify := verifyPassword
+	originalDelete := deleteUser
+	t.Cleanup(func() {
+		findPasswordHashByUserID = originalFind
+		verifyPassword = originalVerify
+		deleteUser = originalDelete
+	})
+
+	findPasswordHashByUserID = func(userID string) (string, error) {
+		return "stored-hash", nil
+	}
+	verifyPassword = func(hash string, password string) (bool, bool) {
+		return true, false
+	}
+	gotUserID := ""
+	deleteUser = func(userID string) error {
+		gotUserID = userID
+		return nil
+	}
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/me", strings.NewReader(`{"password":"correct-password"}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	deleteAccountHandler(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	if gotUserID != "user-1" {
+		t.Fatalf("expected user_id user-1, got %s", gotUserID)
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || cookies[0].MaxAge >= 0 {
+		t.Fatalf("expected session cookie to be cleared, got %v", cookies)
+	}
+}
+
+func TestExportAccountHandler_ReturnsZipWithProfileAndMessages(t *testing.T) {
+	originalProfile := findUserProfile
+	originalEach := eachUserMessage
+	originalAudit := listAuditEvents
+	originalSettings := loadSettingOverrides
+	originalRecords := loadAccountRecords
+	originalOpenBlob := openAttachmentBlob
+	t.Cleanup(func() {
+		findUserProfile = originalProfile
+		eachUserMessage = originalEach
+		listAuditEvents = originalAudit
+		loadSettingOverrides = originalSettings
+		loadAccountRecords = originalRecords
+		openAttachmentBlob = originalOpenBlob
+	})
+
+	createdAt := time.Date(2026, 2, 9, 10, 30, 0, 0, time.UTC)
+	findUserProfile = func(userID string) (userProfile, error) {
+		return userProfile{ID: userID, Username: "alice", CreatedAt: createdAt}, nil
+	}
+	eachUserMessage = func(userID string, filter messageFilter, fn func(messageListItem) error) error {
+		for _, message := range []messageListItem{
+			{ID: 1, Body: "最初のメッセージ", CreatedAt: createdAt},
+			{ID: 2, Body: "二つ目", CreatedAt: createdAt.Add(time.Minute)},
+		} {
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	listAuditEvents = func(userID string, beforeID int64, limit int) ([]auditEvent, error) {
+		return []auditEvent{}, nil
+	}
+	loadSettingOverrides = func(userID string) (map[string]json.RawMessage, error) {
+		return map[string]json.RawMessage{"timezone": json.RawMessage(`"Asia/Tokyo"`)}, nil
+	}
+	loadAccountRecords = func(userID string) (accountRecords, error) {
+		return accountRecords{
+			Attachments: []attachment{
+				{ID: 3, MessageID: 1, Filename: "memo.txt", Status: attachmentStatusReady, StorageKey: "users/user-1/memo"},
+				{ID: 4, MessageID: 1, Filename: "photo.jpg", Status: attachmentStatusFailed, StorageKey: "users/user-1/photo"},
+			},
+			Archives:          []exportedArchive{{MessageID: 1, messageArchive: messageArchive{ID: 5, URL: "https://example.com/"}}},
+			Reminders:         []reminder{{ID: 6, MessageID: 2, RemindAt: createdAt}},
+			PushSubscriptions: []exportedPushSubscription{{Endpoint: "https://push.example.com/abc", CreatedAt: createdAt}},
+		}, nil
+	}
+	openAttachmentBlob = func(ctx context.Context, key string) (io.ReadCloser, error) {
+		if key != "users/user-1/memo" {
+			t.Fatalf("unexpected blob: %s", key)
+		}
+		return io.NopCloser(strings.NewReader("添付の中身")), nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/me/export", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	exportAccountHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to open zip: %v", err)
+	}
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", file.Name, err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file.Name, err)
+		}
+		files[file.Name] = content
+	}
+
+	var profile userProfile
+	if err := json.Unmarshal(files["profile.json"], &profile); err != nil {
+		t.Fatalf("failed to decode profile.json: %v", err)
+	}
+	if profile.Username != "alice" {
+		t.Fatalf("expected username alice, got %s", profile.Username)
+	}
+
+	var messages []messageListItem
+	if err := json.Unmarshal(files["messages.json"], &messages); err != nil {
+		t.Fatalf("failed to decode messages.json: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Body != "最初のメッセージ" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+
+	if _, ok := files["audit_events.json"]; !ok {
+		t.Fatalf("expected audit_events.json in archive")
+	}
+
+	var settings userSettings
+	if err := json.Unmarshal(files["settings.json"], &settings); err != nil || settings.Timezone != "Asia/Tokyo" {
+		t.Fatalf("unexpected settings.json: %s", files["settings.json"])
+	}
+
+	var attachments []exportedAttachment
+	if err := json.Unmarshal(files["attachments.json"], &attachments); err != nil {
+		t.Fatalf("failed to decode attachments.json: %v", err)
+	}
+	if len(attachments) != 2 || attachments[0].File != "attachments/3-memo.txt" || attachments[1].File != "" {
+		t.Fatalf("unexpected attachments: %+v", attachments)
+	}
+	if string(files["attachments/3-memo.txt"]) != "添付の中身" {
+		t.Fatalf("unexpected attachment content: %q", files["attachments/3-memo.txt"])
+	}
+
+	for _, name := range []string{"archives.json", "reminders.json", "push_subscriptions.json", "README.txt"} {
+		if len(files[name]) == 0 {
+			t.Fatalf("expected %s in archive", name)
+		}
+	}
+	if strings.Contains(string(files["push_subscriptions.json"]), "p256dh") {
+		t.Fatalf("push subscription keys should not be exported: %s", files["push_subscriptions.json"])
+	}
+}
+
+func TestDeleteAccountHandler_PasswordlessAccountRequiresRecentLogin(t *testing.T) {
+	originalFind := findPasswordHashByUserID
+	originalCreatedAt := findSessionCreatedAt
+	originalDelete := deleteUser
+	t.Cleanup(func() {
+		findPasswordHashByUserID = originalFind
+		findSessionCreatedAt = originalCreatedAt
+		deleteUser = originalDelete
+	})
+
+	findPasswordHashByUserID = func(userID string) (string, error) {
+		return unusablePasswordHash, nil
+	}
+	deleted := 0
+	deleteUser = func(userID string) error {
+		deleted++
+		return nil
+	}
+
+	for _, tc := range []struct {
+		loggedInAgo time.Duration
+		status      int
+	}{
+		{time.Hour, http.StatusForbidden},
+		{time.Minute, http.StatusNoContent},
+	} {
+		findSessionCreatedAt = func(tokenHash string) (time.Time, error) {
+			if tokenHash != hashSessionToken("session-token") {
+				t.Fatalf("unexpected session %s", tokenHash)
+			}
+			return time.Now().Add(-tc.loggedInAgo), nil
+		}
+
+		request := httptest.NewRequest(http.MethodDelete, "/api/me", strings.NewReader(`{}`))
+		request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-token"})
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		deleteAccountHandler(recorder, request)
+
+		if recorder.Code != tc.status {
+			t.Fatalf("logged in %s ago: expected status %d, got %d", tc.loggedInAgo, tc.status, recorder.Code)
+		}
+	}
+	if deleted != 1 {
+		t.Fatalf("expected account to be deleted once, got %d", deleted)
+	}
+}
+
+func TestEachUserMessage_ReadsPagesAfterLastMessage(t *testing.T) {
+	original := listUserMessagesAfter
+	t.Cleanup(func() {
+		listUserMessagesAfter = original
+	})
+
+	createdAt := time.Date(2026, 2, 9, 10, 30, 0, 0, time.UTC)
+	stored := make([]messageListItem, 0)
+	for i := 1; i <= messageExportPageSize*2+1; i++ {
+		stored = append(stored, messageListItem{ID: i, CreatedAt: createdAt.Add(time.Duration(i/3) * time.Second)})
+	}
+	calls := 0
+	listUserMessagesAfter = func(userID string, filter messageFilter, after *messageListItem, limit int) ([]messageListItem, error) {
+		calls++
+		start := 0
+		if after != nil {
+			if !after.CreatedAt.Equal(stored[after.ID-1].CreatedAt) {
+				t.Fatalf("unexpected cursor %+v", after)
+			}
+			start = after.ID
+		}
+		return stored[start:min(start+limit, len(stored))], nil
+	}
+
+	ids := make([]int, 0)
+	err := eachUserMessage("user-1", messageFilter{}, func(message messageListItem) error {
+		ids = append(ids, message.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("eachUserMessage returned error: %v", err)
+	}
+	if calls != 3 || len(ids) != len(stored) {
+		t.Fatalf("expected %d messages in 3 pages, got %d in %d", len(stored), len(ids), calls)
+	}
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("expected messages in order, got %d at %d", id, i)
+		}
+	}
+}
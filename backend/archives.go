@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+
+	"futto-note/backend/imaging"
+	"futto-note/backend/webfetch"
+)
+
+const (
+	archivePageMaxBytes   = 2 << 20
+	archiveImageMaxBytes  = 5 << 20
+	archiveTextMaxBytes   = 200 << 10
+	archiveTimeout        = 15 * time.Second
+	archiveErrorMaxBytes  = 200
+	defaultArchiveWorkers = 2
+
+	archiveStatusReady  = "ready"
+	archiveStatusFailed = "failed"
+)
+
+type messageArchive struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Status     string    `json:"status"`
+	FinalURL   string    `json:"final_url,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Text       string    `json:"text,omitempty"`
+	HasImage   bool      `json:"has_image"`
+	Error      string    `json:"error,omitempty"`
+	ArchivedAt time.Time `json:"archived_at"`
+
+	imageKey         string
+	imageContentType string
+}
+
+type messageArchiveResponse struct {
+	MessageID int              `json:"message_id"`
+	Archives  []messageArchive `json:"archives"`
+}
+
+// Requested は利用者が明示的に保存を求めたジョブ。設定で無効でも処理する
+type archiveJob struct {
+	MessageID int
+	UserID    string
+	Requested bool
+}
+
+var archiveFetcher = webfetch.New(webfetch.Options{
+	Timeout:      archiveTimeout,
+	MaxRedirects: linkPreviewMaxRedirects,
+	UserAgent:    "futto-note-archiver/1.0",
+})
+
+var archiveQueue = newWorkQueue("message archive", archiveMessageLinks)
+
+func archiveWorkers() int {
+	return readWorkerCountEnv("ARCHIVE_WORKERS", defaultArchiveWorkers)
+}
+
+const messageArchiveColumns = `id, url, status, final_url, title, content, COALESCE(image_key, ''),
+	image_content_type, error, archived_at`
+
+func scanMessageArchive(row rowScanner) (messageArchive, error) {
+	var a messageArchive
+	err := row.Scan(&a.ID, &a.URL, &a.Status, &a.FinalURL, &a.Title, &a.Text, &a.imageKey,
+		&a.imageContentType, &a.Error, &a.ArchivedAt)
+	a.HasImage = a.imageKey != ""
+	return a, err
+}
+
+// メッセージが存在しなければ sql.ErrNoRows
+var listMessageArchives = func(messageID int, userID string) ([]messageArchive, error) {
+	archives := make([]messageArchive, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND user_id = $2)",
+			messageID,
+			userID,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		rows, err := tx.Query(
+			`SELECT `+messageArchiveColumns+`
+			 FROM message_archives
+			 WHERE message_id = $1 AND user_id = $2
+			 ORDER BY id`,
+			messageID,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			a, err := scanMessageArchive(rows)
+			if err != nil {
+				return err
+			}
+			archives = append(archives, a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archives, nil
+}
+
+var findMessageArchive = func(archiveID int, messageID int, userID string) (messageArchive, error) {
+	var archive messageArchive
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		archive, err = scanMessageArchive(tx.QueryRow(
+			`SELECT `+messageArchiveColumns+`
+			 FROM message_archives
+			 WHERE id = $1 AND message_id = $2 AND user_id = $3`,
+			archiveID,
+			messageID,
+			userID,
+		))
+		return err
+	})
+	return archive, err
+}
+
+// 保存済みのスナップショットは上書きしない。保存しなかったら false を返す
+var saveMessageArchive = func(userID string, messageID int, archive messageArchive) (bool, error) {
+	var saved bool
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var image sql.NullString
+		if archive.imageKey != "" {
+			image = sql.NullString{String: archive.imageKey, Valid: true}
+		}
+		var id int
+		err := tx.QueryRow(
+			`INSERT INTO message_archives
+			     (message_id, user_id, url, status, final_url, title, content, image_key, image_content_type, error, archived_at)
+			 SELECT id, user_id, $3, $4, $5, $6, $7, $8, $9, $10, NOW()
+			 FROM messages WHERE id = $1 AND user_id = $2
+			 ON CONFLICT (message_id, url) DO UPDATE SET
+			     status = EXCLUDED.status, final_url = EXCLUDED.final_url, title = EXCLUDED.title,
+			     content = EXCLUDED.content, image_key = EXCLUDED.image_key,
+			     image_content_type = EXCLUDED.image_content_type, error = EXCLUDED.error,
+			     archived_at = EXCLUDED.archived_at
+			 WHERE message_archives.status <> $11
+			 RETURNING id`,
+			messageID,
+			userID,
+			archive.URL,
+			archive.Status,
+			archive.FinalURL,
+			archive.Title,
+			archive.Text,
+			image,
+			archive.imageContentType,
+			archive.Error,
+			archiveStatusReady,
+		).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		saved = true
+		return nil
+	})
+	return saved, err
+}
+
+// 本文から消えた URL のスナップショットを削除し、消す画像のキーを返す
+var pruneMessageArchives = func(userID string, messageID int, urls []string) ([]string, error) {
+	keys := make([]string, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`DELETE FROM message_archives
+			 WHERE message_id = $1 AND user_id = $2 AND NOT (url = ANY($3))
+			 RETURNING COALESCE(image_key, '')`,
+			messageID,
+			userID,
+			pq.StringArray(urls),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+		return rows.Err()
+	})
+	return keys, err
+}
+
+func listArchiveImageKeys(tx *sql.Tx, where string, args ...any) ([]string, error) {
+	rows, err := tx.Query("SELECT image_key FROM message_archives WHERE image_key IS NOT NULL AND "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// 添付とアーカイブ画像のブロブはカスケードで消えないので、行を消す前にまとめて控える
+func listMessageBlobKeys(tx *sql.Tx, where string, args ...any) ([]string, error) {
+	keys, err := listAttachmentKeys(tx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	archiveKeys, err := listArchiveImageKeys(tx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, archiveKeys...), nil
+}
+
+// 編集でリンクが消えた場合は古いスナップショットを片付けるため、URL がなくても積む
+func enqueueMessageArchive(userID string, message messageListItem, edited bool) {
+	if !edited && len(extractMessageURLs(message.Body)) == 0 {
+		return
+	}
+	archiveQueue.enqueue(archiveJob{MessageID: message.ID, UserID: userID})
+}
+
+func archiveMessageLinks(job archiveJob) error {
+	message, err := findMessage(job.MessageID, job.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	urls := extractMessageURLs(message.Body)
+	removed, err := pruneMessageArchives(job.UserID, job.MessageID, urls)
+	if err != nil {
+		return err
+	}
+	removeBlobs(removed)
+	if len(urls) == 0 {
+		return nil
+	}
+
+	if !job.Requested {
+		settings, err := getUserSettings(job.UserID)
+		if err != nil {
+			return err
+		}
+		if !settings.ArchiveLinks {
+			return nil
+		}
+	}
+
+	existing, err := listMessageArchives(job.MessageID, job.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	archived := make(map[string]bool, len(existing))
+	for _, a := range existing {
+		if a.Status == archiveStatusReady {
+			archived[a.URL] = true
+		}
+	}
+
+	for _, link := range urls {
+		if archived[link] {
+			continue
+		}
+		archive := archivePage(job.UserID, link)
+		saved, err := saveMessageArchive(job.UserID, job.MessageID, archive)
+		if err != nil || !saved {
+			if archive.imageKey != "" {
+				removeBlobs([]string{archive.imageKey})
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 取得に失敗しても failed のスナップショットとして記録する
+func archivePage(userID string, link string) messageArchive {
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+
+	archive := messageArchive{URL: link, Status: archiveStatusFailed}
+
+	resp, err := archiveFetcher.Get(ctx, link, archivePageMaxBytes, "text/html", "application/xhtml+xml")
+	if err != nil {
+		archive.Error = truncateString(err.Error(), archiveErrorMaxBytes)
+		return archive
+	}
+	article, err := webfetch.ExtractArticle(resp)
+	if err != nil {
+		archive.Error = truncateString(err.Error(), archiveErrorMaxBytes)
+		return archive
+	}
+
+	archive.Status = archiveStatusReady
+	archive.FinalURL = resp.URL.String()
+	archive.Title = article.Title
+	archive.Text = truncateString(article.Text, archiveTextMaxBytes)
+
+	if article.ImageURL != "" {
+		key, contentType, err := archiveImage(ctx, userID, article.ImageURL)
+		if err != nil {
+			log.Printf("failed to archive image %s: %v", article.ImageURL, err)
+		} else {
+			archive.imageKey = key
+			archive.imageContentType = contentType
+		}
+	}
+	return archive
+}
+
+var errArchiveImageTooLarge = errors.New("archive image too large")
+
+// 画像は添付と同じく作り直してから保存し、メタデータや偽装したファイルを残さない
+func archiveImage(ctx context.Context, userID string, imageURL string) (string, string, error) {
+	resp, err := archiveFetcher.Get(ctx, imageURL, archiveImageMaxBytes, "image/")
+	if err != nil {
+		return "", "", err
+	}
+	if resp.Truncated {
+		return "", "", errArchiveImageTooLarge
+	}
+
+	contentType := http.DetectContentType(resp.Body)
+	processed, err := imaging.Process(resp.Body, contentType, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := newAttachmentStorageKey(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := blobStore.Put(ctx, key, bytes.NewReader(processed.Original.Data), processed.Original.ContentType); err != nil {
+		removeBlobs([]string{key})
+		return "", "", err
+	}
+	return key, processed.Original.ContentType, nil
+}
+
+func getMessageArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	archives, err := listMessageArchives(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, messageArchiveResponse{MessageID: messageID, Archives: archives})
+}
+
+// 設定で自動保存を有効にしていなくても、メッセージ単位で保存を依頼できる
+func requestMessageArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	archives, err := listMessageArchives(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	archiveQueue.enqueue(archiveJob{MessageID: messageID, UserID: userID, Requested: true})
+	writeJSON(w, http.StatusAccepted, messageArchiveResponse{MessageID: messageID, Archives: archives})
+}
+
+func downloadArchiveImageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	archiveID, err := strconv.Atoi(chi.URLParam(r, "archiveID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid archive id")
+		return
+	}
+
+	archive, err := findMessageArchive(archiveID, messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "archive not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if archive.imageKey == "" {
+		writeError(w, http.StatusNotFound, "archive image not found")
+		return
+	}
+
+	serveBlob(w, r, archive.imageKey, archive.imageContentType, "inline", "archive-"+strconv.Itoa(archive.ID), archive.ArchivedAt)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"futto-note/backend/webfetch"
+)
+
+const archivedArticleHTML = `<html><head><title>Field notes</title></head><body>
+	<nav><a href="/">Home</a> <a href="/about">About us and everything else we do here</a></nav>
+	<div class="post">
+		<p>The first paragraph of the article is long enough to count as content.</p>
+		<p>The second paragraph keeps going so the extractor picks this container.</p>
+		<img src="/photo.png">
+	</div>
+	<footer><p>Copyright notice that should never appear in the archived text.</p></footer>
+</body></html>`
+
+// メッセージと保存先をメモリ上のスタブに置き換え、保存されたスナップショットを返す
+func stubMessageArchives(t *testing.T, body string, archiveLinks bool, allowPrivate bool) *[]messageArchive {
+	t.Helper()
+
+	stubAttachmentStore(t)
+
+	originalFetcher := archiveFetcher
+	originalFind := findMessage
+	originalPrune := pruneMessageArchives
+	originalList := listMessageArchives
+	originalSave := saveMessageArchive
+	originalFindArchive := findMessageArchive
+	originalSettings := loadSettingOverrides
+	t.Cleanup(func() {
+		archiveFetcher = originalFetcher
+		findMessage = originalFind
+		pruneMessageArchives = originalPrune
+		listMessageArchives = originalList
+		saveMessageArchive = originalSave
+		findMessageArchive = originalFindArchive
+		loadSettingOverrides = originalSettings
+	})
+
+	archiveFetcher = webfetch.New(webfetch.Options{Timeout: time.Second, MaxRedirects: 3, AllowPrivate: allowPrivate})
+
+	saved := make([]messageArchive, 0)
+	findMessage = func(id int, userID string) (messageDetailResponse, error) {
+		if id != 1 {
+			return messageDetailResponse{}, sql.ErrNoRows
+		}
+		return messageDetailResponse{messageListItem: messageListItem{ID: 1, Body: body}}, nil
+	}
+	pruneMessageArchives = func(userID string, messageID int, urls []string) ([]string, error) {
+		return nil, nil
+	}
+	listMessageArchives = func(messageID int, userID string) ([]messageArchive, error) {
+		if messageID != 1 {
+			return nil, sql.ErrNoRows
+		}
+		return saved, nil
+	}
+	saveMessageArchive = func(userID string, messageID int, archive messageArchive) (bool, error) {
+		archive.ID = len(saved) + 1
+		saved = append(saved, archive)
+		return true, nil
+	}
+	loadSettingOverrides = func(userID string) (map[string]json.RawMessage, error) {
+		if archiveLinks {
+			return map[string]json.RawMessage{"archive_links": json.RawMessage(`true`)}, nil
+		}
+		return map[string]json.RawMessage{}, nil
+	}
+
+	return &saved
+}
+
+func newArchiveTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewNRGBA(image.Rect(0, 0, 8, 6))); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(photo.Bytes())
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(archivedArticleHTML))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestArchiveMessageLinks_StoresReadableTextAndImage(t *testing.T) {
+	server := newArchiveTestServer(t)
+	link := server.URL + "/notes"
+	saved := stubMessageArchives(t, "あとで読む "+link, true, true)
+
+	if err := archiveMessageLinks(archiveJob{MessageID: 1, UserID: "user-1"}); err != nil {
+		t.Fatalf("archiveMessageLinks returned error: %v", err)
+	}
+
+	if len(*saved) != 1 {
+		t.Fatalf("expected 1 archive, got %d", len(*saved))
+	}
+	archive := (*saved)[0]
+	if archive.Status != archiveStatusReady || archive.URL != link || archive.Title != "Field notes" {
+		t.Fatalf("unexpected archive: %+v", archive)
+	}
+	want := "The first paragraph of the article is long enough to count as content.\n\n" +
+		"The second paragraph keeps going so the extractor picks this container."
+	if archive.Text != want {
+		t.Fatalf("unexpected archived text: %q", archive.Text)
+	}
+	if archive.imageKey == "" || archive.imageContentType != "image/png" {
+		t.Fatalf("expected main image to be stored, got %+v", archive)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/messages/{id}/archive/{archiveID}/image", downloadArchiveImageHandler)
+	findMessageArchive = func(archiveID int, messageID int, userID string) (messageArchive, error) {
+		return archive, nil
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/1/archive/1/image", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if config, err := png.DecodeConfig(recorder.Body); err != nil || config.Width != 8 || config.Height != 6 {
+		t.Fatalf("unexpected archived image: %+v, %v", config, err)
+	}
+}
+
+func TestArchiveMessageLinks_RequiresOptIn(t *testing.T) {
+	server := newArchiveTestServer(t)
+	saved := stubMessageArchives(t, server.URL, false, true)
+
+	if err := archiveMessageLinks(archiveJob{MessageID: 1, UserID: "user-1"}); err != nil {
+		t.Fatalf("archiveMessageLinks returned error: %v", err)
+	}
+	if len(*saved) != 0 {
+		t.Fatalf("expected nothing to be archived without opt-in, got %+v", *saved)
+	}
+
+	// 明示的な依頼は設定に関係なく処理する
+	if err := archiveMessageLinks(archiveJob{MessageID: 1, UserID: "user-1", Requested: true}); err != nil {
+		t.Fatalf("archiveMessageLinks returned error: %v", err)
+	}
+	if len(*saved) != 1 || (*saved)[0].Status != archiveStatusReady {
+		t.Fatalf("expected requested archive to be stored, got %+v", *saved)
+	}
+}
+
+func TestArchiveMessageLinks_BlocksPrivateAddresses(t *testing.T) {
+	server := newArchiveTestServer(t)
+	saved := stubMessageArchives(t, server.URL, true, false)
+
+	if err := archiveMessageLinks(archiveJob{MessageID: 1, UserID: "user-1"}); err != nil {
+		t.Fatalf("archiveMessageLinks returned error: %v", err)
+	}
+	if len(*saved) != 1 {
+		t.Fatalf("expected failure to be recorded, got %+v", *saved)
+	}
+	if archive := (*saved)[0]; archive.Status != archiveStatusFailed || archive.Error != webfetch.ErrBlockedAddress.Error() {
+		t.Fatalf("expected blocked fetch to be recorded as failed, got %+v", archive)
+	}
+}
+
+func TestGetMessageArchiveHandler(t *testing.T) {
+	stubMessageArchives(t, "", true, true)
+	listMessageArchives = func(messageID int, userID string) ([]messageArchive, error) {
+		if messageID != 1 {
+			return nil, sql.ErrNoRows
+		}
+		return []messageArchive{{
+			ID:         3,
+			URL:        "https://example.com/a",
+			Status:     archiveStatusReady,
+			Title:      "A",
+			Text:       "Body",
+			ArchivedAt: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+			HasImage:   true,
+			imageKey:   "users/user-1/key",
+		}}, nil
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/messages/{id}/archive", getMessageArchiveHandler)
+
+	cases := map[string]struct {
+		status int
+		body   string
+	}{
+		"/api/messages/1/archive": {
+			http.StatusOK,
+			`{"message_id":1,"archives":[{"id":3,"url":"https://example.com/a","status":"ready","title":"A","text":"Body","has_image":true,"archived_at":"2026-03-10T12:00:00Z"}]}` + "\n",
+		},
+		"/api/messages/2/archive": {http.StatusNotFound, `{"error":"message not found"}` + "\n"},
+		"/api/messages/x/archive": {http.StatusBadRequest, `{"error":"invalid message id"}` + "\n"},
+	}
+	for path, want := range cases {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != want.status {
+			t.Fatalf("%s: expected status %d, got %d", path, want.status, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != want.body {
+			t.Fatalf("%s: unexpected response body: %s", path, strings.TrimSpace(body))
+		}
+	}
+}
+
+func TestRequestMessageArchiveHandler_Enqueues(t *testing.T) {
+	stubMessageArchives(t, "", false, true)
+	originalQueue := archiveQueue
+	t.Cleanup(func() {
+		archiveQueue = originalQueue
+	})
+	archiveQueue = newWorkQueue("message archive", archiveMessageLinks)
+
+	router := chi.NewRouter()
+	router.Post("/api/messages/{id}/archive", requestMessageArchiveHandler)
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/1/archive", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, recorder.Code)
+	}
+	want := archiveJob{MessageID: 1, UserID: "user-1", Requested: true}
+	if len(archiveQueue.queue) != 1 || archiveQueue.queue[0] != want {
+		t.Fatalf("expected %+v to be queued, got %+v", want, archiveQueue.queue)
+	}
+}
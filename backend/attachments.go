@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+
+	"futto-note/backend/blobstore"
+	"futto-note/backend/imaging"
+)
+
+const (
+	defaultAttachmentMaxBytes   = 25 << 20
+	defaultAttachmentQuotaBytes = 1 << 30
+	maxAttachmentsPerUpload     = 10
+	maxAttachmentFilenameBytes  = 255
+	contentSniffBytes           = 512
+)
+
+const (
+	attachmentStatusReady      = "ready"
+	attachmentStatusProcessing = "processing"
+	attachmentStatusFailed     = "failed"
+)
+
+var (
+	errAttachmentQuotaExceeded = errors.New("attachment quota exceeded")
+	errAttachmentTooLarge      = errors.New("attachment too large")
+)
+
+var blobStore blobstore.Store
+
+// StorageKey はクライアントに見せない
+type attachment struct {
+	ID          int       `json:"id"`
+	MessageID   int       `json:"message_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Status      string    `json:"status"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Thumbnails  []int64   `json:"thumbnails,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	StorageKey  string    `json:"-"`
+}
+
+type attachmentListResponse struct {
+	Attachments []attachment `json:"attachments"`
+}
+
+func attachmentMaxBytes() int64 {
+	return readByteLimitEnv("ATTACHMENT_MAX_BYTES", defaultAttachmentMaxBytes)
+}
+
+func attachmentQuotaBytes() int64 {
+	return readByteLimitEnv("ATTACHMENT_QUOTA_BYTES", defaultAttachmentQuotaBytes)
+}
+
+func readByteLimitEnv(name string, fallback int64) int64 {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+const attachmentColumns = `id, message_id, filename, content_type, size, status,
+	COALESCE(width, 0), COALESCE(height, 0), thumbnail_sizes, created_at, storage_key`
+
+func scanAttachment(row rowScanner) (attachment, error) {
+	var a attachment
+	var thumbnails pq.Int64Array
+	err := row.Scan(&a.ID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.Status,
+		&a.Width, &a.Height, &thumbnails, &a.CreatedAt, &a.StorageKey)
+	a.Thumbnails = thumbnails
+	return a, err
+}
+
+// メッセージが見つからなければ sql.ErrNoRows を返す
+var attachmentUsage = func(messageID int, userID string) (int64, error) {
+	var used int64
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`SELECT COALESCE((SELECT SUM(size) FROM attachments WHERE user_id = $2), 0)
+			 FROM messages
+			 WHERE id = $1 AND user_id = $2`,
+			messageID,
+			userID,
+		).Scan(&used)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// 同じユーザーの同時アップロードで容量上限を超えないようアドバイザリロックで直列化する
+var insertAttachment = func(userID string, a attachment, quota int64) (attachment, error) {
+	var inserted attachment
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "attachments:"+userID); err != nil {
+			return err
+		}
+
+		var used int64
+		err := tx.QueryRow(
+			`SELECT COALESCE((SELECT SUM(size) FROM attachments WHERE user_id = $2), 0)
+			 FROM messages
+			 WHERE id = $1 AND user_id = $2`,
+			a.MessageID,
+			userID,
+		).Scan(&used)
+		if err != nil {
+			return err
+		}
+		if used+a.Size > quota {
+			return errAttachmentQuotaExceeded
+		}
+
+		inserted, err = scanAttachment(tx.QueryRow(
+			`INSERT INTO attachments (message_id, user_id, storage_key, filename, content_type, size, status)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7)
+			 RETURNING `+attachmentColumns,
+			a.MessageID,
+			userID,
+			a.StorageKey,
+			a.Filename,
+			a.ContentType,
+			a.Size,
+			a.Status,
+		))
+		return err
+	})
+	if err != nil {
+		return attachment{}, err
+	}
+	return inserted, nil
+}
+
+var listAttachments = func(messageID int, userID string) ([]attachment, error) {
+	attachments := make([]attachment, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND user_id = $2)",
+			messageID,
+			userID,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		rows, err := tx.Query(
+			`SELECT `+attachmentColumns+`
+			 FROM attachments
+			 WHERE message_id = $1 AND user_id = $2
+			 ORDER BY id ASC`,
+			messageID,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			a, err := scanAttachment(rows)
+			if err != nil {
+				return err
+			}
+			attachments = append(attachments, a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+var findAttachment = func(id int, userID string) (attachment, error) {
+	var a attachment
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		a, err = scanAttachment(tx.QueryRow(
+			`SELECT `+attachmentColumns+` FROM attachments WHERE id = $1 AND user_id = $2`,
+			id,
+			userID,
+		))
+		return err
+	})
+	if err != nil {
+		return attachment{}, err
+	}
+	return a, nil
+}
+
+var deleteAttachment = func(id int, userID string) error {
+	var storageKey string
+	var thumbnailSizes pq.Int64Array
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			"DELETE FROM attachments WHERE id = $1 AND user_id = $2 RETURNING storage_key, thumbnail_sizes",
+			id,
+			userID,
+		).Scan(&storageKey, &thumbnailSizes)
+	})
+	if err != nil {
+		return err
+	}
+
+	removeBlobs(attachmentBlobKeys(storageKey, thumbnailSizes))
+	return nil
+}
+
+// 条件に合う添付の元ファイルとサムネイルのキーをまとめて返す
+func listAttachmentKeys(tx *sql.Tx, where string, args ...any) ([]string, error) {
+	rows, err := tx.Query("SELECT storage_key, thumbnail_sizes FROM attachments WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		var sizes pq.Int64Array
+		if err := rows.Scan(&key, &sizes); err != nil {
+			return nil, err
+		}
+		keys = append(keys, attachmentBlobKeys(key, sizes)...)
+	}
+	return keys, rows.Err()
+}
+
+func attachmentBlobKeys(storageKey string, thumbnailSizes []int64) []string {
+	keys := []string{storageKey}
+	for _, size := range thumbnailSizes {
+		keys = append(keys, thumbnailKey(storageKey, int(size)))
+	}
+	return keys
+}
+
+// サムネイルは元ファイルの隣に置く
+func thumbnailKey(storageKey string, size int) string {
+	return fmt.Sprintf("%s-thumb-%d", storageKey, size)
+}
+
+// DB の行を消した後に呼ぶ。ブロブが残っても参照はされないので失敗はログに残すだけにする
+func removeBlobs(keys []string) {
+	for _, key := range keys {
+		if err := blobStore.Delete(context.Background(), key); err != nil {
+			log.Printf("failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+func newAttachmentStorageKey(userID string) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	return "users/" + userID + "/" + token[:32], nil
+}
+
+// パス区切りや制御文字を落とし、ダウンロード時のファイル名として安全な形にする
+func sanitizeAttachmentFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(truncateString(name, maxAttachmentFilenameBytes))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func uploadAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "id")
+	messageID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	used, err := attachmentUsage(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	maxBytes := attachmentMaxBytes()
+	quota := attachmentQuotaBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes*maxAttachmentsPerUpload+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid multipart body")
+		return
+	}
+
+	// 途中で失敗したら、このリクエストで保存した分は取り消す
+	created := make([]attachment, 0)
+	discard := func() {
+		for _, a := range created {
+			if err := deleteAttachment(a.ID, userID); err != nil {
+				log.Printf("failed to discard attachment %d: %v", a.ID, err)
+			}
+		}
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			discard()
+			writeError(w, http.StatusBadRequest, "invalid multipart body")
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(created) >= maxAttachmentsPerUpload {
+			part.Close()
+			discard()
+			writeError(w, http.StatusBadRequest, "too many files")
+			return
+		}
+
+		stored, err := storeAttachment(r.Context(), userID, messageID, part.FileName(), part, min(maxBytes, quota-used), quota)
+		part.Close()
+		if err != nil {
+			discard()
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			case errors.Is(err, errAttachmentTooLarge) && maxBytes <= quota-used:
+				writeError(w, http.StatusRequestEntityTooLarge, "file too large")
+			case errors.Is(err, errAttachmentTooLarge), errors.Is(err, errAttachmentQuotaExceeded):
+				writeError(w, http.StatusRequestEntityTooLarge, "attachment quota exceeded")
+			case errors.Is(err, sql.ErrNoRows):
+				writeError(w, http.StatusNotFound, "message not found")
+			default:
+				writeError(w, http.StatusInternalServerError, "internal server error")
+			}
+			return
+		}
+
+		created = append(created, stored)
+		used += stored.Size
+	}
+
+	if len(created) == 0 {
+		writeError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	for _, a := range created {
+		if a.Status == attachmentStatusProcessing {
+			imageQueue.enqueue(imageJob{AttachmentID: a.ID, UserID: userID})
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, attachmentListResponse{Attachments: created})
+}
+
+// Content-Type はクライアントの申告ではなく先頭バイトから判定する
+func storeAttachment(ctx context.Context, userID string, messageID int, filename string, content io.Reader, limit int64, quota int64) (attachment, error) {
+	if limit <= 0 {
+		return attachment{}, errAttachmentQuotaExceeded
+	}
+
+	buffered := bufio.NewReaderSize(content, contentSniffBytes)
+	head, err := buffered.Peek(contentSniffBytes)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return attachment{}, err
+	}
+	contentType := http.DetectContentType(head)
+
+	key, err := newAttachmentStorageKey(userID)
+	if err != nil {
+		return attachment{}, err
+	}
+
+	limited := &io.LimitedReader{R: buffered, N: limit + 1}
+	size, err := blobStore.Put(ctx, key, limited, contentType)
+	if err != nil {
+		removeBlobs([]string{key})
+		return attachment{}, err
+	}
+	if size > limit {
+		removeBlobs([]string{key})
+		return attachment{}, errAttachmentTooLarge
+	}
+
+	status := attachmentStatusReady
+	if imaging.Supported(contentType) {
+		status = attachmentStatusProcessing
+	}
+
+	stored, err := insertAttachment(userID, attachment{
+		MessageID:   messageID,
+		Filename:    sanitizeAttachmentFilename(filename),
+		ContentType: contentType,
+		Size:        size,
+		Status:      status,
+		StorageKey:  key,
+	}, quota)
+	if err != nil {
+		removeBlobs([]string{key})
+		return attachment{}, err
+	}
+	return stored, nil
+}
+
+func listAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "id")
+	messageID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	attachments, err := listAttachments(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, attachmentListResponse{Attachments: attachments})
+}
+
+// Range と If-Modified-Since は http.ServeContent に任せる。
+// 画像以外はブラウザで開かせず、保存させる
+func downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "attachmentID")
+	attachmentID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+
+	a, err := findAttachment(attachmentID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	// 再起動で処理待ちの行が取り残されることがあるので、ここでも投入し直す
+	if a.Status == attachmentStatusProcessing {
+		imageQueue.enqueue(imageJob{AttachmentID: a.ID, UserID: userID})
+		writeError(w, http.StatusConflict, "attachment is processing")
+		return
+	}
+
+	// 処理できなかった画像は EXIF などを落とせていないので、元ファイルを配信しない
+	if a.Status == attachmentStatusFailed {
+		writeError(w, http.StatusGone, "attachment could not be processed")
+		return
+	}
+
+	disposition := "attachment"
+	if a.Status == attachmentStatusReady && strings.HasPrefix(a.ContentType, "image/") {
+		disposition = "inline"
+	}
+	serveBlob(w, r, a.StorageKey, a.ContentType, disposition, a.Filename, a.CreatedAt)
+}
+
+func downloadThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	attachmentID, err := strconv.Atoi(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+	size, err := strconv.ParseInt(chi.URLParam(r, "size"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid thumbnail size")
+		return
+	}
+
+	a, err := findAttachment(attachmentID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if !slices.Contains(a.Thumbnails, size) {
+		writeError(w, http.StatusNotFound, "thumbnail not found")
+		return
+	}
+
+	serveBlob(w, r, thumbnailKey(a.StorageKey, int(size)), a.ContentType, "inline", a.Filename, a.CreatedAt)
+}
+
+func serveBlob(w http.ResponseWriter, r *http.Request, key string, contentType string, disposition string, filename string, modified time.Time) {
+	object, err := blobStore.Open(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	defer object.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=0")
+	http.ServeContent(w, r, "", modified, object)
+}
+
+func deleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "attachmentID")
+	attachmentID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+
+	if err := deleteAttachment(attachmentID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
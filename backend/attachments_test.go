@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"futto-note/backend/blobstore"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// ローカルのブロブストアと、DB の代わりにメモリ上で添付を管理するスタブを用意する
+func stubAttachmentStore(t *testing.T) (string, *[]attachment) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := blobstore.NewLocal(dir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+
+	originalStore := blobStore
+	originalUsage := attachmentUsage
+	originalInsert := insertAttachment
+	originalFind := findAttachment
+	originalDelete := deleteAttachment
+	originalQueue := imageQueue
+	t.Cleanup(func() {
+		imageQueue = originalQueue
+		blobStore = originalStore
+		attachmentUsage = originalUsage
+		insertAttachment = originalInsert
+		findAttachment = originalFind
+		deleteAttachment = originalDelete
+	})
+
+	stored := make([]attachment, 0)
+	blobStore = store
+	// ワーカーは起動せず、積まれたジョブだけを確認できるようにする
+	imageQueue = newWorkQueue("image attachment", processImageAttachment)
+	attachmentUsage = func(messageID int, userID string) (int64, error) {
+		if messageID != 1 {
+			return 0, sql.ErrNoRows
+		}
+		var used int64
+		for _, a := range stored {
+			used += a.Size
+		}
+		return used, nil
+	}
+	insertAttachment = func(userID string, a attachment, quota int64) (attachment, error) {
+		a.ID = len(stored) + 1
+		a.CreatedAt = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+		stored = append(stored, a)
+		return a, nil
+	}
+	findAttachment = func(id int, userID string) (attachment, error) {
+		for _, a := range stored {
+			if a.ID == id {
+				return a, nil
+			}
+		}
+		return attachment{}, sql.ErrNoRows
+	}
+	deleteAttachment = func(id int, userID string) error {
+		for i, a := range stored {
+			if a.ID == id {
+				stored = append(stored[:i], stored[i+1:]...)
+				removeBlobs([]string{a.StorageKey})
+				return nil
+			}
+		}
+		return sql.ErrNoRows
+	}
+
+	return dir, &stored
+}
+
+func performAttachmentUpload(t *testing.T, messageID string, files map[string][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("failed to create form file: %v", err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+
+	router := chi.NewRouter()
+	router.Post("/api/messages/{id}/attachments", uploadAttachmentsHandler)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/"+messageID+"/attachments", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func countBlobs(t *testing.T, dir string) int {
+	t.Helper()
+
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to walk blob dir: %v", err)
+	}
+	return count
+}
+
+func TestUploadAttachmentsHandler_SniffsContentType(t *testing.T) {
+	dir, stored := stubAttachmentStore(t)
+
+	content := append(append([]byte{}, pngHeader...), bytes.Repeat([]byte{0}, 100)...)
+	recorder := performAttachmentUpload(t, "1", map[string][]byte{"../../whiteboard.txt": content})
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+
+	var response attachmentListResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(response.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(response.Attachments))
+	}
+
+	got := response.Attachments[0]
+	if got.ContentType != "image/png" || got.Filename != "whiteboard.txt" || got.Size != int64(len(content)) {
+		t.Fatalf("unexpected attachment: %+v", got)
+	}
+	if len(*stored) != 1 || countBlobs(t, dir) != 1 {
+		t.Fatalf("expected one stored attachment and blob")
+	}
+}
+
+func TestUploadAttachmentsHandler_RejectsOversizedFile(t *testing.T) {
+	dir, stored := stubAttachmentStore(t)
+	t.Setenv("ATTACHMENT_MAX_BYTES", "64")
+
+	recorder := performAttachmentUpload(t, "1", map[string][]byte{"big.bin": bytes.Repeat([]byte("a"), 65)})
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "{\"error\":\"file too large\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+	if len(*stored) != 0 || countBlobs(t, dir) != 0 {
+		t.Fatalf("expected oversized upload to leave nothing behind")
+	}
+}
+
+func TestUploadAttachmentsHandler_EnforcesQuota(t *testing.T) {
+	dir, stored := stubAttachmentStore(t)
+	t.Setenv("ATTACHMENT_QUOTA_BYTES", "100")
+
+	first := performAttachmentUpload(t, "1", map[string][]byte{"a.txt": bytes.Repeat([]byte("a"), 80)})
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected first upload to succeed, got %d", first.Code)
+	}
+
+	recorder := performAttachmentUpload(t, "1", map[string][]byte{"b.txt": bytes.Repeat([]byte("b"), 30)})
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "{\"error\":\"attachment quota exceeded\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+	if len(*stored) != 1 || countBlobs(t, dir) != 1 {
+		t.Fatalf("expected only the first attachment to remain")
+	}
+}
+
+func TestUploadAttachmentsHandler_NotFoundForOtherUsersMessage(t *testing.T) {
+	stubAttachmentStore(t)
+
+	recorder := performAttachmentUpload(t, "2", map[string][]byte{"a.txt": []byte("a")})
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestDownloadAttachmentHandler_ServesRange(t *testing.T) {
+	_, stored := stubAttachmentStore(t)
+
+	upload := performAttachmentUpload(t, "1", map[string][]byte{"memo.html": []byte("<html><body>0123456789</body></html>")})
+	if upload.Code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", upload.Code)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/attachments/{attachmentID}", downloadAttachmentHandler)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/attachments/1", nil)
+	request.Header.Set("Range", "bytes=12-21")
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d", http.StatusPartialContent, recorder.Code)
+	}
+	if body, _ := io.ReadAll(recorder.Body); string(body) != "0123456789" {
+		t.Fatalf("unexpected range body: %q", body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != (*stored)[0].ContentType {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); disposition != "attachment; filename=memo.html" {
+		t.Fatalf("expected HTML to be served as a download, got %s", disposition)
+	}
+	if recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected nosniff header")
+	}
+}
+
+func TestDownloadAttachmentHandler_NotFound(t *testing.T) {
+	stubAttachmentStore(t)
+
+	router := chi.NewRouter()
+	router.Get("/api/attachments/{attachmentID}", downloadAttachmentHandler)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/attachments/99", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "{\"error\":\"attachment not found\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestSanitizeAttachmentFilename(t *testing.T) {
+	cases := map[string]string{
+		"receipt.jpg":          "receipt.jpg",
+		`C:\Users\me\scan.pdf`: "scan.pdf",
+		"../../etc/passwd":     "passwd",
+		"line\nbreak.txt":      "linebreak.txt",
+		"":                     "file",
+		"..":                   "file",
+	}
+	for input, expected := range cases {
+		if got := sanitizeAttachmentFilename(input); got != expected {
+			t.Fatalf("sanitizeAttachmentFilename(%q) = %q, want %q", input, got, expected)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+
+	auditEventLogin          = "login"
+	auditEventLogout         = "logout"
+	auditEventUnauthorized   = "unauthorized"
+	auditEventPasswordChange = "password_change"
+	auditEventPasswordReset  = "password_reset"
+	auditEventMessageDelete  = "message_delete"
+	auditEventMessageImport  = "message_import"
+	auditEventAccountDelete  = "account_delete"
+
+	defaultAuditRetentionDays   = 365
+	defaultAuditListLimit       = 50
+	maxAuditListLimit           = 200
+	maxAuditExportEvents        = 10000
+	maxAuditIPLength            = 64 // audit_events.ip の長さ
+	auditRetentionPurgeInterval = 24 * time.Hour
+)
+
+type auditEvent struct {
+	ID        int64             `json:"id"`
+	UserID    string            `json:"-"`
+	EventType string            `json:"event_type"`
+	Outcome   string            `json:"outcome"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type auditEventListResponse struct {
+	Events []auditEvent `json:"events"`
+}
+
+var insertAuditEvent = func(event auditEvent) error {
+	var userID any
+	if event.UserID != "" {
+		userID = event.UserID
+	}
+
+	var details any
+	if len(event.Details) > 0 {
+		encoded, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		details = string(encoded)
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO audit_events (user_id, event_type, outcome, ip, user_agent, details)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		userID, event.EventType, event.Outcome, event.IP, event.UserAgent, details,
+	)
+	return err
+}
+
+var listAuditEvents = func(userID string, beforeID int64, limit int) ([]auditEvent, error) {
+	rows, err := db.Query(
+		`SELECT id, event_type, outcome, ip, user_agent, details, created_at
+		 FROM audit_events
+		 WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+		 ORDER BY id DESC
+		 LIMIT $3`,
+		userID, beforeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]auditEvent, 0)
+	for rows.Next() {
+		var event auditEvent
+		var details []byte
+		if err := rows.Scan(&event.ID, &event.EventType, &event.Outcome, &event.IP, &event.UserAgent, &details, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &event.Details); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+var purgeAuditEvents = func(olderThan time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM audit_events WHERE created_at < $1", olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 監査ログの書き込み失敗でリクエスト自体を失敗させない
+func recordAudit(r *http.Request, userID string, eventType string, outcome string, details map[string]string) {
+	event := auditEvent{
+		UserID:    userID,
+		EventType: eventType,
+		Outcome:   outcome,
+		IP:        clientIP(r),
+		UserAgent: truncateString(r.UserAgent(), 512),
+		Details:   details,
+	}
+
+	if err := insertAuditEvent(event); err != nil {
+		log.Printf(
+			"failed to record audit event %s: user_id=%s outcome=%s ip=%s details=%v: %v",
+			eventType, userID, outcome, event.IP, details, err,
+		)
+	}
+}
+
+// X-Forwarded-For は各プロキシが末尾に接続元を追記していくので、左側はクライアントが自由に書ける。
+// 信頼するプロキシの段数だけ右から数えた値を使い、IP として読めなければ接続元のアドレスを使う
+func clientIP(r *http.Request) string {
+	if hops := trustedProxyHops(); hops > 0 {
+		entries := make([]string, 0)
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(value, ",")...)
+		}
+		if len(entries) >= hops {
+			if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-hops])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return truncateString(host, maxAuditIPLength)
+}
+
+// TRUST_PROXY_HOPS で段数を指定する。TRUST_PROXY_HEADERS=true は 1 段とみなす
+func trustedProxyHops() int {
+	if value := os.Getenv("TRUST_PROXY_HOPS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+		log.Printf("invalid TRUST_PROXY_HOPS: %q", value)
+		return 0
+	}
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		return 1
+	}
+	return 0
+}
+
+func truncateString(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	return strings.ToValidUTF8(value[:max], "")
+}
+
+func auditRetention() time.Duration {
+	days := defaultAuditRetentionDays
+	if value := os.Getenv("AUDIT_RETENTION_DAYS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func startAuditRetentionWorker() {
+	go func() {
+		ticker := time.NewTicker(auditRetentionPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			purged, err := purgeAuditEvents(time.Now().Add(-auditRetention()))
+			if err != nil {
+				log.Printf("failed to purge audit events: %v", err)
+			} else if purged > 0 {
+				log.Printf("purged %d audit events", purged)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	limit := defaultAuditListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxAuditListLimit {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	var beforeID int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid before")
+			return
+		}
+		beforeID = parsed
+	}
+
+	events, err := listAuditEvents(userID, beforeID, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, auditEventListResponse{Events: events})
+}
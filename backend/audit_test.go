@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ハンドラのテストでは DB が無いため、監査ログの書き込みは既定で捨てる
+func TestMain(m *testing.M) {
+	insertAuditEvent = func(event auditEvent) error {
+		return nil
+	}
+	os.Exit(m.Run())
+}
+
+func captureAuditEvents(t *testing.T) *[]auditEvent {
+	t.Helper()
+
+	original := insertAuditEvent
+	t.Cleanup(func() {
+		insertAuditEvent = original
+	})
+
+	events := &[]auditEvent{}
+	insertAuditEvent = func(event auditEvent) error {
+		*events = append(*events, event)
+		return nil
+	}
+	return events
+}
+
+func TestAuthMiddleware_RecordsUnauthorizedAccess(t *testing.T) {
+	events := captureAuditEvents(t)
+
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Get("/api/messages", listMessagesHandler)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	request.RemoteAddr = "192.0.2.10:54321"
+	request.Header.Set("User-Agent", "test-agent")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if len(*events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(*events))
+	}
+
+	event := (*events)[0]
+	if event.EventType != auditEventUnauthorized || event.Outcome != auditOutcomeFailure {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+
+	if event.IP != "192.0.2.10" || event.UserAgent != "test-agent" {
+		t.Fatalf("unexpected client info: ip=%s user_agent=%s", event.IP, event.UserAgent)
+	}
+
+	if event.Details["path"] != "/api/messages" || event.Details["reason"] != "missing_session" {
+		t.Fatalf("unexpected details: %v", event.Details)
+	}
+}
+
+func TestDeleteMessageHandler_RecordsAuditEvent(t *testing.T) {
+	events := captureAuditEvents(t)
+
+	originalDeleteMessage := deleteMessage
+	t.Cleanup(func() {
+		deleteMessage = originalDeleteMessage
+	})
+	deleteMessage = func(id int, userID string) (bool, error) {
+		return true, nil
+	}
+
+	router := chi.NewRouter()
+	router.Delete("/api/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), userIDContextKey, "user-1")
+		deleteMessageHandler(w, r.WithContext(ctx))
+	})
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/messages/42", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if len(*events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(*events))
+	}
+
+	event := (*events)[0]
+	if event.UserID != "user-1" || event.EventType != auditEventMessageDelete || event.Details["message_id"] != "42" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+func TestClientIP_UsesForwardedHeaderOnlyWhenTrusted(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	// 左端はクライアントが送ってきた偽の値、右端がプロキシの追記した接続元
+	request.Header.Set("X-Forwarded-For", "192.0.2.66, 198.51.100.7, 203.0.113.5")
+
+	if ip := clientIP(request); ip != "10.0.0.1" {
+		t.Fatalf("expected remote address, got %s", ip)
+	}
+
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	if ip := clientIP(request); ip != "203.0.113.5" {
+		t.Fatalf("expected rightmost forwarded address, got %s", ip)
+	}
+
+	t.Setenv("TRUST_PROXY_HOPS", "2")
+	if ip := clientIP(request); ip != "198.51.100.7" {
+		t.Fatalf("expected address before the second proxy, got %s", ip)
+	}
+
+	t.Setenv("TRUST_PROXY_HOPS", "4")
+	if ip := clientIP(request); ip != "10.0.0.1" {
+		t.Fatalf("expected remote address when the header is too short, got %s", ip)
+	}
+}
+
+func TestClientIP_IgnoresInvalidForwardedAddress(t *testing.T) {
+	t.Setenv("TRUST_PROXY_HEADERS", "true")
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "[2001:db8::1]:443"
+	request.Header.Set("X-Forwarded-For", strings.Repeat("x", 100))
+
+	if ip := clientIP(request); ip != "2001:db8::1" {
+		t.Fatalf("expected remote address, got %s", ip)
+	}
+}
+
+func TestListAuditEventsHandler_RejectsInvalidLimit(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/me/audit?limit=1000", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listAuditEventsHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestListAuditEventsHandler_ReturnsOwnEvents(t *testing.T) {
+	original := listAuditEvents
+	t.Cleanup(func() {
+		listAuditEvents = original
+	})
+
+	gotUserID := ""
+	gotBefore := int64(0)
+	gotLimit := 0
+	listAuditEvents = func(userID string, beforeID int64, limit int) ([]auditEvent, error) {
+		gotUserID = userID
+		gotBefore = beforeID
+		gotLimit = limit
+		return []auditEvent{{ID: 9, EventType: auditEventLogin, Outcome: auditOutcomeSuccess}}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/me/audit?before=10&limit=20", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listAuditEventsHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotUserID != "user-1" || gotBefore != 10 || gotLimit != 20 {
+		t.Fatalf("unexpected arguments: user_id=%s before=%d limit=%d", gotUserID, gotBefore, gotLimit)
+	}
+}
@@ -3,16 +3,17 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -38,6 +39,9 @@ type user struct {
 	Username string `json:"username"`
 }
 
+// パスワードでログインできないアカウント (OIDC で作成したもの) の password_hash
+const unusablePasswordHash = "!"
+
 var errMissingSessionToken = errors.New("session token is missing")
 
 func sessionDuration() time.Duration {
@@ -53,10 +57,20 @@ func generateSessionToken() (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
+// DB にはトークンそのものではなく SHA-256 ダイジェストのみを保存する
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token, err := readSessionToken(r)
 		if err != nil {
+			recordAudit(r, "", auditEventUnauthorized, auditOutcomeFailure, map[string]string{
+				"path":   r.URL.Path,
+				"reason": "missing_session",
+			})
 			writeError(w, http.StatusUnauthorized, "unauthorized")
 			return
 		}
@@ -64,6 +78,10 @@ func authMiddleware(next http.Handler) http.Handler {
 		userID, err := findActiveSessionUserID(token)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
+				recordAudit(r, "", auditEventUnauthorized, auditOutcomeFailure, map[string]string{
+					"path":   r.URL.Path,
+					"reason": "invalid_session",
+				})
 				writeError(w, http.StatusUnauthorized, "unauthorized")
 				return
 			}
@@ -97,14 +115,11 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var dbUser user
-	var passwordHash string
-	err := db.QueryRow(
-		"SELECT id, username, password_hash FROM users WHERE username = $1",
-		username,
-	).Scan(&dbUser.ID, &dbUser.Username, &passwordHash)
+	dbUser, passwordHash, err := findLoginUser(username)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
+			verifyLoginPassword("", password)
+			recordAudit(r, "", auditEventLogin, auditOutcomeFailure, map[string]string{"username": username})
 			writeError(w, http.StatusUnauthorized, "invalid username or password")
 			return
 		}
@@ -112,37 +127,98 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+	ok, needsRehash := verifyLoginPassword(passwordHash, password)
+	if !ok {
+		recordAudit(r, dbUser.ID, auditEventLogin, auditOutcomeFailure, map[string]string{"username": username})
 		writeError(w, http.StatusUnauthorized, "invalid username or password")
 		return
 	}
 
-	token, err := generateSessionToken()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to create session")
-		return
+	if needsRehash {
+		rehashPassword(dbUser.ID, password)
 	}
 
-	expiresAt := time.Now().Add(sessionDuration())
-	if _, err := db.Exec(
-		"INSERT INTO sessions (token, user_id, expires_at) VALUES ($1, $2, $3)",
-		token, dbUser.ID, expiresAt,
-	); err != nil {
+	if err := startSession(w, dbUser.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to create session")
 		return
 	}
 
-	setSessionCookie(w, token)
+	recordAudit(r, dbUser.ID, auditEventLogin, auditOutcomeSuccess, map[string]string{"method": "password"})
 	writeJSON(w, http.StatusOK, userResponse{User: dbUser})
 }
 
+var insertSession = func(tokenHash string, userID string, expiresAt time.Time) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"INSERT INTO sessions (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+			tokenHash, userID, expiresAt,
+		)
+		return err
+	})
+}
+
+var deleteSession = func(tokenHash string) error {
+	return withSessionScope(tokenHash, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+		return err
+	})
+}
+
+func startSession(w http.ResponseWriter, userID string) error {
+	token, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+
+	if err := insertSession(hashSessionToken(token), userID, time.Now().Add(sessionDuration())); err != nil {
+		return err
+	}
+
+	setSessionCookie(w, token)
+	return nil
+}
+
+var findLoginUser = func(username string) (user, string, error) {
+	var dbUser user
+	var passwordHash string
+	err := db.QueryRow(
+		"SELECT id, username, password_hash FROM users WHERE username = $1",
+		username,
+	).Scan(&dbUser.ID, &dbUser.Username, &passwordHash)
+	return dbUser, passwordHash, err
+}
+
+// 照合用のダミー。現在の設定でハッシュ化するので、実在ユーザーの検証と同じだけ時間がかかる
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("futto-note-dummy-password")
+	if err != nil {
+		log.Printf("failed to create dummy password hash: %v", err)
+		return ""
+	}
+	return hash
+})
+
+// 存在しないユーザーやパスワードを持たないユーザー (OIDC で作成) でもハッシュの検証を 1 回行い、
+// 応答時間からユーザー名の有無を推測されないようにする
+func verifyLoginPassword(passwordHash string, password string) (bool, bool) {
+	if passwordHash == "" || passwordHash == unusablePasswordHash {
+		verifyPassword(dummyPasswordHash(), password)
+		return false, false
+	}
+	return verifyPassword(passwordHash, password)
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := readSessionToken(r)
 	if err == nil {
-		if _, execErr := db.Exec("DELETE FROM sessions WHERE token = $1", token); execErr != nil {
+		userID, _ := findActiveSessionUserID(token)
+		if execErr := deleteSession(hashSessionToken(token)); execErr != nil {
 			writeError(w, http.StatusInternalServerError, "failed to delete session")
 			return
 		}
+		if userID != "" {
+			recordAudit(r, userID, auditEventLogout, auditOutcomeSuccess, nil)
+		}
 	}
 
 	clearSessionCookie(w)
@@ -166,15 +242,25 @@ func meHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, userResponse{User: dbUser})
+	settings, err := getUserSettings(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, meResponse{User: dbUser, Settings: settings})
 }
 
-func findActiveSessionUserID(token string) (string, error) {
+var findActiveSessionUserID = func(token string) (string, error) {
+	tokenHash := hashSessionToken(token)
+
 	var userID string
-	err := db.QueryRow(
-		"SELECT user_id FROM sessions WHERE token = $1 AND expires_at > NOW()",
-		token,
-	).Scan(&userID)
+	err := withSessionScope(tokenHash, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			"SELECT user_id FROM sessions WHERE token_hash = $1 AND expires_at > NOW()",
+			tokenHash,
+		).Scan(&userID)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -182,14 +268,18 @@ func findActiveSessionUserID(token string) (string, error) {
 }
 
 func findUserBySessionToken(token string) (user, error) {
+	tokenHash := hashSessionToken(token)
+
 	var dbUser user
-	err := db.QueryRow(
-		`SELECT u.id, u.username
-		 FROM sessions s
-		 JOIN users u ON u.id = s.user_id
-		 WHERE s.token = $1 AND s.expires_at > NOW()`,
-		token,
-	).Scan(&dbUser.ID, &dbUser.Username)
+	err := withSessionScope(tokenHash, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`SELECT u.id, u.username
+			 FROM sessions s
+			 JOIN users u ON u.id = s.user_id
+			 WHERE s.token_hash = $1 AND s.expires_at > NOW()`,
+			tokenHash,
+		).Scan(&dbUser.ID, &dbUser.Username)
+	})
 	if err != nil {
 		return user{}, err
 	}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHashSessionToken_ReturnsSHA256HexDigest(t *testing.T) {
+	// echo -n "abc" | sha256sum
+	expected := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+	if got := hashSessionToken("abc"); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestHashSessionToken_DoesNotStoreRawToken(t *testing.T) {
+	token, err := generateSessionToken()
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	hashed := hashSessionToken(token)
+	if hashed == token {
+		t.Fatalf("hashed token must differ from raw token")
+	}
+
+	if len(hashed) != 64 {
+		t.Fatalf("expected 64 hex characters, got %d", len(hashed))
+	}
+}
+
+func TestLoginHandler_VerifiesDummyHashForUnknownAndPasswordlessUsers(t *testing.T) {
+	originalFind := findLoginUser
+	originalVerify := verifyPassword
+	t.Cleanup(func() {
+		findLoginUser = originalFind
+		verifyPassword = originalVerify
+	})
+
+	findLoginUser = func(username string) (user, string, error) {
+		if username == "oidc-user" {
+			return user{ID: "user-1", Username: username}, unusablePasswordHash, nil
+		}
+		return user{}, "", sql.ErrNoRows
+	}
+	verified := make([]string, 0)
+	verifyPassword = func(hash string, password string) (bool, bool) {
+		verified = append(verified, hash)
+		return false, false
+	}
+
+	for _, username := range []string{"nobody", "oidc-user"} {
+		body := `{"username":"` + username + `","password":"secret"}`
+		request := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		loginHandler(recorder, request)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected status %d, got %d", username, http.StatusUnauthorized, recorder.Code)
+		}
+	}
+
+	if len(verified) != 2 || verified[0] != dummyPasswordHash() || verified[1] != dummyPasswordHash() {
+		t.Fatalf("expected the dummy hash to be verified for each attempt, got %v", verified)
+	}
+	if !strings.HasPrefix(dummyPasswordHash(), "$argon2id$") {
+		t.Fatalf("expected dummy hash to use the configured algorithm, got %q", dummyPasswordHash())
+	}
+}
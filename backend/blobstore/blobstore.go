@@ -0,0 +1,72 @@
+// Package blobstore は添付ファイルなどのバイナリを保存する先を抽象化する。
+// 既定はローカルファイルシステムで、S3 互換ストレージも選べる。
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+
+	defaultLocalDir = "data/blobs"
+	defaultS3Region = "us-east-1"
+)
+
+var (
+	ErrNotFound       = errors.New("blob not found")
+	ErrInvalidKey     = errors.New("invalid blob key")
+	ErrUnknownBackend = errors.New("unknown blob store backend")
+)
+
+// Open が返すオブジェクトは Range リクエストに応えられるよう Seek できる
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (int64, error)
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func NewFromEnv() (Store, error) {
+	backend := os.Getenv("BLOB_STORE")
+	switch backend {
+	case "", BackendLocal:
+		dir := os.Getenv("BLOB_LOCAL_DIR")
+		if dir == "" {
+			dir = defaultLocalDir
+		}
+		return NewLocal(dir)
+	case BackendS3:
+		config := S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			Region:          os.Getenv("S3_REGION"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}
+		if config.Region == "" {
+			config.Region = defaultS3Region
+		}
+		return NewS3(config)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
+
+// キーは "/" 区切りの相対パスに限る。ローカル保存時にディレクトリの外へ出ないようにする
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+type csrfTokenResponse struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !isTrustedRequestOrigin(r) {
+			writeError(w, http.StatusForbidden, "csrf origin check failed")
+			return
+		}
+
+		if isCSRFTokenRequired() && !hasValidCSRFToken(r) {
+			writeError(w, http.StatusForbidden, "csrf token missing or invalid")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := ""
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		token = strings.TrimSpace(cookie.Value)
+	}
+
+	if token == "" {
+		var err error
+		token, err = generateSessionToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to create csrf token")
+			return
+		}
+	}
+
+	setCSRFCookie(w, token)
+	writeJSON(w, http.StatusOK, csrfTokenResponse{CSRFToken: token})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// Sec-Fetch-Site が取れればそれを優先し、なければ Origin を許可リストと照合する。
+// どちらも無いリクエストはブラウザ以外のクライアントとみなして通す。
+func isTrustedRequestOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "same-site", "cross-site":
+		return origin != "" && isAllowedOrigin(origin)
+	}
+
+	if origin == "" {
+		return true
+	}
+
+	if isAllowedOrigin(origin) {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return parsed.Host == r.Host
+}
+
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range allowedOrigins() {
+		if strings.EqualFold(strings.TrimRight(origin, "/"), strings.TrimRight(allowed, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedOrigins() []string {
+	origins := []string{}
+	if origin := os.Getenv("CORS_ORIGIN"); origin != "" {
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+func isCSRFTokenRequired() bool {
+	return isCrossOrigin() && os.Getenv("CSRF_TOKEN_REQUIRED") == "true"
+}
+
+func hasValidCSRFToken(r *http.Request) bool {
+	header := strings.TrimSpace(r.Header.Get(csrfHeaderName))
+	if header == "" {
+		return false
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(strings.TrimSpace(cookie.Value))) == 1
+}
+
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isProduction() || isCrossOrigin(),
+		SameSite: cookieSameSite(),
+		MaxAge:   sessionMaxAgeSecond,
+		Expires:  time.Now().Add(sessionDuration()),
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newCSRFTestHandler() http.Handler {
+	return csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestCSRFMiddleware_AllowsSafeMethodsFromAnyOrigin(t *testing.T) {
+	t.Setenv("CORS_ORIGIN", "https://note.example.com")
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+	request.Header.Set("Origin", "https://evil.example.net")
+	request.Header.Set("Sec-Fetch-Site", "cross-site")
+	recorder := httptest.NewRecorder()
+	newCSRFTestHandler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+}
+
+func TestCSRFMiddleware_RejectsCrossSiteOriginNotInAllowList(t *testing.T) {
+	t.Setenv("CORS_ORIGIN", "https://note.example.com")
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages", nil)
+	request.Header.Set("Origin", "https://evil.example.net")
+	request.Header.Set("Sec-Fetch-Site", "cross-site")
+	recorder := httptest.NewRecorder()
+	newCSRFTestHandler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"csrf origin check failed\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestCSRFMiddleware_AllowsConfiguredOrigin(t *testing.T) {
+	t.Setenv("CORS_ORIGIN", "https://note.example.com")
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/messages/1", nil)
+	request.Header.Set("Origin", "https://note.example.com")
+	request.Header.Set("Sec-Fetch-Site", "cross-site")
+	recorder := httptest.NewRecorder()
+	newCSRFTestHandler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+}
+
+func TestCSRFMiddleware_RequiresMatchingTokenWhenEnabled(t *testing.T) {
+	t.Setenv("CORS_ORIGIN", "https://note.example.com")
+	t.Setenv("CSRF_TOKEN_REQUIRED", "true")
+
+	request := httptest.NewRequest(http.MethodPut, "/api/messages/1", nil)
+	request.Header.Set("Origin", "https://note.example.com")
+	request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token-a"})
+	request.Header.Set(csrfHeaderName, "token-b")
+	recorder := httptest.NewRecorder()
+	newCSRFTestHandler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"csrf token missing or invalid\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+
+	request = httptest.NewRequest(http.MethodPut, "/api/messages/1", nil)
+	request.Header.Set("Origin", "https://note.example.com")
+	request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token-a"})
+	request.Header.Set(csrfHeaderName, "token-a")
+	recorder = httptest.NewRecorder()
+	newCSRFTestHandler().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+}
+
+func TestCSRFTokenHandler_ReturnsTokenAndSetsCookie(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/csrf", nil)
+	recorder := httptest.NewRecorder()
+	csrfTokenHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || cookies[0].Value == "" {
+		t.Fatalf("expected csrf cookie to be set, got %v", cookies)
+	}
+}
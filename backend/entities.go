@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	entityTypeURL     = "url"
+	entityTypeEmail   = "email"
+	entityTypeDate    = "date"
+	entityTypePhone   = "phone"
+	entityTypeHashtag = "hashtag"
+)
+
+// Start/End はバイト位置、RuneStart/RuneEnd は文字 (rune) 位置。どちらも End を含まない。
+// Value は正規化した値 (日付は ISO 8601、電話番号は数字と先頭の + のみ、ハッシュタグは # を除いた名前)
+type messageEntity struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	RuneStart int    `json:"rune_start"`
+	RuneEnd   int    `json:"rune_end"`
+	Value     string `json:"value,omitempty"`
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	// タグ検索 (messageFilterClause) と同じく、英数字と _ 以外の直後の # だけをタグとみなす
+	hashtagEntityPattern = regexp.MustCompile(`#[\p{L}\p{N}_]+`)
+	phonePatterns        = []*regexp.Regexp{
+		regexp.MustCompile(`\+\d{1,3}[ \-]?\(?\d{1,4}\)?[ \-]?\d{1,4}[ \-]?\d{3,4}`),
+		regexp.MustCompile(`\(0\d{1,4}\) ?\d{1,4}-\d{3,4}`),
+		regexp.MustCompile(`0\d{1,4}-\d{1,4}-\d{3,4}`),
+		regexp.MustCompile(`0[5789]0\d{8}|0\d{9}`),
+	}
+	isoDatePattern         = regexp.MustCompile(`(\d{4})[-/.](\d{1,2})[-/.](\d{1,2})`)
+	japaneseDatePattern    = regexp.MustCompile(`(?:(\d{4})年)?(\d{1,2})月(\d{1,2})日`)
+	englishDatePattern     = regexp.MustCompile(`(?i)\b(` + englishMonthNames + `)\.? (\d{1,2})(?:st|nd|rd|th)?(?:, (\d{4}))?\b`)
+	englishDayFirstPattern = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)? (` + englishMonthNames + `)\.?(?: (\d{4}))?\b`)
+)
+
+const englishMonthNames = `january|february|march|april|may|june|july|august|september|october|november|december|` +
+	`jan|feb|mar|apr|jun|jul|aug|sept|sep|oct|nov|dec`
+
+// 月名は先頭 3 文字で引く
+var englishMonths = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// 本文から URL・メールアドレス・日付・電話番号・ハッシュタグを取り出す。
+// 範囲が重なった場合は先に挙げた種類を優先する (URL 中の # や数字を別の実体にしない)
+func extractEntities(body string) []messageEntity {
+	candidates := make([]messageEntity, 0)
+	add := func(entityType string, start int, end int, value string) {
+		candidates = append(candidates, messageEntity{Type: entityType, Start: start, End: end, Value: value})
+	}
+
+	for _, span := range findURLSpans(body) {
+		add(entityTypeURL, span[0], span[1], "")
+	}
+	for _, span := range emailPattern.FindAllStringIndex(body, -1) {
+		add(entityTypeEmail, span[0], span[1], strings.ToLower(body[span[0]:span[1]]))
+	}
+	for _, match := range findDates(body) {
+		add(entityTypeDate, match.start, match.end, match.value)
+	}
+	for _, pattern := range phonePatterns {
+		for _, span := range pattern.FindAllStringIndex(body, -1) {
+			if digitAdjacent(body, span[0], span[1]) {
+				continue
+			}
+			add(entityTypePhone, span[0], span[1], normalizePhone(body[span[0]:span[1]]))
+		}
+	}
+	for _, span := range hashtagEntityPattern.FindAllStringIndex(body, -1) {
+		name := body[span[0]+1 : span[1]]
+		if !hashtagPattern.MatchString(name) || wordAdjacentBefore(body, span[0]) {
+			continue
+		}
+		add(entityTypeHashtag, span[0], span[1], name)
+	}
+
+	entities := make([]messageEntity, 0, len(candidates))
+	for _, candidate := range candidates {
+		overlaps := false
+		for _, accepted := range entities {
+			if candidate.Start < accepted.End && accepted.Start < candidate.End {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			entities = append(entities, candidate)
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Start < entities[j].Start
+	})
+
+	runeOffset, byteOffset := 0, 0
+	for i := range entities {
+		entities[i].Text = body[entities[i].Start:entities[i].End]
+		runeOffset += utf8.RuneCountInString(body[byteOffset:entities[i].Start])
+		entities[i].RuneStart = runeOffset
+		entities[i].RuneEnd = runeOffset + utf8.RuneCountInString(entities[i].Text)
+		runeOffset, byteOffset = entities[i].RuneEnd, entities[i].End
+	}
+	return entities
+}
+
+// 保存用の JSON。抽出結果が空でも [] を入れて「計算済み」を表す。
+// lib/pq は []byte を bytea として送るので文字列で渡す
+func encodeEntities(body string) string {
+	encoded, err := json.Marshal(extractEntities(body))
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// entities 列が NULL の行 (この列を追加する前のメッセージ) はその場で計算する
+func decodeEntities(raw []byte, body string) ([]messageEntity, error) {
+	if raw == nil {
+		return extractEntities(body), nil
+	}
+	var entities []messageEntity
+	if err := json.Unmarshal(raw, &entities); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// 抜粋で本文を切り詰めたときに、はみ出した実体を落とす
+func clipEntities(entities []messageEntity, bodyLength int) []messageEntity {
+	clipped := make([]messageEntity, 0, len(entities))
+	for _, entity := range entities {
+		if entity.End <= bodyLength {
+			clipped = append(clipped, entity)
+		}
+	}
+	return clipped
+}
+
+type dateMatch struct {
+	start int
+	end   int
+	value string
+}
+
+func findDates(body string) []dateMatch {
+	matches := make([]dateMatch, 0)
+	collect := func(pattern *regexp.Regexp, parse func(groups []string) (int, time.Month, int, bool)) {
+		for _, indexes := range pattern.FindAllStringSubmatchIndex(body, -1) {
+			if digitAdjacent(body, indexes[0], indexes[1]) {
+				continue
+			}
+			groups := make([]string, len(indexes)/2)
+			for i := range groups {
+				if indexes[2*i] >= 0 {
+					groups[i] = body[indexes[2*i]:indexes[2*i+1]]
+				}
+			}
+			year, month, day, ok := parse(groups)
+			if !ok {
+				continue
+			}
+			value, ok := formatEntityDate(year, month, day)
+			if !ok {
+				continue
+			}
+			matches = append(matches, dateMatch{start: indexes[0], end: indexes[1], value: value})
+		}
+	}
+
+	collect(isoDatePattern, func(groups []string) (int, time.Month, int, bool) {
+		return atoiOrZero(groups[1]), time.Month(atoiOrZero(groups[2])), atoiOrZero(groups[3]), true
+	})
+	collect(japaneseDatePattern, func(groups []string) (int, time.Month, int, bool) {
+		return atoiOrZero(groups[1]), time.Month(atoiOrZero(groups[2])), atoiOrZero(groups[3]), true
+	})
+	collect(englishDatePattern, func(groups []string) (int, time.Month, int, bool) {
+		month, ok := englishMonths[strings.ToLower(groups[1][:3])]
+		return atoiOrZero(groups[3]), month, atoiOrZero(groups[2]), ok
+	})
+	collect(englishDayFirstPattern, func(groups []string) (int, time.Month, int, bool) {
+		month, ok := englishMonths[strings.ToLower(groups[2][:3])]
+		return atoiOrZero(groups[3]), month, atoiOrZero(groups[1]), ok
+	})
+	return matches
+}
+
+// 年がなければ ISO 8601 の --MM-DD 形式にする。2 月 30 日のような存在しない日付は捨てる
+func formatEntityDate(year int, month time.Month, day int) (string, bool) {
+	checkYear := year
+	if checkYear == 0 {
+		// 2 月 29 日を許すためうるう年で検査する
+		checkYear = 2000
+	}
+	date := time.Date(checkYear, month, day, 0, 0, 0, 0, time.UTC)
+	if date.Month() != month || date.Day() != day {
+		return "", false
+	}
+	if year == 0 {
+		return fmt.Sprintf("--%02d-%02d", month, day), true
+	}
+	return date.Format(time.DateOnly), true
+}
+
+func atoiOrZero(value string) int {
+	parsed, _ := strconv.Atoi(value)
+	return parsed
+}
+
+func normalizePhone(value string) string {
+	var builder strings.Builder
+	for i, r := range value {
+		if r >= '0' && r <= '9' || r == '+' && i == 0 {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// 長い数字列の一部を電話番号や日付として拾わないよう、前後が数字なら除外する
+func digitAdjacent(body string, start int, end int) bool {
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(body[:start]); unicode.IsDigit(r) {
+			return true
+		}
+	}
+	if end < len(body) {
+		if r, _ := utf8.DecodeRuneInString(body[end:]); unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func wordAdjacentBefore(body string, start int) bool {
+	if start == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeLastRuneInString(body[:start])
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
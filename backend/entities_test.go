@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExtractEntities(t *testing.T) {
+	body := "明日の会議は2026年3月10日。資料→https://example.com/docs?id=1#top、連絡先 team@Example.co.jp / 03-1234-5678 #仕事 #2026"
+
+	got := extractEntities(body)
+	want := []struct {
+		entityType string
+		text       string
+		value      string
+	}{
+		{entityTypeDate, "2026年3月10日", "2026-03-10"},
+		{entityTypeURL, "https://example.com/docs?id=1#top", ""},
+		{entityTypeEmail, "team@Example.co.jp", "team@example.co.jp"},
+		{entityTypePhone, "03-1234-5678", "0312345678"},
+		{entityTypeHashtag, "#仕事", "仕事"},
+		{entityTypeHashtag, "#2026", "2026"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d entities, got %+v", len(want), got)
+	}
+
+	runes := []rune(body)
+	for i, entity := range got {
+		if entity.Type != want[i].entityType || entity.Text != want[i].text || entity.Value != want[i].value {
+			t.Fatalf("entity %d: got %+v, want %+v", i, entity, want[i])
+		}
+		if body[entity.Start:entity.End] != entity.Text {
+			t.Fatalf("entity %d: byte offsets %d-%d do not match %q", i, entity.Start, entity.End, entity.Text)
+		}
+		if string(runes[entity.RuneStart:entity.RuneEnd]) != entity.Text {
+			t.Fatalf("entity %d: rune offsets %d-%d do not match %q", i, entity.RuneStart, entity.RuneEnd, entity.Text)
+		}
+		if entity.RuneStart != utf8.RuneCountInString(body[:entity.Start]) {
+			t.Fatalf("entity %d: rune start %d does not match byte start %d", i, entity.RuneStart, entity.Start)
+		}
+	}
+}
+
+func TestExtractEntities_Dates(t *testing.T) {
+	cases := map[string]string{
+		"due 2026-03-10":         "2026-03-10",
+		"due 2026/3/9":           "2026-03-09",
+		"12月24日":                 "--12-24",
+		"on March 10, 2026":      "2026-03-10",
+		"on Sept. 3rd":           "--09-03",
+		"on 10 Mar 2026":         "2026-03-10",
+		"2月29日":                  "--02-29",
+		"2026-02-30 is not real": "",
+		"version 12026-03-10":    "",
+		"marching 5 miles":       "",
+	}
+	for body, want := range cases {
+		var got string
+		for _, entity := range extractEntities(body) {
+			if entity.Type == entityTypeDate {
+				got = entity.Value
+			}
+		}
+		if got != want {
+			t.Errorf("date in %q = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestExtractEntities_PhonesAndHashtags(t *testing.T) {
+	cases := map[string][]string{
+		"携帯は09012345678です":            {"09012345678"},
+		"call +81 90-1234-5678":       {"+819012345678"},
+		"(03) 1234-5678":              {"0312345678"},
+		"order 1234567890123":         {},
+		"issue#12 and foo_#bar":       {},
+		"タグ: #日記 #go_lang、#x":         {"日記", "go_lang", "x"},
+		"https://example.com/#anchor": {"https://example.com/#anchor"},
+	}
+	for body, want := range cases {
+		got := make([]string, 0)
+		for _, entity := range extractEntities(body) {
+			if entity.Value != "" {
+				got = append(got, entity.Value)
+			} else {
+				got = append(got, entity.Text)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("extractEntities(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestDecodeEntities_ComputesMissingColumn(t *testing.T) {
+	entities, err := decodeEntities(nil, "#memo")
+	if err != nil || len(entities) != 1 || entities[0].Value != "memo" {
+		t.Fatalf("expected entities to be computed for NULL column, got %+v, %v", entities, err)
+	}
+
+	stored, err := decodeEntities([]byte(encodeEntities("https://example.com")), "ignored")
+	if err != nil || len(stored) != 1 || stored[0].Type != entityTypeURL {
+		t.Fatalf("expected stored entities to be used, got %+v, %v", stored, err)
+	}
+}
+
+func TestApplyMessageView_ClipsEntitiesToExcerpt(t *testing.T) {
+	body := "#一 と #二"
+	messages := []messageListItem{{ID: 1, Body: body, Entities: extractEntities(body)}}
+
+	applyMessageView(messages, messageFieldID|messageFieldEntities, 3)
+
+	encoded, err := json.Marshal(messages[0])
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	want := `{"entities":[{"type":"hashtag","text":"#一","start":0,"end":4,"rune_start":0,"rune_end":2,"value":"一"}],"id":1}`
+	if string(encoded) != want {
+		t.Fatalf("unexpected response: %s", encoded)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type messageExportFormat struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer, settings userSettings, location *time.Location) messageExportWriter
+}
+
+// 1 件ずつ受け取って書き出し、最後に Close で閉じ括弧などを書く
+type messageExportWriter interface {
+	Write(message messageListItem) error
+	Close() error
+}
+
+var messageExportFormats = map[string]messageExportFormat{
+	"json": {
+		contentType: "application/json",
+		extension:   "json",
+		newWriter: func(w io.Writer, _ userSettings, _ *time.Location) messageExportWriter {
+			return &jsonMessageExportWriter{w: w}
+		},
+	},
+	"ndjson": {
+		contentType: "application/x-ndjson",
+		extension:   "ndjson",
+		newWriter: func(w io.Writer, _ userSettings, _ *time.Location) messageExportWriter {
+			return &ndjsonMessageExportWriter{encoder: json.NewEncoder(w)}
+		},
+	},
+	"markdown": {
+		contentType: "text/markdown; charset=utf-8",
+		extension:   "md",
+		newWriter: func(w io.Writer, settings userSettings, location *time.Location) messageExportWriter {
+			return &markdownMessageExportWriter{w: w, settings: settings, location: location}
+		},
+	},
+	"csv": {
+		contentType: "text/csv; charset=utf-8",
+		extension:   "csv",
+		newWriter: func(w io.Writer, _ userSettings, location *time.Location) messageExportWriter {
+			return &csvMessageExportWriter{w: csv.NewWriter(w), location: location}
+		},
+	},
+	"txt": {
+		contentType: "text/plain; charset=utf-8",
+		extension:   "txt",
+		newWriter: func(w io.Writer, _ userSettings, location *time.Location) messageExportWriter {
+			return &textMessageExportWriter{w: w, location: location}
+		},
+	},
+}
+
+type jsonMessageExportWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonMessageExportWriter) Write(message messageListItem) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	separator := ",\n  "
+	if e.count == 0 {
+		separator = "[\n  "
+	}
+	e.count++
+
+	_, err = e.w.Write(append([]byte(separator), encoded...))
+	return err
+}
+
+func (e *jsonMessageExportWriter) Close() error {
+	closing := "\n]\n"
+	if e.count == 0 {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(e.w, closing)
+	return err
+}
+
+type ndjsonMessageExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonMessageExportWriter) Write(message messageListItem) error {
+	return e.encoder.Encode(message)
+}
+
+func (e *ndjsonMessageExportWriter) Close() error {
+	return nil
+}
+
+// タイムラインの日付区切りと同じく、ローカル日付ごとに見出しを立てる
+type markdownMessageExportWriter struct {
+	w        io.Writer
+	settings userSettings
+	location *time.Location
+	lastDate string
+}
+
+func (e *markdownMessageExportWriter) Write(message messageListItem) error {
+	local := message.CreatedAt.In(e.location)
+	if date := local.Format(time.DateOnly); date != e.lastDate {
+		if _, err := fmt.Fprintf(e.w, "## %s\n\n", e.settings.formatSeparatorDate(local)); err != nil {
+			return err
+		}
+		e.lastDate = date
+	}
+
+	_, err := fmt.Fprintf(e.w, "### %s\n\n%s\n\n", local.Format("15:04"), escapeMarkdownBody(message.Body))
+	return err
+}
+
+var markdownHeadingLinePattern = regexp.MustCompile(`^ {0,3}(#{1,6}([ \t]|$)|=+ *$|-+ *$)`)
+
+// 本文中の "## ..." や "---" が見出しとして扱われ、日付の見出しと紛れないようにする
+func escapeMarkdownBody(body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if markdownHeadingLinePattern.MatchString(line) {
+			trimmed := strings.TrimLeft(line, " ")
+			lines[i] = line[:len(line)-len(trimmed)] + "\\" + trimmed
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *markdownMessageExportWriter) Close() error {
+	return nil
+}
+
+type csvMessageExportWriter struct {
+	w           *csv.Writer
+	location    *time.Location
+	wroteHeader bool
+}
+
+func (e *csvMessageExportWriter) Write(message messageListItem) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	return e.w.Write([]string{
+		strconv.Itoa(message.ID),
+		message.CreatedAt.In(e.location).Format(time.RFC3339),
+		message.Body,
+	})
+}
+
+func (e *csvMessageExportWriter) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+	e.wroteHeader = true
+	return e.w.Write([]string{"id", "created_at", "body"})
+}
+
+func (e *csvMessageExportWriter) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type textMessageExportWriter struct {
+	w        io.Writer
+	location *time.Location
+}
+
+func (e *textMessageExportWriter) Write(message messageListItem) error {
+	_, err := fmt.Fprintf(e.w, "[%s]\n%s\n\n", message.CreatedAt.In(e.location).Format("2006-01-02 15:04"), message.Body)
+	return err
+}
+
+func (e *textMessageExportWriter) Close() error {
+	return nil
+}
+
+// 一覧の表示範囲やページングの指定はエクスポートでは意味がないので、黙って無視せずに拒否する
+var messageExportParameters = map[string]bool{
+	"format":  true,
+	"tz":      true,
+	"from":    true,
+	"to":      true,
+	"tag":     true,
+	"pinned":  true,
+	"starred": true,
+}
+
+func exportMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "json"
+	}
+	format, ok := messageExportFormats[formatName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+
+	values := r.URL.Query()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !messageExportParameters[name] {
+			writeError(w, http.StatusBadRequest, "unsupported parameter: "+name)
+			return
+		}
+	}
+
+	filter, filterLocation, badRequest, err := parseMessageFilter(values, userID, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if badRequest != "" {
+		writeError(w, http.StatusBadRequest, badRequest)
+		return
+	}
+
+	settings, err := getUserSettings(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	location := filterLocation
+	if location == nil {
+		location = settings.location()
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			location, err = loadTimezone(tz)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid tz")
+				return
+			}
+		}
+	}
+
+	filename := fmt.Sprintf("futto-note-messages-%s.%s", time.Now().In(location).Format("20060102"), format.extension)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// ヘッダー送信後はステータスを変えられないので、途中の失敗はログに残して打ち切る
+	buffered := bufio.NewWriter(w)
+	writer := format.newWriter(buffered, settings, location)
+	err = eachUserMessage(userID, filter, writer.Write)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		log.Printf("failed to export messages: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func stubExportMessages(t *testing.T, messages []messageListItem, overrides map[string]json.RawMessage) *messageFilter {
+	t.Helper()
+
+	originalEach := eachUserMessage
+	originalLoad := loadSettingOverrides
+	t.Cleanup(func() {
+		eachUserMessage = originalEach
+		loadSettingOverrides = originalLoad
+	})
+
+	var gotFilter messageFilter
+	eachUserMessage = func(userID string, filter messageFilter, fn func(messageListItem) error) error {
+		gotFilter = filter
+		for _, message := range messages {
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	loadSettingOverrides = func(userID string) (map[string]json.RawMessage, error) {
+		return overrides, nil
+	}
+
+	return &gotFilter
+}
+
+func performExport(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/export"+query, nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	exportMessagesHandler(recorder, request)
+	return recorder
+}
+
+func TestExportMessagesHandler_RejectsUnknownFormat(t *testing.T) {
+	stubExportMessages(t, nil, nil)
+
+	recorder := performExport(t, "?format=pdf")
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid format\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestExportMessagesHandler_WritesEmptyJSONArray(t *testing.T) {
+	stubExportMessages(t, nil, nil)
+
+	recorder := performExport(t, "")
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "[]\n" {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
+
+func TestExportMessagesHandler_WritesNDJSON(t *testing.T) {
+	stubExportMessages(t, []messageListItem{
+		{ID: 1, Body: "first", CreatedAt: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, Body: "second", CreatedAt: time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)},
+	}, nil)
+
+	recorder := performExport(t, "?format=ndjson")
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+
+	expected := "{\"id\":1,\"body\":\"first\",\"created_at\":\"2026-03-10T00:00:00Z\"}\n" +
+		"{\"id\":2,\"body\":\"second\",\"created_at\":\"2026-03-11T00:00:00Z\"}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
+
+func TestExportMessagesHandler_GroupsMarkdownByLocalDay(t *testing.T) {
+	stubExportMessages(t, []messageListItem{
+		{ID: 1, Body: "朝のメモ", CreatedAt: time.Date(2026, 3, 9, 23, 30, 0, 0, time.UTC)},
+		{ID: 2, Body: "昼のメモ", CreatedAt: time.Date(2026, 3, 10, 3, 0, 0, 0, time.UTC)},
+		{ID: 3, Body: "翌日のメモ", CreatedAt: time.Date(2026, 3, 10, 16, 0, 0, 0, time.UTC)},
+	}, map[string]json.RawMessage{"date_separator_format": json.RawMessage(`"yyyy-MM-dd"`)})
+
+	recorder := performExport(t, "?format=markdown&tz=Asia/Tokyo")
+
+	expected := "## 2026-03-10\n\n### 08:30\n\n朝のメモ\n\n### 12:00\n\n昼のメモ\n\n" +
+		"## 2026-03-11\n\n### 01:00\n\n翌日のメモ\n\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
+
+func TestExportMessagesHandler_QuotesCSVFields(t *testing.T) {
+	stubExportMessages(t, []messageListItem{
+		{ID: 1, Body: "a, \"b\"\nc", CreatedAt: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+	}, nil)
+
+	recorder := performExport(t, "?format=csv&tz=UTC")
+
+	expected := "id,created_at,body\n1,2026-03-10T00:00:00Z,\"a, \"\"b\"\"\nc\"\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
+
+func TestExportMessagesHandler_PassesDateRangeAndTag(t *testing.T) {
+	gotFilter := stubExportMessages(t, nil, nil)
+
+	recorder := performExport(t, "?format=txt&from=2026-03-01&to=2026-03-01&tz=UTC&tag=%23日記")
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotFilter.From == nil || !gotFilter.From.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected from: %v", gotFilter.From)
+	}
+	if gotFilter.To == nil || !gotFilter.To.Equal(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected to: %v", gotFilter.To)
+	}
+	if gotFilter.Tag != "日記" {
+		t.Fatalf("expected tag 日記, got %q", gotFilter.Tag)
+	}
+}
+
+func TestExportMessagesHandler_RejectsUnsupportedParameters(t *testing.T) {
+	stubExportMessages(t, nil, nil)
+
+	for _, query := range []string{"?around=10", "?before=3", "?limit=20", "?fields=body", "?excerpt=10", "?include=pinned", "?group=day"} {
+		recorder := performExport(t, query)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
+
+func TestExportMessagesHandler_EscapesMarkdownHeadingsInBody(t *testing.T) {
+	stubExportMessages(t, []messageListItem{
+		{ID: 1, Body: "## 2026-01-01\n本文\n---\n#タグ\n  # 字下げ", CreatedAt: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+	}, nil)
+
+	recorder := performExport(t, "?format=markdown&tz=UTC")
+
+	expected := "## 2026/03/10\n\n### 00:00\n\n\\## 2026-01-01\n本文\n\\---\n#タグ\n  \\# 字下げ\n\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
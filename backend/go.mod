@@ -8,4 +8,11 @@ require (
 	golang.org/x/crypto v0.48.0
 )
 
-require github.com/go-chi/cors v1.2.2
+require (
+	github.com/go-chi/cors v1.2.2
+	golang.org/x/image v0.36.0
+	golang.org/x/net v0.50.0
+	golang.org/x/text v0.34.0
+)
+
+require golang.org/x/sys v0.41.0 // indirect
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/lib/pq"
+
+	"futto-note/backend/imaging"
+)
+
+const defaultImageWorkers = 2
+
+// サムネイルの長辺 (px)
+var thumbnailSizes = []int{160, 480, 1024}
+
+var errImageProcessingStale = errors.New("attachment changed during image processing")
+
+type imageJob struct {
+	AttachmentID int
+	UserID       string
+}
+
+var imageQueue = newWorkQueue("image attachment", processImageAttachment)
+
+func imageWorkers() int {
+	return readWorkerCountEnv("IMAGE_WORKERS", defaultImageWorkers)
+}
+
+func processImageAttachment(job imageJob) error {
+	a, err := findAttachment(job.AttachmentID, job.UserID)
+	if err != nil {
+		// 処理待ちの間に削除された
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if a.Status != attachmentStatusProcessing {
+		return nil
+	}
+
+	ctx := context.Background()
+	data, err := readBlob(ctx, a.StorageKey)
+	if err != nil {
+		return err
+	}
+
+	result, err := imaging.Process(data, a.ContentType, thumbnailSizes)
+	if err != nil {
+		log.Printf("image attachment %d could not be processed: %v", a.ID, err)
+		if err := failImageProcessing(job.UserID, a.ID, a.StorageKey); err != nil {
+			if errors.Is(err, errImageProcessingStale) {
+				return nil
+			}
+			return err
+		}
+		// 元ファイルは位置情報などのメタデータを含んだままなので残さない
+		removeBlobs([]string{a.StorageKey})
+		return nil
+	}
+
+	// 元ファイルは別キーに書き直し、差し替えが確定してから古い方を消す
+	newKey, err := newAttachmentStorageKey(job.UserID)
+	if err != nil {
+		return err
+	}
+	written := make([]string, 0, len(result.Thumbnails)+1)
+	put := func(key string, encoded imaging.Encoded) error {
+		written = append(written, key)
+		_, err := blobStore.Put(ctx, key, bytes.NewReader(encoded.Data), encoded.ContentType)
+		return err
+	}
+
+	if err := put(newKey, result.Original); err != nil {
+		removeBlobs(written)
+		return err
+	}
+	sizes := make([]int64, 0, len(result.Thumbnails))
+	for _, thumbnail := range result.Thumbnails {
+		if err := put(thumbnailKey(newKey, thumbnail.Size), thumbnail.Encoded); err != nil {
+			removeBlobs(written)
+			return err
+		}
+		sizes = append(sizes, int64(thumbnail.Size))
+	}
+
+	processed := attachment{
+		ContentType: result.Original.ContentType,
+		Size:        int64(len(result.Original.Data)),
+		Width:       result.Original.Width,
+		Height:      result.Original.Height,
+		Thumbnails:  sizes,
+		StorageKey:  newKey,
+	}
+	if err := completeImageProcessing(job.UserID, a.ID, a.StorageKey, processed); err != nil {
+		removeBlobs(written)
+		if errors.Is(err, errImageProcessingStale) {
+			return nil
+		}
+		return err
+	}
+
+	removeBlobs([]string{a.StorageKey})
+	return nil
+}
+
+func readBlob(ctx context.Context, key string) ([]byte, error) {
+	object, err := blobStore.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+// 処理中に削除や再処理で行が変わっていたら errImageProcessingStale を返す
+var completeImageProcessing = func(userID string, id int, previousKey string, processed attachment) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`UPDATE attachments
+			 SET status = $1, storage_key = $2, content_type = $3, size = $4,
+			     width = $5, height = $6, thumbnail_sizes = $7
+			 WHERE id = $8 AND user_id = $9 AND status = $10 AND storage_key = $11`,
+			attachmentStatusReady,
+			processed.StorageKey,
+			processed.ContentType,
+			processed.Size,
+			processed.Width,
+			processed.Height,
+			pq.Int64Array(processed.Thumbnails),
+			id,
+			userID,
+			attachmentStatusProcessing,
+			previousKey,
+		)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return errImageProcessingStale
+		}
+		return nil
+	})
+}
+
+// 壊れた画像や大きすぎる画像は failed にする。元ファイルは配信せず、呼び出し側で消す。
+// 処理中に削除や再処理で行が変わっていたら errImageProcessingStale を返す
+var failImageProcessing = func(userID string, id int, storageKey string) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`UPDATE attachments SET status = $1, size = 0
+			 WHERE id = $2 AND user_id = $3 AND status = $4 AND storage_key = $5`,
+			attachmentStatusFailed,
+			id,
+			userID,
+			attachmentStatusProcessing,
+			storageKey,
+		)
+		if err != nil {
+			return fmt.Errorf("mark attachment %d failed: %w", id, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return errImageProcessingStale
+		}
+		return nil
+	})
+}
+
+// 再起動で処理待ちのまま取り残された画像を、利用者をまたいで探す
+var listProcessingImages = func() ([]imageJob, error) {
+	jobs := make([]imageJob, 0)
+	err := withImageSweepScope(func(tx *sql.Tx) error {
+		var err error
+		jobs, err = collectRows(tx, func(row rowScanner) (imageJob, error) {
+			var job imageJob
+			err := row.Scan(&job.AttachmentID, &job.UserID)
+			return job, err
+		}, "SELECT id, user_id FROM attachments WHERE status = $1 ORDER BY id", attachmentStatusProcessing)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// 起動時に processing の画像を積み直す。失敗してもダウンロード時に積み直されるので起動は続ける
+func requeueProcessingImages() {
+	jobs, err := listProcessingImages()
+	if err != nil {
+		log.Printf("failed to requeue processing image attachments: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		imageQueue.enqueue(job)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Orientation=6 (時計回りに 90 度) の Exif を持つ JPEG を作る
+func rotatedJPEG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 6)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func stubImageProcessingResult(t *testing.T, stored *[]attachment) {
+	t.Helper()
+
+	originalComplete := completeImageProcessing
+	originalFail := failImageProcessing
+	t.Cleanup(func() {
+		completeImageProcessing = originalComplete
+		failImageProcessing = originalFail
+	})
+
+	completeImageProcessing = func(userID string, id int, previousKey string, processed attachment) error {
+		for i, a := range *stored {
+			if a.ID == id && a.Status == attachmentStatusProcessing && a.StorageKey == previousKey {
+				a.Status = attachmentStatusReady
+				a.StorageKey = processed.StorageKey
+				a.ContentType = processed.ContentType
+				a.Size = processed.Size
+				a.Width = processed.Width
+				a.Height = processed.Height
+				a.Thumbnails = processed.Thumbnails
+				(*stored)[i] = a
+				return nil
+			}
+		}
+		return errImageProcessingStale
+	}
+	failImageProcessing = func(userID string, id int, storageKey string) error {
+		for i, a := range *stored {
+			if a.ID == id && a.Status == attachmentStatusProcessing && a.StorageKey == storageKey {
+				(*stored)[i].Status = attachmentStatusFailed
+				(*stored)[i].Size = 0
+				return nil
+			}
+		}
+		return errImageProcessingStale
+	}
+}
+
+func TestProcessImageAttachment_StripsExifAndStoresThumbnails(t *testing.T) {
+	dir, stored := stubAttachmentStore(t)
+	stubImageProcessingResult(t, stored)
+
+	upload := performAttachmentUpload(t, "1", map[string][]byte{"photo.jpg": rotatedJPEG(t, 400, 200)})
+	if upload.Code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d: %s", upload.Code, upload.Body.String())
+	}
+	if (*stored)[0].Status != attachmentStatusProcessing {
+		t.Fatalf("expected image to be queued for processing, got %q", (*stored)[0].Status)
+	}
+	if len(imageQueue.queue) != 1 || imageQueue.queue[0].AttachmentID != 1 {
+		t.Fatalf("expected upload to enqueue attachment 1, got %+v", imageQueue.queue)
+	}
+	originalKey := (*stored)[0].StorageKey
+
+	if err := processImageAttachment(imageJob{AttachmentID: 1, UserID: "user-1"}); err != nil {
+		t.Fatalf("processImageAttachment returned error: %v", err)
+	}
+
+	processed := (*stored)[0]
+	if processed.Status != attachmentStatusReady {
+		t.Fatalf("expected status ready, got %q", processed.Status)
+	}
+	if processed.Width != 200 || processed.Height != 400 {
+		t.Fatalf("expected orientation to be applied, got %dx%d", processed.Width, processed.Height)
+	}
+	if len(processed.Thumbnails) != 1 || processed.Thumbnails[0] != 160 {
+		t.Fatalf("expected only thumbnails smaller than the image, got %v", processed.Thumbnails)
+	}
+	if processed.StorageKey == originalKey {
+		t.Fatalf("expected processed image to be stored under a new key")
+	}
+	// 元ファイルは消え、作り直した画像とサムネイルだけが残る
+	if count := countBlobs(t, dir); count != 2 {
+		t.Fatalf("expected 2 blobs after processing, got %d", count)
+	}
+
+	data, err := readBlob(context.Background(), processed.StorageKey)
+	if err != nil {
+		t.Fatalf("failed to read processed blob: %v", err)
+	}
+	if bytes.Contains(data, []byte("Exif")) {
+		t.Fatalf("expected EXIF to be stripped")
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/attachments/{attachmentID}/thumbnails/{size}", downloadThumbnailHandler)
+	for path, status := range map[string]int{
+		"/api/attachments/1/thumbnails/160": http.StatusOK,
+		"/api/attachments/1/thumbnails/480": http.StatusNotFound,
+	} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Fatalf("%s: expected status %d, got %d", path, status, recorder.Code)
+		}
+		if status == http.StatusOK {
+			config, err := jpeg.DecodeConfig(recorder.Body)
+			if err != nil || config.Width != 80 || config.Height != 160 {
+				t.Fatalf("unexpected thumbnail: %+v, %v", config, err)
+			}
+		}
+	}
+}
+
+func TestProcessImageAttachment_MarksCorruptImageFailed(t *testing.T) {
+	dir, stored := stubAttachmentStore(t)
+	stubImageProcessingResult(t, stored)
+
+	// EXIF は読めるが画像としては壊れている JPEG
+	photo := rotatedJPEG(t, 400, 200)
+	upload := performAttachmentUpload(t, "1", map[string][]byte{"broken.jpg": photo[:len(photo)/2]})
+	if upload.Code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", upload.Code)
+	}
+
+	if err := processImageAttachment(imageJob{AttachmentID: 1, UserID: "user-1"}); err != nil {
+		t.Fatalf("processImageAttachment returned error: %v", err)
+	}
+	if (*stored)[0].Status != attachmentStatusFailed {
+		t.Fatalf("expected status failed, got %q", (*stored)[0].Status)
+	}
+	if count := countBlobs(t, dir); count != 0 {
+		t.Fatalf("expected original blob with EXIF to be removed, got %d blobs", count)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/attachments/{attachmentID}", downloadAttachmentHandler)
+	request := httptest.NewRequest(http.MethodGet, "/api/attachments/1", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusGone {
+		t.Fatalf("expected status %d, got %d", http.StatusGone, recorder.Code)
+	}
+	if bytes.Contains(recorder.Body.Bytes(), []byte("Exif")) {
+		t.Fatalf("expected failed image not to be served with EXIF")
+	}
+}
+
+func TestRequeueProcessingImages_EnqueuesStuckAttachments(t *testing.T) {
+	originalList := listProcessingImages
+	originalQueue := imageQueue
+	t.Cleanup(func() {
+		listProcessingImages = originalList
+		imageQueue = originalQueue
+	})
+
+	imageQueue = newWorkQueue("image attachment", processImageAttachment)
+	listProcessingImages = func() ([]imageJob, error) {
+		return []imageJob{{AttachmentID: 3, UserID: "user-1"}, {AttachmentID: 7, UserID: "user-2"}}, nil
+	}
+
+	requeueProcessingImages()
+
+	if len(imageQueue.queue) != 2 || imageQueue.queue[0].AttachmentID != 3 || imageQueue.queue[1].UserID != "user-2" {
+		t.Fatalf("expected stuck attachments to be enqueued, got %+v", imageQueue.queue)
+	}
+}
+
+func TestDownloadAttachmentHandler_ConflictWhileProcessing(t *testing.T) {
+	_, stored := stubAttachmentStore(t)
+
+	performAttachmentUpload(t, "1", map[string][]byte{"photo.jpg": rotatedJPEG(t, 40, 20)})
+	imageQueue = newWorkQueue("image attachment", processImageAttachment)
+
+	router := chi.NewRouter()
+	router.Get("/api/attachments/{attachmentID}", downloadAttachmentHandler)
+	request := httptest.NewRequest(http.MethodGet, "/api/attachments/1", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "{\"error\":\"attachment is processing\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+	// 再起動で取り残された行もダウンロード時に再投入される
+	if len(imageQueue.queue) != 1 || imageQueue.queue[0].AttachmentID != (*stored)[0].ID {
+		t.Fatalf("expected attachment to be re-enqueued, got %+v", imageQueue.queue)
+	}
+}
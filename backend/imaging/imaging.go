@@ -0,0 +1,176 @@
+// Package imaging はアップロードされた画像を安全な形に作り直す。
+// デコードして EXIF などのメタデータを捨て、向きを適用して再エンコードし、サムネイルを作る。
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	// 圧縮爆弾対策。デコード前にヘッダーの寸法で弾く
+	MaxPixels   = 50_000_000
+	jpegQuality = 88
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooLarge          = errors.New("image dimensions too large")
+)
+
+type Encoded struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+type Thumbnail struct {
+	Size int
+	Encoded
+}
+
+type Result struct {
+	Original   Encoded
+	Thumbnails []Thumbnail
+}
+
+// Supported は Process が扱える Content-Type かどうかを返す
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// sizes は長辺のピクセル数。元画像より大きいサイズは作らない。
+// JPEG は JPEG のまま、それ以外は透過を保つため PNG で書き出す
+func Process(data []byte, contentType string, sizes []int) (Result, error) {
+	decode, ok := decoders[contentType]
+	if !ok {
+		return Result{}, ErrUnsupportedFormat
+	}
+
+	config, err := decodeConfig(contentType, data)
+	if err != nil {
+		return Result{}, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return Result{}, ErrTooLarge
+	}
+
+	decoded, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return Result{}, fmt.Errorf("decode %s: %w", contentType, err)
+	}
+
+	oriented := decoded
+	if contentType == "image/jpeg" {
+		oriented = applyOrientation(decoded, jpegOrientation(data))
+	}
+
+	outputType := "image/png"
+	if contentType == "image/jpeg" {
+		outputType = "image/jpeg"
+	}
+
+	original, err := encode(oriented, outputType)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{Original: original}
+
+	bounds := oriented.Bounds()
+	longest := max(bounds.Dx(), bounds.Dy())
+	for _, size := range sizes {
+		if size <= 0 || size >= longest {
+			continue
+		}
+		thumbnail, err := encode(resize(oriented, size), outputType)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Thumbnails = append(result.Thumbnails, Thumbnail{Size: size, Encoded: thumbnail})
+	}
+
+	return result, nil
+}
+
+var decoders = map[string]func(r *bytes.Reader) (image.Image, error){
+	"image/jpeg": func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) },
+	"image/png":  func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) },
+	// アニメーション GIF は先頭フレームだけを使う
+	"image/gif":  func(r *bytes.Reader) (image.Image, error) { return gif.Decode(r) },
+	"image/webp": func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) },
+}
+
+func decodeConfig(contentType string, data []byte) (image.Config, error) {
+	reader := bytes.NewReader(data)
+	var config image.Config
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		config, err = jpeg.DecodeConfig(reader)
+	case "image/png":
+		config, err = png.DecodeConfig(reader)
+	case "image/gif":
+		config, err = gif.DecodeConfig(reader)
+	case "image/webp":
+		config, err = webp.DecodeConfig(reader)
+	default:
+		return image.Config{}, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return image.Config{}, fmt.Errorf("decode %s header: %w", contentType, err)
+	}
+	return config, nil
+}
+
+// 標準のエンコーダーはメタデータを書かないので、作り直すだけで EXIF が消える
+func encode(img image.Image, contentType string) (Encoded, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return Encoded{}, err
+	}
+
+	bounds := img.Bounds()
+	return Encoded{
+		Data:        buf.Bytes(),
+		ContentType: contentType,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+	}, nil
+}
+
+// 縦横比を保ったまま長辺を size に合わせる
+func resize(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
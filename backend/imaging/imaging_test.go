@@ -0,0 +1,149 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// 左半分が赤、右半分が青の横長画像
+func leftRightImage(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// SOI の直後に Orientation だけを持つ Exif APP1 を差し込む
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	data := encoded.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestProcess_AppliesOrientationAndStripsExif(t *testing.T) {
+	data := jpegWithOrientation(t, leftRightImage(64, 32), 6)
+	if jpegOrientation(data) != 6 {
+		t.Fatalf("expected the fixture to carry orientation 6")
+	}
+
+	result, err := Process(data, "image/jpeg", []int{16, 128})
+	if err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+
+	if result.Original.Width != 32 || result.Original.Height != 64 {
+		t.Fatalf("expected rotated 32x64, got %dx%d", result.Original.Width, result.Original.Height)
+	}
+	if bytes.Contains(result.Original.Data, []byte("Exif")) {
+		t.Fatalf("expected EXIF to be stripped")
+	}
+	if jpegOrientation(result.Original.Data) != 1 {
+		t.Fatalf("expected no orientation in output")
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(result.Original.Data))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	// 時計回りに 90 度回すと、元の左側 (赤) が上に来る
+	top, _, _, _ := decoded.At(16, 8).RGBA()
+	bottom, _, _, _ := decoded.At(16, 56).RGBA()
+	if top < 0xC000 || bottom > 0x4000 {
+		t.Fatalf("expected red on top and blue at the bottom, got top=%x bottom=%x", top, bottom)
+	}
+
+	if len(result.Thumbnails) != 1 || result.Thumbnails[0].Size != 16 {
+		t.Fatalf("expected only the 16px thumbnail, got %+v", result.Thumbnails)
+	}
+	if thumbnail := result.Thumbnails[0]; thumbnail.Width != 8 || thumbnail.Height != 16 || thumbnail.ContentType != "image/jpeg" {
+		t.Fatalf("unexpected thumbnail: %dx%d %s", thumbnail.Width, thumbnail.Height, thumbnail.ContentType)
+	}
+}
+
+func TestProcess_KeepsPNGTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+
+	result, err := Process(encoded.Bytes(), "image/png", []int{10})
+	if err != nil {
+		t.Fatalf("process failed: %v", err)
+	}
+
+	if result.Original.ContentType != "image/png" || len(result.Thumbnails) != 1 {
+		t.Fatalf("unexpected result: %s with %d thumbnails", result.Original.ContentType, len(result.Thumbnails))
+	}
+
+	thumbnail, err := png.Decode(bytes.NewReader(result.Thumbnails[0].Data))
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if _, _, _, alpha := thumbnail.At(0, 0).RGBA(); alpha != 0 {
+		t.Fatalf("expected transparent thumbnail, got alpha %x", alpha)
+	}
+}
+
+func TestProcess_RejectsUnsupportedAndCorruptInput(t *testing.T) {
+	if _, err := Process([]byte("%PDF-1.7"), "application/pdf", nil); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+	if _, err := Process([]byte("\x89PNG\r\n\x1a\nbroken"), "image/png", nil); err == nil {
+		t.Fatalf("expected corrupt PNG to fail")
+	}
+}
+
+func TestApplyOrientation_MapsCorners(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.NRGBA{R: 255, A: 255}
+	src.SetNRGBA(0, 0, marker)
+
+	expected := map[int]image.Point{
+		2: {2, 0},
+		3: {2, 1},
+		4: {0, 1},
+		5: {0, 0},
+		6: {1, 0},
+		7: {1, 2},
+		8: {0, 2},
+	}
+	for orientation, point := range expected {
+		dst := applyOrientation(src, orientation)
+		if got := dst.At(point.X, point.Y); got != marker {
+			t.Fatalf("orientation %d: expected marker at %v, got %v", orientation, point, got)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxImportUploadBytes = 100 << 20
+	maxImportLineBytes   = 10 << 20
+	maxImportErrors      = 100
+	importBatchSize      = 500
+)
+
+// Item はエラー報告で元ファイルのどこかを示すためのラベル
+type importedMessage struct {
+	Item      string
+	Body      string
+	CreatedAt time.Time
+	Err       error
+}
+
+type messageImportError struct {
+	Item  string `json:"item"`
+	Error string `json:"error"`
+}
+
+type messageImportReport struct {
+	Imported   int                  `json:"imported"`
+	Duplicates int                  `json:"duplicates"`
+	Failed     int                  `json:"failed"`
+	Errors     []messageImportError `json:"errors"`
+}
+
+// ファイル自体が読めない場合は importFormatError を返し、取り込み全体を取り消す
+type messageImportParser func(r io.Reader, emit func(importedMessage) error) error
+
+type importFormatError struct {
+	err error
+}
+
+func (e importFormatError) Error() string {
+	return e.err.Error()
+}
+
+func (e importFormatError) Unwrap() error {
+	return e.err
+}
+
+var messageImportParsers = map[string]messageImportParser{
+	"ndjson": parseNDJSONImport,
+	"slack":  parseSlackImport,
+	"keep":   parseKeepImport,
+	"enex":   parseENEXImport,
+}
+
+// importBatchSize 件ずつ短いトランザクションで取り込む。同じ本文・同じ作成日時のメッセージは重複として数える。
+// 途中で失敗するとそれまでのバッチは残るが、取り込み直せば重複として数えられる。
+// 本文に URL があれば createMessage と同じくリンクを保存し、コミット後にプレビューとアーカイブを依頼する
+var importMessages = func(userID string, parse func(emit func(importedMessage) error) error) (messageImportReport, error) {
+	report := messageImportReport{Errors: make([]messageImportError, 0)}
+	batch := make([]importedMessage, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := importMessageBatch(userID, batch, &report)
+		batch = batch[:0]
+		return err
+	}
+
+	err := parse(func(message importedMessage) error {
+		if message.Err == nil {
+			message.Err = validateImportedMessage(message)
+		}
+		if message.Err != nil {
+			report.addError(message.Item, message.Err)
+			return nil
+		}
+
+		batch = append(batch, message)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return messageImportReport{}, err
+	}
+	return report, nil
+}
+
+func importMessageBatch(userID string, batch []importedMessage, report *messageImportReport) error {
+	imported := 0
+	duplicates := 0
+	linked := make([]messageListItem, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		statement, err := tx.Prepare(
+			`INSERT INTO messages (user_id, body, created_at, entities)
+			 SELECT $1, $2, $3, $4
+			 WHERE NOT EXISTS (
+			   SELECT 1 FROM messages WHERE user_id = $1 AND created_at = $3 AND body = $2
+			 )
+			 RETURNING id`,
+		)
+		if err != nil {
+			return err
+		}
+		defer statement.Close()
+
+		for _, message := range batch {
+			inserted := messageListItem{Body: message.Body, CreatedAt: message.CreatedAt}
+			err := statement.QueryRow(userID, message.Body, message.CreatedAt, encodeEntities(message.Body)).Scan(&inserted.ID)
+			if errors.Is(err, sql.ErrNoRows) {
+				duplicates++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			imported++
+
+			if len(extractMessageURLs(message.Body)) == 0 {
+				continue
+			}
+			if err := saveMessageLinks(tx, userID, &inserted); err != nil {
+				return err
+			}
+			linked = append(linked, messageListItem{ID: inserted.ID, Body: inserted.Body})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	report.Imported += imported
+	report.Duplicates += duplicates
+	for _, message := range linked {
+		enqueueLinkPreviews(message.Body)
+		enqueueMessageArchive(userID, message, false)
+	}
+	return nil
+}
+
+func (r *messageImportReport) addError(item string, err error) {
+	r.Failed++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, messageImportError{Item: item, Error: err.Error()})
+	}
+}
+
+// PostgreSQL の text は NUL を保存できないので、INSERT で取り込み全体が失敗する前に項目ごとのエラーにする
+func validateImportedMessage(message importedMessage) error {
+	if strings.TrimSpace(message.Body) == "" {
+		return errors.New("body is required")
+	}
+	if !utf8.ValidString(message.Body) {
+		return errors.New("body must be valid UTF-8")
+	}
+	if strings.ContainsRune(message.Body, 0) {
+		return errors.New("body must not contain NUL characters")
+	}
+	if message.CreatedAt.IsZero() {
+		return errors.New("created_at is required")
+	}
+	return nil
+}
+
+func importMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	parser, ok := messageImportParsers[r.URL.Query().Get("format")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+
+	// 送信の遅いクライアントに DB 接続を握らせないよう、受け取りきってから読む。
+	// 形式の誤りは取り込みを始める前に一度読み通して確かめる
+	upload, err := spoolImportUpload(http.MaxBytesReader(w, r.Body, maxImportUploadBytes))
+	if upload != nil {
+		defer os.Remove(upload.Name())
+		defer upload.Close()
+	}
+	if err == nil {
+		err = parser(upload, func(importedMessage) error { return nil })
+	}
+	var report messageImportReport
+	if err == nil {
+		report, err = importMessages(userID, func(emit func(importedMessage) error) error {
+			if _, err := upload.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return parser(upload, emit)
+		})
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var formatErr importFormatError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			writeError(w, http.StatusRequestEntityTooLarge, "import file too large")
+		case errors.As(err, &formatErr):
+			writeError(w, http.StatusBadRequest, "invalid import file")
+		default:
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}
+		return
+	}
+
+	recordAudit(r, userID, auditEventMessageImport, auditOutcomeSuccess, map[string]string{
+		"imported":   strconv.Itoa(report.Imported),
+		"duplicates": strconv.Itoa(report.Duplicates),
+		"failed":     strconv.Itoa(report.Failed),
+	})
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func spoolImportUpload(body io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp("", "futto-note-import-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(spool, body); err != nil {
+		return spool, importReadError(err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return spool, err
+	}
+	return spool, nil
+}
+
+// 自前のエクスポート (format=ndjson) と同じ 1 行 1 メッセージの形式
+func parseNDJSONImport(r io.Reader, emit func(importedMessage) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var item struct {
+			Body      string    `json:"body"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		message := importedMessage{Item: fmt.Sprintf("line %d", line)}
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			message.Err = errors.New("invalid JSON")
+		} else {
+			message.Body = item.Body
+			message.CreatedAt = item.CreatedAt
+		}
+		if err := emit(message); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return importReadError(err)
+	}
+	return nil
+}
+
+var (
+	slackLabeledLinkPattern = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)\|([^>]+)>`)
+	slackLinkPattern        = regexp.MustCompile(`<((?:https?|mailto):[^>]+)>`)
+	slackEntityReplacer     = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// Slack のチャンネルエクスポートは日ごとの JSON 配列。参加・退出などのシステムメッセージは取り込まない
+func parseSlackImport(r io.Reader, emit func(importedMessage) error) error {
+	return decodeJSONArray(r, func(index int, raw json.RawMessage) error {
+		var item struct {
+			Type    string `json:"type"`
+			Subtype string `json:"subtype"`
+			Text    string `json:"text"`
+			TS      string `json:"ts"`
+		}
+		message := importedMessage{Item: fmt.Sprintf("message %d", index)}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			message.Err = errors.New("invalid message")
+			return emit(message)
+		}
+		if item.Type != "message" || (item.Subtype != "" && item.Subtype != "thread_broadcast" && item.Subtype != "file_share") {
+			return nil
+		}
+
+		createdAt, err := parseSlackTimestamp(item.TS)
+		if err != nil {
+			message.Err = errors.New("invalid ts")
+			return emit(message)
+		}
+		message.CreatedAt = createdAt
+		message.Body = convertSlackText(item.Text)
+		return emit(message)
+	})
+}
+
+func parseSlackTimestamp(ts string) (time.Time, error) {
+	secondsPart, fractionPart, _ := strings.Cut(ts, ".")
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var micros int64
+	if fractionPart != "" {
+		fractionPart = (fractionPart + "000000")[:6]
+		micros, err = strconv.ParseInt(fractionPart, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(seconds, micros*int64(time.Microsecond)).UTC(), nil
+}
+
+func convertSlackText(text string) string {
+	text = slackLabeledLinkPattern.ReplaceAllString(text, "$2 ($1)")
+	text = slackLinkPattern.ReplaceAllString(text, "$1")
+	return slackEntityReplacer.Replace(text)
+}
+
+func decodeJSONArray(r io.Reader, fn func(index int, raw json.RawMessage) error) error {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return importReadError(err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return importFormatError{errors.New("expected a JSON array")}
+	}
+
+	for index := 1; decoder.More(); index++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return importReadError(err)
+		}
+		if err := fn(index, raw); err != nil {
+			return err
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return importReadError(err)
+	}
+	return nil
+}
+
+type keepNote struct {
+	Title                string `json:"title"`
+	TextContent          string `json:"textContent"`
+	CreatedTimestampUsec int64  `json:"createdTimestampUsec"`
+	IsTrashed            bool   `json:"isTrashed"`
+	ListContent          []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+}
+
+// Google Keep の Takeout は zip の中にメモごとの JSON が入っている。単体の JSON も受け付ける
+func parseKeepImport(r io.Reader, emit func(importedMessage) error) error {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil {
+		return importReadError(err)
+	}
+	if string(magic) != "PK" {
+		raw, err := io.ReadAll(buffered)
+		if err != nil {
+			return importReadError(err)
+		}
+		message, ok := keepNoteToMessage("note", raw)
+		if !ok {
+			return nil
+		}
+		return emit(message)
+	}
+
+	// zip は末尾の目次から読むため一時ファイルに書き出す
+	spool, err := os.CreateTemp("", "futto-note-import-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, buffered)
+	if err != nil {
+		return importReadError(err)
+	}
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return importFormatError{err}
+	}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !strings.EqualFold(path.Ext(file.Name), ".json") {
+			continue
+		}
+
+		raw, err := readZipFile(file, maxImportLineBytes)
+		message := importedMessage{Item: file.Name, Err: err}
+		if err == nil {
+			var ok bool
+			if message, ok = keepNoteToMessage(file.Name, raw); !ok {
+				continue
+			}
+		}
+		if err := emit(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ゴミ箱のメモは取り込まない (false を返す)
+func keepNoteToMessage(item string, raw []byte) (importedMessage, bool) {
+	var note keepNote
+	if err := json.Unmarshal(raw, &note); err != nil {
+		return importedMessage{Item: item, Err: errors.New("invalid note")}, true
+	}
+	if note.IsTrashed {
+		return importedMessage{}, false
+	}
+
+	var text strings.Builder
+	text.WriteString(note.TextContent)
+	for _, entry := range note.ListContent {
+		if text.Len() > 0 {
+			text.WriteString("\n")
+		}
+		if entry.IsChecked {
+			text.WriteString("- [x] ")
+		} else {
+			text.WriteString("- [ ] ")
+		}
+		text.WriteString(entry.Text)
+	}
+
+	message := importedMessage{Item: item, Body: joinTitleAndText(note.Title, text.String())}
+	if note.CreatedTimestampUsec > 0 {
+		message.CreatedAt = time.UnixMicro(note.CreatedTimestampUsec).UTC()
+	}
+	return message, true
+}
+
+func readZipFile(file *zip.File, limit int64) ([]byte, error) {
+	if file.UncompressedSize64 > uint64(limit) {
+		return nil, errors.New("file too large")
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, limit))
+}
+
+type enexNote struct {
+	Title   string `xml:"title"`
+	Content string `xml:"content"`
+	Created string `xml:"created"`
+}
+
+// Evernote の ENEX。content の ENML はタグを落としてプレーンテキストにする
+func parseENEXImport(r io.Reader, emit func(importedMessage) error) error {
+	decoder := xml.NewDecoder(r)
+	index := 0
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return importReadError(err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+
+		index++
+		var note enexNote
+		if err := decoder.DecodeElement(&note, &start); err != nil {
+			return importReadError(err)
+		}
+
+		message := importedMessage{Item: fmt.Sprintf("note %d", index)}
+		text, err := enmlToText(note.Content)
+		if err != nil {
+			message.Err = errors.New("invalid content")
+			if err := emit(message); err != nil {
+				return err
+			}
+			continue
+		}
+		message.Body = joinTitleAndText(strings.TrimSpace(note.Title), text)
+		if note.Created != "" {
+			message.CreatedAt, err = time.Parse("20060102T150405Z", note.Created)
+			if err != nil {
+				message.Err = errors.New("invalid created")
+			}
+		}
+		if err := emit(message); err != nil {
+			return err
+		}
+	}
+}
+
+var blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+
+func enmlToText(content string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch element := token.(type) {
+		case xml.CharData:
+			text.Write(element)
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "br":
+				text.WriteString("\n")
+			case "li":
+				text.WriteString("- ")
+			case "en-todo":
+				checked := false
+				for _, attr := range element.Attr {
+					if attr.Name.Local == "checked" && attr.Value == "true" {
+						checked = true
+					}
+				}
+				if checked {
+					text.WriteString("[x] ")
+				} else {
+					text.WriteString("[ ] ")
+				}
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "div", "p", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "pre":
+				text.WriteString("\n")
+			}
+		}
+	}
+
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(text.String(), "\n\n")), nil
+}
+
+func joinTitleAndText(title string, text string) string {
+	text = strings.TrimSpace(text)
+	switch {
+	case title == "":
+		return text
+	case text == "":
+		return title
+	default:
+		return title + "\n\n" + text
+	}
+}
+
+// サイズ超過はそのまま返して 413 にし、それ以外の読み取り失敗は形式エラーとして扱う
+func importReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return importFormatError{err}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func collectImported(t *testing.T, parser messageImportParser, input []byte) []importedMessage {
+	t.Helper()
+
+	var messages []importedMessage
+	err := parser(bytes.NewReader(input), func(message importedMessage) error {
+		messages = append(messages, message)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	return messages
+}
+
+// 本文と作成日時が同じものを重複として扱う、DB を使わない importMessages
+func stubImportMessages(t *testing.T, existing []importedMessage) *[]importedMessage {
+	t.Helper()
+
+	original := importMessages
+	t.Cleanup(func() {
+		importMessages = original
+	})
+
+	stored := append([]importedMessage{}, existing...)
+	importMessages = func(userID string, parse func(emit func(importedMessage) error) error) (messageImportReport, error) {
+		report := messageImportReport{Errors: make([]messageImportError, 0)}
+		staged := append([]importedMessage{}, stored...)
+		err := parse(func(message importedMessage) error {
+			if message.Err == nil {
+				message.Err = validateImportedMessage(message)
+			}
+			if message.Err != nil {
+				report.addError(message.Item, message.Err)
+				return nil
+			}
+			for _, existing := range staged {
+				if existing.Body == message.Body && existing.CreatedAt.Equal(message.CreatedAt) {
+					report.Duplicates++
+					return nil
+				}
+			}
+			staged = append(staged, message)
+			report.Imported++
+			return nil
+		})
+		if err != nil {
+			return messageImportReport{}, err
+		}
+		stored = staged
+		return report, nil
+	}
+	return &stored
+}
+
+func performImport(t *testing.T, format string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/import?format="+format, bytes.NewReader(body))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	importMessagesHandler(recorder, request)
+	return recorder
+}
+
+func TestImportMessagesHandler_RejectsUnknownFormat(t *testing.T) {
+	stubImportMessages(t, nil)
+
+	recorder := performImport(t, "onenote", nil)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid format\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestImportMessagesHandler_ReportsDuplicatesAndItemErrors(t *testing.T) {
+	stored := stubImportMessages(t, []importedMessage{
+		{Body: "already here", CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	input := strings.Join([]string{
+		`{"id":1,"body":"already here","created_at":"2026-01-01T09:00:00+09:00"}`,
+		`{"id":2,"body":"new note","created_at":"2026-01-02T00:00:00Z"}`,
+		`not json`,
+		`{"id":4,"body":"","created_at":"2026-01-03T00:00:00Z"}`,
+		``,
+	}, "\n")
+
+	recorder := performImport(t, "ndjson", []byte(input))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "{\"imported\":1,\"duplicates\":1,\"failed\":2,\"errors\":[" +
+		"{\"item\":\"line 3\",\"error\":\"invalid JSON\"}," +
+		"{\"item\":\"line 4\",\"error\":\"body is required\"}]}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+
+	if len(*stored) != 2 {
+		t.Fatalf("expected 2 stored messages, got %d", len(*stored))
+	}
+}
+
+func TestImportMessagesHandler_ReportsNULAndInvalidUTF8PerItem(t *testing.T) {
+	stored := stubImportMessages(t, nil)
+
+	input := strings.Join([]string{
+		`{"body":"nul\u0000byte","created_at":"2026-01-01T00:00:00Z"}`,
+		`{"body":"ok","created_at":"2026-01-02T00:00:00Z"}`,
+		``,
+	}, "\n")
+	recorder := performImport(t, "ndjson", []byte(input))
+
+	expected := "{\"imported\":1,\"duplicates\":0,\"failed\":1,\"errors\":[" +
+		"{\"item\":\"line 1\",\"error\":\"body must not contain NUL characters\"}]}\n"
+	if body := recorder.Body.String(); recorder.Code != http.StatusOK || body != expected {
+		t.Fatalf("unexpected response: %d %s", recorder.Code, body)
+	}
+	if len(*stored) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(*stored))
+	}
+
+	invalid := importedMessage{Body: "bad \xff byte", CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := validateImportedMessage(invalid); err == nil || err.Error() != "body must be valid UTF-8" {
+		t.Fatalf("expected invalid UTF-8 to be rejected, got %v", err)
+	}
+}
+
+// 読み終えたかどうかを覚えておくリクエストボディ
+type trackingReader struct {
+	r        io.Reader
+	finished bool
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		t.finished = true
+	}
+	return n, err
+}
+
+func TestImportMessagesHandler_ReadsWholeUploadBeforeImporting(t *testing.T) {
+	original := importMessages
+	t.Cleanup(func() {
+		importMessages = original
+	})
+
+	body := &trackingReader{r: strings.NewReader(`{"body":"note","created_at":"2026-01-02T00:00:00Z"}` + "\n")}
+	imported := 0
+	importMessages = func(userID string, parse func(emit func(importedMessage) error) error) (messageImportReport, error) {
+		if !body.finished {
+			t.Fatalf("expected the upload to be read before the import starts")
+		}
+		err := parse(func(message importedMessage) error {
+			imported++
+			return nil
+		})
+		return messageImportReport{Imported: imported, Errors: make([]messageImportError, 0)}, err
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/import?format=ndjson", body)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	importMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK || imported != 1 {
+		t.Fatalf("unexpected result: status=%d imported=%d", recorder.Code, imported)
+	}
+}
+
+func TestImportMessagesHandler_RejectsMalformedFile(t *testing.T) {
+	stored := stubImportMessages(t, nil)
+
+	recorder := performImport(t, "slack", []byte(`[{"type":"message","text":"hi","ts":"1700000000.000100"}`))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid import file\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+
+	if len(*stored) != 0 {
+		t.Fatalf("expected import to be rolled back, got %d messages", len(*stored))
+	}
+}
+
+func TestParseSlackImport_ConvertsMessagesAndSkipsSystemEvents(t *testing.T) {
+	input := []byte(`[
+		{"type":"message","subtype":"channel_join","text":"<@U1> has joined","ts":"1700000000.000100"},
+		{"type":"message","text":"see <https://example.com|the docs> &amp; <https://example.org>","ts":"1700000001.000200"}
+	]`)
+
+	messages := collectImported(t, parseSlackImport, input)
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if messages[0].Body != "see the docs (https://example.com) & https://example.org" {
+		t.Fatalf("unexpected body: %q", messages[0].Body)
+	}
+	if !messages[0].CreatedAt.Equal(time.Unix(1700000001, 200000)) {
+		t.Fatalf("unexpected created_at: %s", messages[0].CreatedAt)
+	}
+}
+
+func TestParseKeepImport_ReadsTakeoutArchive(t *testing.T) {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	notes := map[string]any{
+		"Takeout/Keep/買い物.json": map[string]any{
+			"title":                "買い物",
+			"createdTimestampUsec": 1700000000123456,
+			"listContent": []map[string]any{
+				{"text": "牛乳", "isChecked": true},
+				{"text": "卵", "isChecked": false},
+			},
+		},
+		"Takeout/Keep/trashed.json": map[string]any{
+			"textContent":          "消したメモ",
+			"createdTimestampUsec": 1700000000000000,
+			"isTrashed":            true,
+		},
+		"Takeout/Keep/買い物.html": "<html></html>",
+	}
+	for name, note := range notes {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		if err := json.NewEncoder(file).Encode(note); err != nil {
+			t.Fatalf("failed to write zip entry: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close zip: %v", err)
+	}
+
+	messages := collectImported(t, parseKeepImport, archive.Bytes())
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if messages[0].Body != "買い物\n\n- [x] 牛乳\n- [ ] 卵" {
+		t.Fatalf("unexpected body: %q", messages[0].Body)
+	}
+	if !messages[0].CreatedAt.Equal(time.UnixMicro(1700000000123456)) {
+		t.Fatalf("unexpected created_at: %s", messages[0].CreatedAt)
+	}
+}
+
+func TestParseKeepImport_SkipsTrashedSingleNote(t *testing.T) {
+	messages := collectImported(t, parseKeepImport, []byte(`{"textContent":"消したメモ","createdTimestampUsec":1700000000000000,"isTrashed":true}`))
+
+	if len(messages) != 0 {
+		t.Fatalf("expected trashed note to be skipped, got %+v", messages)
+	}
+}
+
+func TestParseENEXImport_ConvertsENMLToText(t *testing.T) {
+	input := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-export SYSTEM "http://xml.evernote.com/pub/evernote-export4.dtd">
+<en-export>
+  <note>
+    <title>会議メモ</title>
+    <content><![CDATA[<?xml version="1.0" encoding="UTF-8"?><!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd"><en-note><div>議題&nbsp;A</div><div><en-todo checked="true"/>資料共有</div><div><br/></div><ul><li>次回</li></ul></en-note>]]></content>
+    <created>20240115T093000Z</created>
+  </note>
+  <note>
+    <title>日付なし</title>
+    <content><![CDATA[<en-note>本文</en-note>]]></content>
+    <created>yesterday</created>
+  </note>
+</en-export>`)
+
+	messages := collectImported(t, parseENEXImport, input)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].Body != "会議メモ\n\n議題\u00a0A\n[x] 資料共有\n\n- 次回" {
+		t.Fatalf("unexpected body: %q", messages[0].Body)
+	}
+	if !messages[0].CreatedAt.Equal(time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected created_at: %s", messages[0].CreatedAt)
+	}
+	if messages[1].Err == nil || messages[1].Item != "note 2" {
+		t.Fatalf("expected an item error for note 2, got %+v", messages[1])
+	}
+}
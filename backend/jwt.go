@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	errMalformedJWT        = errors.New("malformed jwt")
+	errUnsupportedJWTAlg   = errors.New("unsupported jwt algorithm")
+	errJWTSignatureInvalid = errors.New("jwt signature is invalid")
+	errJWKNotFound         = errors.New("no matching json web key")
+)
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ,omitempty"`
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// parseJWT は署名を検証せずにヘッダーとクレーム、署名対象部分を取り出す
+func parseJWT(token string) (jwtHeader, []byte, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtHeader{}, nil, nil, nil, errMalformedJWT
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, errMalformedJWT
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return jwtHeader{}, nil, nil, nil, errMalformedJWT
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, errMalformedJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, errMalformedJWT
+	}
+
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+func verifyJWTSignature(header jwtHeader, signingInput []byte, signature []byte, key jsonWebKey) error {
+	digest := sha256.Sum256(signingInput)
+
+	switch header.Algorithm {
+	case "RS256":
+		publicKey, err := key.rsaPublicKey()
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errJWTSignatureInvalid
+		}
+		return nil
+
+	case "ES256":
+		publicKey, err := key.ecdsaPublicKey()
+		if err != nil {
+			return err
+		}
+		if len(signature) != 64 {
+			return errJWTSignatureInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errJWTSignatureInvalid
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedJWTAlg, header.Algorithm)
+	}
+}
+
+func (set jsonWebKeySet) find(header jwtHeader) (jsonWebKey, error) {
+	wantType := "RSA"
+	if header.Algorithm == "ES256" {
+		wantType = "EC"
+	}
+
+	for _, key := range set.Keys {
+		if key.KeyType != wantType || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		if header.KeyID == "" || key.KeyID == header.KeyID {
+			return key, nil
+		}
+	}
+	return jsonWebKey{}, errJWKNotFound
+}
+
+func (key jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	if key.KeyType != "RSA" {
+		return nil, errJWKNotFound
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rsa modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rsa exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func (key jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if key.KeyType != "EC" || key.Curve != "P-256" {
+		return nil, errJWKNotFound
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ec x coordinate: %w", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ec y coordinate: %w", err)
+	}
+
+	publicKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("ec point is not on curve")
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"futto-note/backend/webfetch"
+)
+
+const (
+	maxMessageLinks            = 5
+	maxLinkURLLength           = 2048
+	linkPreviewMaxBytes        = 512 << 10
+	linkPreviewTimeout         = 5 * time.Second
+	linkPreviewMaxRedirects    = 5
+	defaultLinkPreviewTTLHours = 24
+	// 取得に失敗した URL は短い間隔で取り直す
+	linkPreviewRetryInterval  = time.Hour
+	defaultLinkPreviewWorkers = 4
+
+	linkPreviewStatusPending = "pending"
+	linkPreviewStatusReady   = "ready"
+	linkPreviewStatusFailed  = "failed"
+)
+
+// 基本はフロントエンドの自動リンクと同じく空白までを URL とみなす。
+// 日本語の文中では空白を挟まないことが多いので、全角の句読点と括弧でも区切る
+var messageURLPattern = regexp.MustCompile(`https?://[^\s<>"、。，．「」『』【】（）]+`)
+
+type linkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+var linkPreviewFetcher = webfetch.New(webfetch.Options{
+	Timeout:      linkPreviewTimeout,
+	MaxRedirects: linkPreviewMaxRedirects,
+	UserAgent:    "futto-note-link-preview/1.0",
+})
+
+var linkPreviewQueue = newWorkQueue("link preview", refreshLinkPreview)
+
+func linkPreviewWorkers() int {
+	return readWorkerCountEnv("LINK_PREVIEW_WORKERS", defaultLinkPreviewWorkers)
+}
+
+func linkPreviewTTL() time.Duration {
+	hours := defaultLinkPreviewTTLHours
+	if value := os.Getenv("LINK_PREVIEW_TTL_HOURS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			hours = parsed
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// 本文中の URL を出現順に重複なく返す。文末の句読点や閉じ括弧は URL に含めない
+func extractMessageURLs(body string) []string {
+	urls := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, span := range findURLSpans(body) {
+		candidate := body[span[0]:span[1]]
+		if len(candidate) > maxLinkURLLength || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		urls = append(urls, candidate)
+		if len(urls) == maxMessageLinks {
+			break
+		}
+	}
+	return urls
+}
+
+// URL の [開始, 終了) バイト位置。エンティティ抽出と共通
+func findURLSpans(body string) [][2]int {
+	spans := make([][2]int, 0)
+	for _, match := range messageURLPattern.FindAllStringIndex(body, -1) {
+		candidate := trimURLPunctuation(body[match[0]:match[1]])
+		parsed, err := url.Parse(candidate)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+		spans = append(spans, [2]int{match[0], match[0] + len(candidate)})
+	}
+	return spans
+}
+
+func trimURLPunctuation(value string) string {
+	for value != "" {
+		trimmed := strings.TrimRight(value, ".,;:!?'！？")
+		// 括弧は対応する開き括弧が URL 内にないときだけ落とす
+		for _, pair := range [][2]string{{"(", ")"}, {"[", "]"}} {
+			if strings.HasSuffix(trimmed, pair[1]) && strings.Count(trimmed, pair[0]) < strings.Count(trimmed, pair[1]) {
+				trimmed = strings.TrimSuffix(trimmed, pair[1])
+			}
+		}
+		if trimmed == value {
+			break
+		}
+		value = trimmed
+	}
+	return value
+}
+
+// 本文の URL で message_links を置き換え、プレビューを含めて行を読み直す
+func saveMessageLinks(tx *sql.Tx, userID string, message *messageListItem) error {
+	if _, err := tx.Exec(
+		"DELETE FROM message_links WHERE message_id = $1 AND user_id = $2",
+		message.ID,
+		userID,
+	); err != nil {
+		return err
+	}
+
+	urls := extractMessageURLs(message.Body)
+	if len(urls) == 0 {
+		return nil
+	}
+	for position, link := range urls {
+		if _, err := tx.Exec(
+			`INSERT INTO message_links (message_id, user_id, position, url)
+			 VALUES ($1, $2, $3, $4)`,
+			message.ID,
+			userID,
+			position,
+			link,
+		); err != nil {
+			return err
+		}
+	}
+
+	reloaded, err := scanMessage(tx.QueryRow(
+		`SELECT `+messageColumns+` FROM messages WHERE id = $1 AND user_id = $2`,
+		message.ID,
+		userID,
+	))
+	if err != nil {
+		return err
+	}
+	*message = reloaded
+	return nil
+}
+
+func enqueueLinkPreviews(body string) {
+	for _, link := range extractMessageURLs(body) {
+		linkPreviewQueue.enqueue(link)
+	}
+}
+
+// messageColumns の previews 列 (JSON 配列) を読む
+func decodeLinkPreviews(raw []byte) ([]linkPreview, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var previews []linkPreview
+	if err := json.Unmarshal(raw, &previews); err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
+
+func refreshLinkPreview(link string) error {
+	claimed, err := claimLinkPreview(link, linkPreviewTTL(), linkPreviewRetryInterval)
+	if err != nil || !claimed {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+
+	preview, err := fetchLinkPreview(ctx, link)
+	if err != nil {
+		log.Printf("failed to fetch link preview for %s: %v", link, err)
+		return storeLinkPreview(linkPreview{URL: link}, linkPreviewStatusFailed)
+	}
+	return storeLinkPreview(preview, linkPreviewStatusReady)
+}
+
+var errEmptyLinkPreview = errors.New("page has no preview metadata")
+
+func fetchLinkPreview(ctx context.Context, link string) (linkPreview, error) {
+	resp, err := linkPreviewFetcher.Get(ctx, link, linkPreviewMaxBytes, "text/html", "application/xhtml+xml")
+	if err != nil {
+		return linkPreview{}, err
+	}
+
+	metadata := webfetch.ParseMetadata(resp)
+	if metadata.Title == "" && metadata.Description == "" && metadata.ImageURL == "" {
+		return linkPreview{}, errEmptyLinkPreview
+	}
+	return linkPreview{
+		URL:         link,
+		Title:       metadata.Title,
+		Description: metadata.Description,
+		ImageURL:    metadata.ImageURL,
+		SiteName:    metadata.SiteName,
+	}, nil
+}
+
+// 取得の権利を取る。キャッシュが新しい、または他のワーカーが取得中なら false。
+// 取り直しの間も古いプレビューを返せるよう、既存の行は fetched_at だけを進める。
+// link_previews は URL 単位の共有キャッシュなのでユーザースコープを使わない
+var claimLinkPreview = func(link string, ttl time.Duration, retry time.Duration) (bool, error) {
+	var claimed string
+	err := db.QueryRow(
+		`INSERT INTO link_previews (url, status, fetched_at)
+		 VALUES ($1, $2, NOW())
+		 ON CONFLICT (url) DO UPDATE SET fetched_at = NOW()
+		 WHERE link_previews.fetched_at < NOW() - make_interval(secs => CASE
+		     WHEN link_previews.status = $3 THEN $4::float8
+		     ELSE $5::float8
+		 END)
+		 RETURNING url`,
+		link,
+		linkPreviewStatusPending,
+		linkPreviewStatusReady,
+		ttl.Seconds(),
+		retry.Seconds(),
+	).Scan(&claimed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+var storeLinkPreview = func(preview linkPreview, status string) error {
+	_, err := db.Exec(
+		`UPDATE link_previews
+		 SET status = $2, title = $3, description = $4, image_url = $5, site_name = $6, fetched_at = NOW()
+		 WHERE url = $1`,
+		preview.URL,
+		status,
+		preview.Title,
+		preview.Description,
+		preview.ImageURL,
+		preview.SiteName,
+	)
+	return err
+}
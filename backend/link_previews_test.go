@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"futto-note/backend/webfetch"
+)
+
+type storedLinkPreview struct {
+	preview linkPreview
+	status  string
+}
+
+// 取得の権利は常に取れるものとし、保存内容をメモリに残す
+func stubLinkPreviewStore(t *testing.T, allowPrivate bool) *[]storedLinkPreview {
+	t.Helper()
+
+	originalFetcher := linkPreviewFetcher
+	originalClaim := claimLinkPreview
+	originalStore := storeLinkPreview
+	t.Cleanup(func() {
+		linkPreviewFetcher = originalFetcher
+		claimLinkPreview = originalClaim
+		storeLinkPreview = originalStore
+	})
+
+	// httptest のサーバーは 127.0.0.1 で待ち受けるので、テストでだけ許可する
+	linkPreviewFetcher = webfetch.New(webfetch.Options{
+		Timeout:      time.Second,
+		MaxRedirects: linkPreviewMaxRedirects,
+		AllowPrivate: allowPrivate,
+	})
+
+	stored := make([]storedLinkPreview, 0)
+	claimLinkPreview = func(link string, ttl time.Duration, retry time.Duration) (bool, error) {
+		return true, nil
+	}
+	storeLinkPreview = func(preview linkPreview, status string) error {
+		stored = append(stored, storedLinkPreview{preview: preview, status: status})
+		return nil
+	}
+	return &stored
+}
+
+func TestExtractMessageURLs(t *testing.T) {
+	cases := map[string][]string{
+		"see https://example.com/a.":                   {"https://example.com/a"},
+		"(https://example.com/wiki/Go_(lang))":         {"https://example.com/wiki/Go_(lang)"},
+		"https://example.com/ja。ここを見て":                 {"https://example.com/ja"},
+		"「https://example.com/q?x=1」":                  {"https://example.com/q?x=1"},
+		"dup http://a.example http://a.example":        {"http://a.example"},
+		"no links here, ftp://files.example, https://": {},
+		"https://1.example https://2.example https://3.example https://4.example https://5.example https://6.example": {
+			"https://1.example", "https://2.example", "https://3.example", "https://4.example", "https://5.example",
+		},
+	}
+	for body, want := range cases {
+		if got := extractMessageURLs(body); !reflect.DeepEqual(got, want) {
+			t.Errorf("extractMessageURLs(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
+
+func TestRefreshLinkPreview_StoresMetadata(t *testing.T) {
+	stored := stubLinkPreviewStore(t, true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head>
+			<meta property="og:title" content="Release notes">
+			<meta property="og:description" content="What changed">
+			<meta property="og:image" content="/cover.png">
+			<meta property="og:site_name" content="Example Blog">
+			</head><body></body></html>`))
+	}))
+	defer server.Close()
+
+	link := server.URL + "/posts/1"
+	if err := refreshLinkPreview(link); err != nil {
+		t.Fatalf("refreshLinkPreview returned error: %v", err)
+	}
+
+	want := storedLinkPreview{
+		preview: linkPreview{
+			URL:         link,
+			Title:       "Release notes",
+			Description: "What changed",
+			ImageURL:    server.URL + "/cover.png",
+			SiteName:    "Example Blog",
+		},
+		status: linkPreviewStatusReady,
+	}
+	if len(*stored) != 1 || !reflect.DeepEqual((*stored)[0], want) {
+		t.Fatalf("unexpected stored previews: %+v", *stored)
+	}
+}
+
+func TestRefreshLinkPreview_BlocksPrivateAddresses(t *testing.T) {
+	stored := stubLinkPreviewStore(t, false)
+
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	if err := refreshLinkPreview(server.URL); err != nil {
+		t.Fatalf("refreshLinkPreview returned error: %v", err)
+	}
+	if reached {
+		t.Fatalf("expected request to a loopback address to be blocked")
+	}
+	if len(*stored) != 1 || (*stored)[0].status != linkPreviewStatusFailed {
+		t.Fatalf("expected preview to be cached as failed, got %+v", *stored)
+	}
+}
+
+func TestRefreshLinkPreview_SkipsFreshCache(t *testing.T) {
+	stored := stubLinkPreviewStore(t, true)
+	claimLinkPreview = func(link string, ttl time.Duration, retry time.Duration) (bool, error) {
+		return false, nil
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	if err := refreshLinkPreview(server.URL); err != nil {
+		t.Fatalf("refreshLinkPreview returned error: %v", err)
+	}
+	if requests != 0 || len(*stored) != 0 {
+		t.Fatalf("expected cached URL not to be fetched, got %d requests and %+v", requests, *stored)
+	}
+}
+
+func TestCreateMessageHandler_EnqueuesLinkPreviews(t *testing.T) {
+	originalInsertMessage := insertMessage
+	originalQueue := linkPreviewQueue
+	t.Cleanup(func() {
+		insertMessage = originalInsertMessage
+		linkPreviewQueue = originalQueue
+	})
+
+	linkPreviewQueue = newWorkQueue("link preview", refreshLinkPreview)
+	insertMessage = func(userID string, body string) (messageListItem, error) {
+		return messageListItem{ID: 1, Body: body}, nil
+	}
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/messages",
+		strings.NewReader(`{"body":"https://example.com/a と https://example.com/b を読む"}`),
+	)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	createMessageHandler(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+	if want := []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(linkPreviewQueue.queue, want) {
+		t.Fatalf("expected %v to be queued, got %v", want, linkPreviewQueue.queue)
+	}
+}
+
+func TestMessageListItem_MarshalsPreviews(t *testing.T) {
+	message := messageListItem{
+		ID:       1,
+		Body:     "https://example.com",
+		Previews: []linkPreview{{URL: "https://example.com", Title: "Example"}},
+	}
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"previews":[{"url":"https://example.com","title":"Example"}]`) {
+		t.Fatalf("expected previews in response, got %s", encoded)
+	}
+
+	sparse, err := json.Marshal(messageListItem{ID: 2, fields: messageFieldID | messageFieldPreviews})
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	if string(sparse) != `{"id":2,"previews":[]}` {
+		t.Fatalf("unexpected sparse response: %s", sparse)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type mailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type mailSender interface {
+	Send(ctx context.Context, message mailMessage) error
+}
+
+var mailer mailSender = logMailSender{}
+
+// log は本文 (パスワード再設定のリンクを含む) をそのままログに出すので、本番では明示的な送信方法を必須にする
+func newMailSenderFromEnv() (mailSender, error) {
+	switch os.Getenv("MAIL_SENDER") {
+	case "", "log":
+		if isProduction() {
+			return nil, fmt.Errorf("MAIL_SENDER must be smtp or file in production")
+		}
+		return logMailSender{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_FILE_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return fileMailSender{dir: dir}, nil
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		from := os.Getenv("MAIL_FROM")
+		if addr == "" || from == "" {
+			return nil, fmt.Errorf("SMTP_ADDR and MAIL_FROM are required for smtp mail sender")
+		}
+		return smtpMailSender{
+			addr:     addr,
+			from:     from,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_SENDER: %s", os.Getenv("MAIL_SENDER"))
+	}
+}
+
+type logMailSender struct{}
+
+func (logMailSender) Send(ctx context.Context, message mailMessage) error {
+	log.Printf("mail to=%s subject=%q\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+type fileMailSender struct {
+	dir string
+}
+
+func (s fileMailSender) Send(ctx context.Context, message mailMessage) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), sanitizeFileName(message.To))
+	return os.WriteFile(filepath.Join(s.dir, name), []byte(formatMail("", message)), 0o600)
+}
+
+type smtpMailSender struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func (s smtpMailSender) Send(ctx context.Context, message mailMessage) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+
+	return smtp.SendMail(s.addr, auth, s.from, []string{message.To}, []byte(formatMail(s.from, message)))
+}
+
+func formatMail(from string, message mailMessage) string {
+	var b strings.Builder
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(message.Body)
+	return b.String()
+}
+
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' || r == '@' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -6,11 +6,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	_ "time/tzdata"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	_ "github.com/lib/pq"
+
+	"futto-note/backend/blobstore"
+	"futto-note/backend/passwordhash"
 )
 
 var db *sql.DB
@@ -23,21 +27,101 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := checkDatabaseRole(); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
+	passwordHasher, err = passwordhash.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure password hashing: %v", err)
+	}
+
+	mailer, err = newMailSenderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure mail sender: %v", err)
+	}
+
+	oidcProviders, err = loadOIDCProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure OIDC providers: %v", err)
+	}
+
+	webPushSender, err = newWebPushSenderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure web push: %v", err)
+	}
+
+	notifiers, err = newNotifiersFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure notifiers: %v", err)
+	}
+
+	blobStore, err = blobstore.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure blob store: %v", err)
+	}
+
+	startAuditRetentionWorker()
+	imageQueue.start(imageWorkers())
+	requeueProcessingImages()
+	linkPreviewQueue.start(linkPreviewWorkers())
+	archiveQueue.start(archiveWorkers())
+	startReminderScheduler()
+
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(corsMiddleware())
+	r.Use(csrfMiddleware)
 
 	r.Get("/api/health", healthHandler)
+	r.Get("/api/csrf", csrfTokenHandler)
 	r.Post("/api/login", loginHandler)
 	r.Post("/api/logout", logoutHandler)
+	r.Post("/api/register", registerHandler)
+	r.Get("/api/auth/oidc", oidcProvidersHandler)
+	r.Get("/api/auth/oidc/{provider}/login", oidcLoginHandler)
+	r.Get("/api/auth/oidc/{provider}/callback", oidcCallbackHandler)
 	r.Get("/api/me", meHandler)
+	r.Post("/api/password-reset", requestPasswordResetHandler)
+	r.Post("/api/password-reset/confirm", confirmPasswordResetHandler)
 	r.Group(func(r chi.Router) {
 		r.Use(authMiddleware)
+		r.Post("/api/me/password", changePasswordHandler)
+		r.Get("/api/me/audit", listAuditEventsHandler)
+		r.Get("/api/me/settings", getSettingsHandler)
+		r.Patch("/api/me/settings", patchSettingsHandler)
+		r.Get("/api/me/export", exportAccountHandler)
+		r.Delete("/api/me", deleteAccountHandler)
+		r.Get("/api/push/vapid-key", vapidPublicKeyHandler)
+		r.Put("/api/push/subscription", putPushSubscriptionHandler)
+		r.Delete("/api/push/subscription", deletePushSubscriptionHandler)
+		r.Post("/api/invites", createInviteHandler)
 		r.Get("/api/messages", listMessagesHandler)
+		r.Get("/api/stats", statsHandler)
 		r.Post("/api/messages", createMessageHandler)
+		r.Post("/api/messages/import", importMessagesHandler)
+		r.Get("/api/messages/export", exportMessagesHandler)
+		r.Get("/api/messages/{id}", getMessageHandler)
 		r.Put("/api/messages/{id}", updateMessageHandler)
 		r.Delete("/api/messages/{id}", deleteMessageHandler)
+		r.Get("/api/messages/{id}/thread", getMessageThreadHandler)
+		r.Get("/api/messages/{id}/attachments", listAttachmentsHandler)
+		r.Post("/api/messages/{id}/attachments", uploadAttachmentsHandler)
+		r.Get("/api/attachments/{attachmentID}", downloadAttachmentHandler)
+		r.Get("/api/attachments/{attachmentID}/thumbnails/{size}", downloadThumbnailHandler)
+		r.Delete("/api/attachments/{attachmentID}", deleteAttachmentHandler)
+		r.Post("/api/messages/{id}/replies", createReplyHandler)
+		r.Get("/api/messages/{id}/archive", getMessageArchiveHandler)
+		r.Post("/api/messages/{id}/archive", requestMessageArchiveHandler)
+		r.Get("/api/messages/{id}/archive/{archiveID}/image", downloadArchiveImageHandler)
+		r.Get("/api/messages/{id}/reminders", listRemindersHandler)
+		r.Post("/api/messages/{id}/reminders", createReminderHandler)
+		r.Delete("/api/reminders/{reminderID}", deleteReminderHandler)
+		r.Put("/api/messages/{id}/pin", messageFlagHandler(messageFlagPinned, true))
+		r.Delete("/api/messages/{id}/pin", messageFlagHandler(messageFlagPinned, false))
+		r.Put("/api/messages/{id}/star", messageFlagHandler(messageFlagStarred, true))
+		r.Delete("/api/messages/{id}/star", messageFlagHandler(messageFlagStarred, false))
 	})
 
 	port := os.Getenv("PORT")
@@ -78,15 +162,10 @@ func connectDB() (*sql.DB, error) {
 }
 
 func corsMiddleware() func(http.Handler) http.Handler {
-	allowedOrigins := []string{}
-	if origin := os.Getenv("CORS_ORIGIN"); origin != "" {
-		allowedOrigins = append(allowedOrigins, origin)
-	}
-
 	return cors.Handler(cors.Options{
-		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedOrigins:   allowedOrigins(),
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", csrfHeaderName},
 		AllowCredentials: true,
 		MaxAge:           300,
 	})
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const defaultMaxPinnedMessages = 20
+
+var errPinLimitReached = errors.New("pin limit reached")
+
+// ピン留めとスターは日時列で持ち、NULL なら外れている
+type messageFlag struct {
+	column string
+	// 上限がなければ nil
+	limit func() int
+}
+
+var (
+	messageFlagPinned  = messageFlag{column: "pinned_at", limit: maxPinnedMessages}
+	messageFlagStarred = messageFlag{column: "starred_at"}
+)
+
+func maxPinnedMessages() int {
+	if value := os.Getenv("MAX_PINNED_MESSAGES"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return defaultMaxPinnedMessages
+}
+
+// ピン留めの上限は同じユーザーの同時リクエストで超えないようアドバイザリロックで直列化する
+var setMessageFlag = func(id int, userID string, flag messageFlag, set bool) (messageListItem, error) {
+	var message messageListItem
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		value := "NULL"
+		if set {
+			value = fmt.Sprintf("COALESCE(%s, NOW())", flag.column)
+		}
+
+		if set && flag.limit != nil {
+			if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", flag.column+":"+userID); err != nil {
+				return err
+			}
+
+			var count int
+			err := tx.QueryRow(
+				fmt.Sprintf("SELECT COUNT(*) FROM messages WHERE user_id = $1 AND %s IS NOT NULL AND id <> $2", flag.column),
+				userID,
+				id,
+			).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count >= flag.limit() {
+				// 存在しないメッセージなら上限より 404 を優先する
+				var exists bool
+				if err := tx.QueryRow(
+					"SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND user_id = $2)",
+					id,
+					userID,
+				).Scan(&exists); err != nil {
+					return err
+				}
+				if !exists {
+					return sql.ErrNoRows
+				}
+				return errPinLimitReached
+			}
+		}
+
+		var err error
+		message, err = scanMessage(tx.QueryRow(
+			fmt.Sprintf(
+				`UPDATE messages
+				 SET %s = %s
+				 WHERE id = $1 AND user_id = $2
+				 RETURNING %s`,
+				flag.column, value, messageColumns,
+			),
+			id,
+			userID,
+		))
+		return err
+	})
+	if err != nil {
+		return messageListItem{}, err
+	}
+
+	return message, nil
+}
+
+// 一覧の先頭に出すピン留めセクション。新しくピン留めしたものから並べる
+var listPinnedMessages = func(userID string) ([]messageListItem, error) {
+	messages := make([]messageListItem, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE user_id = $1 AND pinned_at IS NOT NULL
+			 ORDER BY pinned_at DESC, id DESC`,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			message, err := scanMessage(rows)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func messageFlagHandler(flag messageFlag, set bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := getUserIDFromContext(r.Context())
+		if !ok || userID == "" {
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		idParam := chi.URLParam(r, "id")
+		messageID, err := strconv.Atoi(idParam)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid message id")
+			return
+		}
+
+		message, err := setMessageFlag(messageID, userID, flag, set)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				writeError(w, http.StatusNotFound, "message not found")
+			case errors.Is(err, errPinLimitReached):
+				writeError(w, http.StatusConflict, "pin limit reached")
+			default:
+				writeError(w, http.StatusInternalServerError, "internal server error")
+			}
+			return
+		}
+
+		writeJSON(w, http.StatusOK, message)
+	}
+}
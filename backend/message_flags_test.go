@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func performFlagRequest(t *testing.T, method string, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	router := chi.NewRouter()
+	router.Put("/api/messages/{id}/pin", messageFlagHandler(messageFlagPinned, true))
+	router.Delete("/api/messages/{id}/pin", messageFlagHandler(messageFlagPinned, false))
+	router.Put("/api/messages/{id}/star", messageFlagHandler(messageFlagStarred, true))
+
+	request := httptest.NewRequest(method, path, nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMessageFlagHandler_PinsMessage(t *testing.T) {
+	original := setMessageFlag
+	t.Cleanup(func() {
+		setMessageFlag = original
+	})
+
+	var gotColumn string
+	var gotSet bool
+	setMessageFlag = func(id int, userID string, flag messageFlag, set bool) (messageListItem, error) {
+		gotColumn = flag.column
+		gotSet = set
+		return messageListItem{
+			ID:        id,
+			Body:      "Wi-Fi: futto-guest",
+			CreatedAt: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+			Pinned:    set,
+		}, nil
+	}
+
+	recorder := performFlagRequest(t, http.MethodPut, "/api/messages/7/pin")
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotColumn != "pinned_at" || !gotSet {
+		t.Fatalf("unexpected flag update: column=%s set=%v", gotColumn, gotSet)
+	}
+
+	expected := "{\"id\":7,\"body\":\"Wi-Fi: futto-guest\",\"created_at\":\"2026-03-10T12:00:00Z\",\"pinned\":true}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestMessageFlagHandler_StarUsesStarColumn(t *testing.T) {
+	original := setMessageFlag
+	t.Cleanup(func() {
+		setMessageFlag = original
+	})
+
+	var gotColumn string
+	setMessageFlag = func(id int, userID string, flag messageFlag, set bool) (messageListItem, error) {
+		gotColumn = flag.column
+		return messageListItem{ID: id}, nil
+	}
+
+	recorder := performFlagRequest(t, http.MethodPut, "/api/messages/7/star")
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotColumn != "starred_at" {
+		t.Fatalf("expected starred_at, got %s", gotColumn)
+	}
+}
+
+func TestMessageFlagHandler_RejectsWhenPinLimitReached(t *testing.T) {
+	original := setMessageFlag
+	t.Cleanup(func() {
+		setMessageFlag = original
+	})
+
+	setMessageFlag = func(id int, userID string, flag messageFlag, set bool) (messageListItem, error) {
+		return messageListItem{}, errPinLimitReached
+	}
+
+	recorder := performFlagRequest(t, http.MethodPut, "/api/messages/7/pin")
+
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"pin limit reached\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestMessageFlagHandler_NotFoundForOtherUsersMessage(t *testing.T) {
+	original := setMessageFlag
+	t.Cleanup(func() {
+		setMessageFlag = original
+	})
+
+	setMessageFlag = func(id int, userID string, flag messageFlag, set bool) (messageListItem, error) {
+		return messageListItem{}, sql.ErrNoRows
+	}
+
+	recorder := performFlagRequest(t, http.MethodDelete, "/api/messages/7/pin")
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"message not found\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestMaxPinnedMessages_ReadsEnvironment(t *testing.T) {
+	t.Setenv("MAX_PINNED_MESSAGES", "")
+	if limit := maxPinnedMessages(); limit != defaultMaxPinnedMessages {
+		t.Fatalf("expected default %d, got %d", defaultMaxPinnedMessages, limit)
+	}
+
+	t.Setenv("MAX_PINNED_MESSAGES", "3")
+	if limit := maxPinnedMessages(); limit != 3 {
+		t.Fatalf("expected 3, got %d", limit)
+	}
+}
+
+func TestListMessagesHandler_IncludesPinnedSectionAndFilters(t *testing.T) {
+	originalListMessages := listMessages
+	originalListPinned := listPinnedMessages
+	t.Cleanup(func() {
+		listMessages = originalListMessages
+		listPinnedMessages = originalListPinned
+	})
+
+	var gotFilter messageFilter
+	listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+		gotFilter = filter
+		return []messageListItem{
+			{ID: 2, Body: "starred", CreatedAt: time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC), Starred: true},
+		}, nil
+	}
+	listPinnedMessages = func(userID string) ([]messageListItem, error) {
+		return []messageListItem{
+			{ID: 1, Body: "pinned", CreatedAt: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), Pinned: true},
+		}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?starred=true&include=pinned", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotFilter.Starred == nil || !*gotFilter.Starred || gotFilter.Pinned != nil {
+		t.Fatalf("unexpected filter: %+v", gotFilter)
+	}
+
+	expected := "{\"pinned\":[{\"id\":1,\"body\":\"pinned\",\"created_at\":\"2026-03-10T00:00:00Z\",\"pinned\":true}]," +
+		"\"messages\":[{\"id\":2,\"body\":\"starred\",\"created_at\":\"2026-03-11T00:00:00Z\",\"starred\":true}]}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultMessageWindowSize = 50
+	maxMessageWindowSize     = 500
+	maxMessageExcerptRunes   = 10000
+)
+
+type messageFieldSet uint16
+
+const (
+	messageFieldID messageFieldSet = 1 << iota
+	messageFieldBody
+	messageFieldCreatedAt
+	messageFieldParentID
+	messageFieldReplyCount
+	messageFieldAttachmentCount
+	messageFieldPinned
+	messageFieldStarred
+	messageFieldPreviews
+	messageFieldEntities
+)
+
+var messageFieldNames = map[string]messageFieldSet{
+	"id":               messageFieldID,
+	"body":             messageFieldBody,
+	"created_at":       messageFieldCreatedAt,
+	"parent_id":        messageFieldParentID,
+	"reply_count":      messageFieldReplyCount,
+	"attachment_count": messageFieldAttachmentCount,
+	"pinned":           messageFieldPinned,
+	"starred":          messageFieldStarred,
+	"previews":         messageFieldPreviews,
+	"entities":         messageFieldEntities,
+}
+
+var errInvalidAround = errors.New("invalid around")
+
+var hashtagPattern = regexp.MustCompile(`^[\p{L}\p{N}_]{1,64}$`)
+
+// From は含み、To は含まない。Tag は本文中の #タグ に一致させる
+type messageFilter struct {
+	From    *time.Time
+	To      *time.Time
+	Tag     string
+	Pinned  *bool
+	Starred *bool
+}
+
+// created_at が同じメッセージを安定して並べるため id も併せて位置を表す
+type messagePivot struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+type messageCursors struct {
+	Before *int `json:"before"`
+	After  *int `json:"after"`
+}
+
+type messageListQuery struct {
+	Filter   messageFilter
+	Group    string
+	Location *time.Location
+	Around   string
+	Before   int
+	After    int
+	Limit    int
+	Fields   messageFieldSet
+	Excerpt  int
+
+	IncludePinned bool
+}
+
+func (q messageListQuery) isWindowed() bool {
+	return q.Around != "" || q.Before != 0 || q.After != 0
+}
+
+var findMessagePivot = func(userID string, id int) (messagePivot, error) {
+	var pivot messagePivot
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			"SELECT id, created_at FROM messages WHERE id = $1 AND user_id = $2",
+			id, userID,
+		).Scan(&pivot.ID, &pivot.CreatedAt)
+	})
+	if err != nil {
+		return messagePivot{}, err
+	}
+	return pivot, nil
+}
+
+// pivot の前後 limit 件を created_at 昇順で返し、さらに続きがあるかも返す
+var listMessagesAdjacent = func(userID string, filter messageFilter, pivot messagePivot, forward bool, inclusive bool, limit int) ([]messageListItem, bool, error) {
+	where, args := messageFilterClause(userID, filter)
+
+	operator := "<"
+	order := "DESC"
+	if forward {
+		operator = ">"
+		order = "ASC"
+	}
+	if inclusive {
+		operator += "="
+	}
+
+	args = append(args, pivot.CreatedAt, pivot.ID, limit+1)
+	query := fmt.Sprintf(
+		`SELECT %s
+		 FROM messages
+		 WHERE %s AND (created_at, id) %s ($%d, $%d)
+		 ORDER BY created_at %s, id %s
+		 LIMIT $%d`,
+		messageColumns, where, operator, len(args)-2, len(args)-1, order, order, len(args),
+	)
+
+	messages := make([]messageListItem, 0, limit+1)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			message, err := scanMessage(rows)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	if !forward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, hasMore, nil
+}
+
+func messageFilterClause(userID string, filter messageFilter) (string, []any) {
+	conditions := []string{"user_id = $1"}
+	args := []any{userID}
+
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if filter.Tag != "" {
+		// Tag は hashtagPattern で検証済みなので正規表現に埋め込んでも安全
+		args = append(args, filter.Tag)
+		conditions = append(conditions, fmt.Sprintf(
+			"body ~* ('(^|[^[:alnum:]_])#' || $%d || '($|[^[:alnum:]_])')", len(args),
+		))
+	}
+
+	if filter.Pinned != nil {
+		conditions = append(conditions, flagCondition("pinned_at", *filter.Pinned))
+	}
+	if filter.Starred != nil {
+		conditions = append(conditions, flagCondition("starred_at", *filter.Starred))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+func flagCondition(column string, set bool) string {
+	if set {
+		return column + " IS NOT NULL"
+	}
+	return column + " IS NULL"
+}
+
+// 戻り値の string は 400 で返すメッセージ、error は内部エラー
+// 一覧とエクスポートで共通の絞り込み条件。日付だけの from/to やグループ化にはタイムゾーンが要る
+func parseMessageFilter(values url.Values, userID string, needsLocation bool) (messageFilter, *time.Location, string, error) {
+	var filter messageFilter
+	var location *time.Location
+
+	from := values.Get("from")
+	to := values.Get("to")
+	needsLocation = needsLocation || isDateOnly(from) || isDateOnly(to)
+	if needsLocation {
+		resolved, status := resolveRequestLocation(userID, values.Get("tz"))
+		if status == http.StatusBadRequest {
+			return messageFilter{}, nil, "invalid tz", nil
+		}
+		if status != http.StatusOK {
+			return messageFilter{}, nil, "", fmt.Errorf("failed to resolve timezone")
+		}
+		location = resolved
+	}
+
+	if from != "" {
+		parsed, ok := parseMessageBound(from, location, false)
+		if !ok {
+			return messageFilter{}, nil, "invalid from", nil
+		}
+		filter.From = &parsed
+	}
+	if to != "" {
+		parsed, ok := parseMessageBound(to, location, true)
+		if !ok {
+			return messageFilter{}, nil, "invalid to", nil
+		}
+		filter.To = &parsed
+	}
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		return messageFilter{}, nil, "from must be before to", nil
+	}
+
+	if tag := strings.TrimPrefix(values.Get("tag"), "#"); tag != "" {
+		if !hashtagPattern.MatchString(tag) {
+			return messageFilter{}, nil, "invalid tag", nil
+		}
+		filter.Tag = tag
+	}
+
+	if value := values.Get("pinned"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return messageFilter{}, nil, "invalid pinned", nil
+		}
+		filter.Pinned = &parsed
+	}
+	if value := values.Get("starred"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return messageFilter{}, nil, "invalid starred", nil
+		}
+		filter.Starred = &parsed
+	}
+
+	return filter, location, "", nil
+}
+
+func parseMessageListQuery(r *http.Request, userID string) (messageListQuery, string, error) {
+	values := r.URL.Query()
+	query := messageListQuery{
+		Group:  values.Get("group"),
+		Around: strings.TrimSpace(values.Get("around")),
+		Limit:  defaultMessageWindowSize,
+	}
+
+	if query.Group != "" && query.Group != "day" {
+		return messageListQuery{}, "invalid group", nil
+	}
+
+	filter, location, badRequest, err := parseMessageFilter(values, userID, query.Group == "day")
+	if badRequest != "" || err != nil {
+		return messageListQuery{}, badRequest, err
+	}
+	query.Filter = filter
+	query.Location = location
+
+	if value := values.Get("include"); value != "" {
+		if value != "pinned" {
+			return messageListQuery{}, "invalid include", nil
+		}
+		query.IncludePinned = true
+	}
+
+	if value := values.Get("before"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return messageListQuery{}, "invalid before", nil
+		}
+		query.Before = parsed
+	}
+	if value := values.Get("after"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return messageListQuery{}, "invalid after", nil
+		}
+		query.After = parsed
+	}
+
+	modes := 0
+	for _, set := range []bool{query.Around != "", query.Before != 0, query.After != 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return messageListQuery{}, "around, before and after are mutually exclusive", nil
+	}
+
+	if value := values.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxMessageWindowSize {
+			return messageListQuery{}, "invalid limit", nil
+		}
+		query.Limit = parsed
+	}
+
+	if value := values.Get("fields"); value != "" {
+		for _, name := range strings.Split(value, ",") {
+			field, ok := messageFieldNames[strings.TrimSpace(name)]
+			if !ok {
+				return messageListQuery{}, "invalid fields", nil
+			}
+			query.Fields |= field
+		}
+	}
+
+	if value := values.Get("excerpt"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxMessageExcerptRunes {
+			return messageListQuery{}, "invalid excerpt", nil
+		}
+		query.Excerpt = parsed
+	}
+
+	return query, "", nil
+}
+
+// 大きなメモは excerpt 文字数で切り詰め、truncated で知らせる
+func applyMessageView(messages []messageListItem, fields messageFieldSet, excerpt int) {
+	for i := range messages {
+		messages[i].fields = fields
+		if excerpt == 0 || utf8.RuneCountInString(messages[i].Body) <= excerpt {
+			continue
+		}
+
+		body := messages[i].Body
+		cut := 0
+		for range excerpt {
+			_, size := utf8.DecodeRuneInString(body[cut:])
+			cut += size
+		}
+		messages[i].Body = body[:cut]
+		messages[i].Entities = clipEntities(messages[i].Entities, cut)
+		messages[i].Truncated = true
+	}
+}
+
+func (m messageListItem) MarshalJSON() ([]byte, error) {
+	type plain messageListItem
+	if m.fields == 0 {
+		return json.Marshal(plain(m))
+	}
+
+	sparse := make(map[string]any, len(messageFieldNames)+1)
+	if m.fields&messageFieldID != 0 {
+		sparse["id"] = m.ID
+	}
+	if m.fields&messageFieldBody != 0 {
+		sparse["body"] = m.Body
+		if m.Truncated {
+			sparse["truncated"] = true
+		}
+	}
+	if m.fields&messageFieldCreatedAt != 0 {
+		sparse["created_at"] = m.CreatedAt
+	}
+	if m.fields&messageFieldParentID != 0 {
+		sparse["parent_id"] = m.ParentID
+	}
+	if m.fields&messageFieldReplyCount != 0 {
+		sparse["reply_count"] = m.ReplyCount
+	}
+	if m.fields&messageFieldAttachmentCount != 0 {
+		sparse["attachment_count"] = m.AttachmentCount
+	}
+	if m.fields&messageFieldPinned != 0 {
+		sparse["pinned"] = m.Pinned
+	}
+	if m.fields&messageFieldStarred != 0 {
+		sparse["starred"] = m.Starred
+	}
+	if m.fields&messageFieldPreviews != 0 {
+		previews := m.Previews
+		if previews == nil {
+			previews = []linkPreview{}
+		}
+		sparse["previews"] = previews
+	}
+	if m.fields&messageFieldEntities != 0 {
+		entities := m.Entities
+		if entities == nil {
+			entities = []messageEntity{}
+		}
+		sparse["entities"] = entities
+	}
+	return json.Marshal(sparse)
+}
+
+func isDateOnly(value string) bool {
+	_, err := time.Parse(time.DateOnly, value)
+	return err == nil
+}
+
+// 日付のみの to はその日の終わりまでを含める
+func parseMessageBound(value string, location *time.Location, isEnd bool) (time.Time, bool) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, true
+	}
+
+	if location == nil {
+		return time.Time{}, false
+	}
+	parsed, err := time.ParseInLocation(time.DateOnly, value, location)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if isEnd {
+		parsed = parsed.AddDate(0, 0, 1)
+	}
+	return parsed, true
+}
+
+// around は RFC3339 のタイムスタンプかメッセージ id を受け付ける
+func resolveAroundPivot(userID string, around string) (messagePivot, error) {
+	if parsed, err := time.Parse(time.RFC3339, around); err == nil {
+		return messagePivot{CreatedAt: parsed, ID: 0}, nil
+	}
+
+	id, err := strconv.Atoi(around)
+	if err != nil || id <= 0 {
+		return messagePivot{}, errInvalidAround
+	}
+	return findMessagePivot(userID, id)
+}
+
+func loadMessageWindow(userID string, query messageListQuery) ([]messageListItem, messageCursors, error) {
+	var before, after []messageListItem
+	var hasMoreBefore, hasMoreAfter bool
+
+	switch {
+	case query.Around != "":
+		pivot, err := resolveAroundPivot(userID, query.Around)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+
+		beforeLimit := query.Limit / 2
+		if beforeLimit > 0 {
+			before, hasMoreBefore, err = listMessagesAdjacent(userID, query.Filter, pivot, false, false, beforeLimit)
+			if err != nil {
+				return nil, messageCursors{}, err
+			}
+		}
+		after, hasMoreAfter, err = listMessagesAdjacent(userID, query.Filter, pivot, true, true, query.Limit-beforeLimit)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+
+	case query.Before != 0:
+		pivot, err := findMessagePivot(userID, query.Before)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+		before, hasMoreBefore, err = listMessagesAdjacent(userID, query.Filter, pivot, false, false, query.Limit)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+		hasMoreAfter = true
+
+	case query.After != 0:
+		pivot, err := findMessagePivot(userID, query.After)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+		after, hasMoreAfter, err = listMessagesAdjacent(userID, query.Filter, pivot, true, false, query.Limit)
+		if err != nil {
+			return nil, messageCursors{}, err
+		}
+		hasMoreBefore = true
+	}
+
+	messages := append(before, after...)
+	if messages == nil {
+		messages = make([]messageListItem, 0)
+	}
+
+	var cursors messageCursors
+	if len(messages) > 0 {
+		if hasMoreBefore {
+			id := messages[0].ID
+			cursors.Before = &id
+		}
+		if hasMoreAfter {
+			id := messages[len(messages)-1].ID
+			cursors.After = &id
+		}
+	}
+	return messages, cursors, nil
+}
@@ -12,15 +12,97 @@ import (
 )
 
 type messageListItem struct {
-	ID        int       `json:"id"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         int       `json:"id"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ParentID   *int      `json:"parent_id,omitempty"`
+	ReplyCount int       `json:"reply_count,omitempty"`
+	// 添付ファイルの一覧は GET /api/messages/{id}/attachments で取る
+	AttachmentCount int  `json:"attachment_count,omitempty"`
+	Pinned          bool `json:"pinned,omitempty"`
+	Starred         bool `json:"starred,omitempty"`
+	Truncated       bool `json:"truncated,omitempty"`
+	// 取得済みのリンクプレビューだけを本文中の出現順に返す
+	Previews []linkPreview   `json:"previews,omitempty"`
+	Entities []messageEntity `json:"entities,omitempty"`
+
+	// 0 なら全フィールドを返す。fields= 指定時だけ設定される
+	fields messageFieldSet
+}
+
+// MarshalJSON を持たない別名。独自の JSON 表現の中に埋め込むときに使う
+type plainMessageListItem messageListItem
+
+type messageDetailResponse struct {
+	messageListItem
+	PreviousID *int
+	NextID     *int
+}
+
+func (d messageDetailResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainMessageListItem
+		PreviousID *int `json:"previous_id"`
+		NextID     *int `json:"next_id"`
+	}{plainMessageListItem(d.messageListItem), d.PreviousID, d.NextID})
+}
+
+// SELECT や RETURNING で使う列。並びは scanMessage と合わせる
+const messageColumns = `id, body, created_at, parent_id,
+	(SELECT COUNT(*) FROM messages replies WHERE replies.parent_id = messages.id),
+	(SELECT COUNT(*) FROM attachments WHERE attachments.message_id = messages.id),
+	pinned_at IS NOT NULL, starred_at IS NOT NULL,
+	(SELECT json_agg(json_build_object(
+		'url', link_previews.url, 'title', link_previews.title, 'description', link_previews.description,
+		'image_url', link_previews.image_url, 'site_name', link_previews.site_name
+	) ORDER BY message_links.position)
+	 FROM message_links JOIN link_previews ON link_previews.url = message_links.url
+	 WHERE message_links.message_id = messages.id AND link_previews.status = 'ready'),
+	entities`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (messageListItem, error) {
+	var message messageListItem
+	var parentID sql.NullInt64
+	var previews, entities []byte
+	err := row.Scan(&message.ID, &message.Body, &message.CreatedAt, &parentID, &message.ReplyCount, &message.AttachmentCount, &message.Pinned, &message.Starred, &previews, &entities)
+	if err != nil {
+		return message, err
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		message.ParentID = &id
+	}
+	if message.Previews, err = decodeLinkPreviews(previews); err != nil {
+		return message, err
+	}
+	message.Entities, err = decodeEntities(entities, message.Body)
+	return message, err
 }
 
 type messageListResponse struct {
+	Pinned   []messageListItem `json:"pinned,omitempty"`
+	Messages []messageListItem `json:"messages"`
+	Cursors  *messageCursors   `json:"cursors,omitempty"`
+}
+
+type messageDayGroup struct {
+	Date     string            `json:"date"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
 	Messages []messageListItem `json:"messages"`
 }
 
+type messageDayGroupResponse struct {
+	Timezone string            `json:"timezone"`
+	Pinned   []messageListItem `json:"pinned,omitempty"`
+	Days     []messageDayGroup `json:"days"`
+	Cursors  *messageCursors   `json:"cursors,omitempty"`
+}
+
 type createMessageRequest struct {
 	Body string `json:"body"`
 }
@@ -31,13 +113,21 @@ type updateMessageRequest struct {
 
 var insertMessage = func(userID string, body string) (messageListItem, error) {
 	var message messageListItem
-	err := db.QueryRow(
-		`INSERT INTO messages (user_id, body)
-		 VALUES ($1, $2)
-		 RETURNING id, body, created_at`,
-		userID,
-		body,
-	).Scan(&message.ID, &message.Body, &message.CreatedAt)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		message, err = scanMessage(tx.QueryRow(
+			`INSERT INTO messages (user_id, body, entities)
+			 VALUES ($1, $2, $3)
+			 RETURNING `+messageColumns,
+			userID,
+			body,
+			encodeEntities(body),
+		))
+		if err != nil {
+			return err
+		}
+		return saveMessageLinks(tx, userID, &message)
+	})
 	if err != nil {
 		return messageListItem{}, err
 	}
@@ -45,35 +135,57 @@ var insertMessage = func(userID string, body string) (messageListItem, error) {
 	return message, nil
 }
 
+// 返信は parent_id の ON DELETE SET NULL で独立したメッセージとして残る。
+// 添付ファイルとアーカイブの行はカスケードで消えるので、ブロブはコミット後に削除する
 var deleteMessage = func(id int, userID string) (bool, error) {
-	result, err := db.Exec(
-		`DELETE FROM messages WHERE id = $1 AND user_id = $2`,
-		id,
-		userID,
-	)
-	if err != nil {
-		return false, err
-	}
+	var rowsAffected int64
+	var blobKeys []string
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		blobKeys, err = listMessageBlobKeys(tx, "message_id = $1 AND user_id = $2", id, userID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			`DELETE FROM messages WHERE id = $1 AND user_id = $2`,
+			id,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
 
-	rowsAffected, err := result.RowsAffected()
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
 
+	removeBlobs(blobKeys)
 	return rowsAffected > 0, nil
 }
 
 var updateMessage = func(id int, userID string, body string) (messageListItem, error) {
 	var message messageListItem
-	err := db.QueryRow(
-		`UPDATE messages
-		 SET body = $1
-		 WHERE id = $2 AND user_id = $3
-		 RETURNING id, body, created_at`,
-		body,
-		id,
-		userID,
-	).Scan(&message.ID, &message.Body, &message.CreatedAt)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		message, err = scanMessage(tx.QueryRow(
+			`UPDATE messages
+			 SET body = $1, entities = $4
+			 WHERE id = $2 AND user_id = $3
+			 RETURNING `+messageColumns,
+			body,
+			id,
+			userID,
+			encodeEntities(body),
+		))
+		if err != nil {
+			return err
+		}
+		return saveMessageLinks(tx, userID, &message)
+	})
 	if err != nil {
 		return messageListItem{}, err
 	}
@@ -81,6 +193,74 @@ var updateMessage = func(id int, userID string, body string) (messageListItem, e
 	return message, nil
 }
 
+// 前後のメッセージは一覧と同じ (created_at, id) の順序で決める
+var findMessage = func(id int, userID string) (messageDetailResponse, error) {
+	var detail messageDetailResponse
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		detail.messageListItem, err = scanMessage(tx.QueryRow(
+			`SELECT `+messageColumns+` FROM messages WHERE id = $1 AND user_id = $2`,
+			id,
+			userID,
+		))
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRow(
+			`SELECT
+			   (SELECT id FROM messages
+			    WHERE user_id = $1 AND (created_at, id) < ($2, $3)
+			    ORDER BY created_at DESC, id DESC LIMIT 1),
+			   (SELECT id FROM messages
+			    WHERE user_id = $1 AND (created_at, id) > ($2, $3)
+			    ORDER BY created_at ASC, id ASC LIMIT 1)`,
+			userID,
+			detail.CreatedAt,
+			detail.ID,
+		).Scan(&detail.PreviousID, &detail.NextID)
+	})
+	if err != nil {
+		return messageDetailResponse{}, err
+	}
+
+	return detail, nil
+}
+
+var listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+	where, args := messageFilterClause(userID, filter)
+
+	messages := make([]messageListItem, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE `+where+`
+			 ORDER BY created_at ASC, id ASC`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			message, err := scanMessage(rows)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
 func listMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := getUserIDFromContext(r.Context())
 	if !ok || userID == "" {
@@ -88,35 +268,130 @@ func listMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(
-		`SELECT id, body, created_at
-		 FROM messages
-		 WHERE user_id = $1
-		 ORDER BY created_at ASC`,
-		userID,
-	)
+	query, badRequest, err := parseMessageListQuery(r, userID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
-	defer rows.Close()
+	if badRequest != "" {
+		writeError(w, http.StatusBadRequest, badRequest)
+		return
+	}
 
-	messages := make([]messageListItem, 0)
-	for rows.Next() {
-		var message messageListItem
-		if err := rows.Scan(&message.ID, &message.Body, &message.CreatedAt); err != nil {
+	var messages []messageListItem
+	var cursors *messageCursors
+	if query.isWindowed() {
+		var window messageCursors
+		messages, window, err = loadMessageWindow(userID, query)
+		if err != nil {
+			switch {
+			case errors.Is(err, errInvalidAround):
+				writeError(w, http.StatusBadRequest, "invalid around")
+			case errors.Is(err, sql.ErrNoRows):
+				writeError(w, http.StatusNotFound, "message not found")
+			default:
+				writeError(w, http.StatusInternalServerError, "internal server error")
+			}
+			return
+		}
+		cursors = &window
+	} else {
+		messages, err = listMessages(userID, query.Filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+	}
+	applyMessageView(messages, query.Fields, query.Excerpt)
+
+	var pinned []messageListItem
+	if query.IncludePinned {
+		pinned, err = listPinnedMessages(userID)
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, "internal server error")
 			return
 		}
-		messages = append(messages, message)
+		applyMessageView(pinned, query.Fields, query.Excerpt)
+	}
+
+	if query.Group == "day" {
+		writeJSON(w, http.StatusOK, messageDayGroupResponse{
+			Timezone: query.Location.String(),
+			Pinned:   pinned,
+			Days:     groupMessagesByDay(messages, query.Location),
+			Cursors:  cursors,
+		})
+		return
 	}
 
-	if err := rows.Err(); err != nil {
+	writeJSON(w, http.StatusOK, messageListResponse{Pinned: pinned, Messages: messages, Cursors: cursors})
+}
+
+// tz が指定されていなければユーザー設定のタイムゾーンを使う。
+// 戻り値のステータスで「tz が不正」と「設定の取得失敗」を区別する
+func resolveRequestLocation(userID string, tz string) (*time.Location, int) {
+	if tz != "" {
+		location, err := loadTimezone(tz)
+		if err != nil {
+			return nil, http.StatusBadRequest
+		}
+		return location, http.StatusOK
+	}
+
+	settings, err := getUserSettings(userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return settings.location(), http.StatusOK
+}
+
+// messages は created_at 昇順で渡される前提
+func groupMessagesByDay(messages []messageListItem, location *time.Location) []messageDayGroup {
+	days := make([]messageDayGroup, 0)
+	for _, message := range messages {
+		local := message.CreatedAt.In(location)
+		date := local.Format(time.DateOnly)
+
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+			days = append(days, messageDayGroup{
+				Date:     date,
+				Start:    start,
+				End:      start.AddDate(0, 0, 1),
+				Messages: make([]messageListItem, 0),
+			})
+		}
+
+		days[len(days)-1].Messages = append(days[len(days)-1].Messages, message)
+	}
+	return days
+}
+
+func getMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "id")
+	messageID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	message, err := findMessage(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
 		writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
 
-	writeJSON(w, http.StatusOK, messageListResponse{Messages: messages})
+	writeJSON(w, http.StatusOK, message)
 }
 
 func createMessageHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,6 +419,8 @@ func createMessageHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
+	enqueueLinkPreviews(message.Body)
+	enqueueMessageArchive(userID, message, false)
 
 	writeJSON(w, http.StatusCreated, message)
 }
@@ -184,6 +461,8 @@ func updateMessageHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "internal server error")
 		return
 	}
+	enqueueLinkPreviews(message.Body)
+	enqueueMessageArchive(userID, message, true)
 
 	writeJSON(w, http.StatusOK, message)
 }
@@ -213,5 +492,9 @@ func deleteMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, userID, auditEventMessageDelete, auditOutcomeSuccess, map[string]string{
+		"message_id": strconv.Itoa(messageID),
+	})
+
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -567,3 +567,391 @@ func TestDeleteMessageHandler_NotFoundForOtherUsersMessage(t *testing.T) {
 		t.Fatalf("unexpected response body: %s", body)
 	}
 }
+
+func TestListMessagesHandler_GroupsByLocalDayAcrossDST(t *testing.T) {
+	originalListMessages := listMessages
+	t.Cleanup(func() {
+		listMessages = originalListMessages
+	})
+
+	// 2026-03-08 は America/New_York で夏時間が始まり、1 日が 23 時間になる
+	listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+		return []messageListItem{
+			{ID: 1, Body: "3/7 夜", CreatedAt: time.Date(2026, 3, 8, 4, 30, 0, 0, time.UTC)},
+			{ID: 2, Body: "3/8 未明", CreatedAt: time.Date(2026, 3, 8, 5, 30, 0, 0, time.UTC)},
+			{ID: 3, Body: "3/8 深夜", CreatedAt: time.Date(2026, 3, 9, 3, 59, 0, 0, time.UTC)},
+			{ID: 4, Body: "3/9 未明", CreatedAt: time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC)},
+		}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?group=day&tz=America/New_York", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	var response messageDayGroupResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.Timezone != "America/New_York" {
+		t.Fatalf("expected timezone America/New_York, got %s", response.Timezone)
+	}
+
+	if len(response.Days) != 3 {
+		t.Fatalf("expected 3 days, got %d", len(response.Days))
+	}
+
+	expectedDates := []string{"2026-03-07", "2026-03-08", "2026-03-09"}
+	expectedCounts := []int{1, 2, 1}
+	for i, day := range response.Days {
+		if day.Date != expectedDates[i] || len(day.Messages) != expectedCounts[i] {
+			t.Fatalf("day %d: expected %s with %d messages, got %s with %d", i, expectedDates[i], expectedCounts[i], day.Date, len(day.Messages))
+		}
+	}
+
+	if length := response.Days[1].End.Sub(response.Days[1].Start); length != 23*time.Hour {
+		t.Fatalf("expected DST day to be 23 hours, got %s", length)
+	}
+}
+
+func TestListMessagesHandler_RejectsInvalidTimezone(t *testing.T) {
+	originalListMessages := listMessages
+	t.Cleanup(func() {
+		listMessages = originalListMessages
+	})
+
+	wasCalled := false
+	listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+		wasCalled = true
+		return nil, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?group=day&tz=Nowhere/City", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if wasCalled {
+		t.Fatalf("listMessages should not be called for invalid tz")
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid tz\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_FiltersByLocalDateRange(t *testing.T) {
+	originalListMessages := listMessages
+	t.Cleanup(func() {
+		listMessages = originalListMessages
+	})
+
+	var gotFilter messageFilter
+	listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+		gotFilter = filter
+		return []messageListItem{}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?from=2026-03-01&to=2026-03-31&tz=Asia/Tokyo", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	if gotFilter.From == nil || !gotFilter.From.Equal(time.Date(2026, 2, 28, 15, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected from: %v", gotFilter.From)
+	}
+
+	// to は指定日を含むので翌日 0 時 (JST) までになる
+	if gotFilter.To == nil || !gotFilter.To.Equal(time.Date(2026, 3, 31, 15, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected to: %v", gotFilter.To)
+	}
+
+	if body := recorder.Body.String(); body != "{\"messages\":[]}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_RejectsInvertedDateRange(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?from=2026-04-01T00:00:00Z&to=2026-03-01T00:00:00Z", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"from must be before to\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_ReturnsWindowAroundMessage(t *testing.T) {
+	originalFindMessagePivot := findMessagePivot
+	originalListMessagesAdjacent := listMessagesAdjacent
+	t.Cleanup(func() {
+		findMessagePivot = originalFindMessagePivot
+		listMessagesAdjacent = originalListMessagesAdjacent
+	})
+
+	pivotTime := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	findMessagePivot = func(userID string, id int) (messagePivot, error) {
+		if id != 10 {
+			return messagePivot{}, sql.ErrNoRows
+		}
+		return messagePivot{CreatedAt: pivotTime, ID: 10}, nil
+	}
+
+	type adjacentCall struct {
+		forward   bool
+		inclusive bool
+		limit     int
+	}
+	var calls []adjacentCall
+	listMessagesAdjacent = func(userID string, filter messageFilter, pivot messagePivot, forward bool, inclusive bool, limit int) ([]messageListItem, bool, error) {
+		calls = append(calls, adjacentCall{forward: forward, inclusive: inclusive, limit: limit})
+		if forward {
+			return []messageListItem{
+				{ID: 10, Body: "pivot", CreatedAt: pivotTime},
+				{ID: 11, Body: "after", CreatedAt: pivotTime.Add(time.Minute)},
+			}, false, nil
+		}
+		return []messageListItem{
+			{ID: 8, Body: "before 2", CreatedAt: pivotTime.Add(-2 * time.Minute)},
+			{ID: 9, Body: "before 1", CreatedAt: pivotTime.Add(-time.Minute)},
+		}, true, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?around=10&limit=5", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expectedCalls := []adjacentCall{{forward: false, inclusive: false, limit: 2}, {forward: true, inclusive: true, limit: 3}}
+	if len(calls) != len(expectedCalls) || calls[0] != expectedCalls[0] || calls[1] != expectedCalls[1] {
+		t.Fatalf("unexpected adjacent calls: %+v", calls)
+	}
+
+	var response messageListResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	gotIDs := make([]int, 0, len(response.Messages))
+	for _, message := range response.Messages {
+		gotIDs = append(gotIDs, message.ID)
+	}
+	if len(gotIDs) != 4 || gotIDs[0] != 8 || gotIDs[3] != 11 {
+		t.Fatalf("unexpected message ids: %v", gotIDs)
+	}
+
+	if response.Cursors == nil || response.Cursors.Before == nil || *response.Cursors.Before != 8 {
+		t.Fatalf("expected before cursor 8, got %+v", response.Cursors)
+	}
+	if response.Cursors.After != nil {
+		t.Fatalf("expected no after cursor, got %d", *response.Cursors.After)
+	}
+}
+
+func TestListMessagesHandler_AroundUnknownMessageReturnsNotFound(t *testing.T) {
+	originalFindMessagePivot := findMessagePivot
+	t.Cleanup(func() {
+		findMessagePivot = originalFindMessagePivot
+	})
+
+	findMessagePivot = func(userID string, id int) (messagePivot, error) {
+		return messagePivot{}, sql.ErrNoRows
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?around=999", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"message not found\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_RejectsConflictingCursors(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?before=3&after=5", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"around, before and after are mutually exclusive\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestGetMessageHandler_UnauthorizedWithoutSession(t *testing.T) {
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(authMiddleware)
+		r.Get("/api/messages/{id}", getMessageHandler)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/1", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestGetMessageHandler_RejectsInvalidID(t *testing.T) {
+	router := chi.NewRouter()
+	router.Get("/api/messages/{id}", getMessageHandler)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/abc", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid message id\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestGetMessageHandler_NotFoundForOtherUsersMessage(t *testing.T) {
+	originalFindMessage := findMessage
+	t.Cleanup(func() {
+		findMessage = originalFindMessage
+	})
+
+	var gotUserID string
+	findMessage = func(id int, userID string) (messageDetailResponse, error) {
+		gotUserID = userID
+		return messageDetailResponse{}, sql.ErrNoRows
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/messages/{id}", getMessageHandler)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/42", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	if gotUserID != "user-1" {
+		t.Fatalf("expected user_id user-1, got %s", gotUserID)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"message not found\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestGetMessageHandler_ReturnsMessageWithNeighbors(t *testing.T) {
+	originalFindMessage := findMessage
+	t.Cleanup(func() {
+		findMessage = originalFindMessage
+	})
+
+	previousID := 41
+	findMessage = func(id int, userID string) (messageDetailResponse, error) {
+		return messageDetailResponse{
+			messageListItem: messageListItem{
+				ID:        id,
+				Body:      "hello",
+				CreatedAt: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+				Pinned:    true,
+			},
+			PreviousID: &previousID,
+		}, nil
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/messages/{id}", getMessageHandler)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/42", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "{\"id\":42,\"body\":\"hello\",\"created_at\":\"2026-03-10T12:00:00Z\",\"pinned\":true,\"previous_id\":41,\"next_id\":null}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_AppliesSparseFieldsAndExcerpt(t *testing.T) {
+	originalListMessages := listMessages
+	t.Cleanup(func() {
+		listMessages = originalListMessages
+	})
+
+	listMessages = func(userID string, filter messageFilter) ([]messageListItem, error) {
+		return []messageListItem{
+			{ID: 1, Body: "短いメモ", CreatedAt: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)},
+			{ID: 2, Body: "とても長いメモの本文です", CreatedAt: time.Date(2026, 3, 10, 13, 0, 0, 0, time.UTC)},
+		}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?fields=id,body&excerpt=4", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "{\"messages\":[{\"body\":\"短いメモ\",\"id\":1},{\"body\":\"とても長\",\"id\":2,\"truncated\":true}]}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestListMessagesHandler_RejectsUnknownField(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/api/messages?fields=id,user_id", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	listMessagesHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid fields\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
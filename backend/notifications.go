@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Key は同じ通知を見分けるための識別子 (リマインダーなら reminder-<id>)。
+// 再送されうるので、重複を嫌う通知先はこれで間引く
+type notification struct {
+	UserID    string
+	Key       string
+	Title     string
+	Body      string
+	MessageID int
+}
+
+// Name は配信済みの記録に使うので、通知先ごとに変えない
+type notifier interface {
+	Name() string
+	Notify(ctx context.Context, n notification) error
+}
+
+var notifiers = []notifier{logNotifier{}}
+
+// NOTIFIERS はカンマ区切り (例: "log,mail,webpush")。
+// 未設定なら log と、Web Push が有効ならそれも使う
+func newNotifiersFromEnv() ([]notifier, error) {
+	value := os.Getenv("NOTIFIERS")
+	if value == "" {
+		if webPushSender != nil {
+			return []notifier{logNotifier{}, webPushNotifier{}}, nil
+		}
+		return []notifier{logNotifier{}}, nil
+	}
+
+	configured := make([]notifier, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		switch name {
+		case "log":
+			configured = append(configured, logNotifier{})
+		case "mail":
+			configured = append(configured, mailNotifier{})
+		case "webpush":
+			if webPushSender == nil {
+				return nil, fmt.Errorf("WEB_PUSH_SUBJECT is required for webpush notifier")
+			}
+			configured = append(configured, webPushNotifier{})
+		default:
+			return nil, fmt.Errorf("unknown notifier: %s", name)
+		}
+	}
+	if len(configured) == 0 {
+		return nil, fmt.Errorf("NOTIFIERS is empty")
+	}
+	return configured, nil
+}
+
+// delivered に含まれる通知先には送らず、届いた通知先ごとに markDelivered で記録する。
+// 失敗した通知先が 1 つでもあればエラーを返して再試行させる。
+// ログのように必ず成功する通知先が、他の通知先の失敗を隠さないようにするため
+func dispatchNotification(ctx context.Context, n notification, delivered map[string]bool, markDelivered func(name string) error) error {
+	errs := make([]error, 0)
+	for _, target := range notifiers {
+		name := target.Name()
+		if delivered[name] {
+			continue
+		}
+		if err := target.Notify(ctx, n); err != nil {
+			log.Printf("notifier %s failed for %s: %v", name, n.Key, err)
+			errs = append(errs, err)
+			continue
+		}
+		// 記録できなければ再試行で同じ通知先にもう一度送ることになるが、取りこぼすよりはよい
+		if err := markDelivered(name); err != nil {
+			errs = append(errs, fmt.Errorf("failed to record delivery to %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Name() string {
+	return "log"
+}
+
+// 本文はメモの内容そのものなので、ログには出さない
+func (logNotifier) Notify(ctx context.Context, n notification) error {
+	log.Printf("notification user=%s key=%s title=%q", n.UserID, n.Key, n.Title)
+	return nil
+}
+
+// メールアドレスを登録していない利用者には送らない (失敗扱いにもしない)
+type mailNotifier struct{}
+
+func (mailNotifier) Name() string {
+	return "mail"
+}
+
+func (mailNotifier) Notify(ctx context.Context, n notification) error {
+	profile, err := findUserProfile(n.UserID)
+	if err != nil {
+		return err
+	}
+	if profile.Email == "" {
+		return nil
+	}
+	return mailer.Send(ctx, mailMessage{To: profile.Email, Subject: n.Title, Body: n.Body})
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+const (
+	oidcLoginStateTTL   = 10 * time.Minute
+	oidcClockSkew       = 2 * time.Minute
+	oidcMaxBodyBytes    = 1 << 20
+	oidcStateCookieName = "oidc_state"
+	oidcResumeParam     = "resume"
+)
+
+var (
+	errOIDCProviderNotFound = errors.New("oidc provider is not configured")
+	errOIDCStateInvalid     = errors.New("oidc state is invalid or expired")
+	errOIDCIdentityUnknown  = errors.New("oidc identity is not linked to any user")
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidcProviders = map[string]*oidcProvider{}
+
+type oidcProvider struct {
+	Name          string
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	AutoProvision bool
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      jsonWebKeySet
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcLoginState struct {
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   string
+	ExpiresAt    time.Time
+}
+
+type oidcTokenResponse struct {
+	IDToken   string `json:"id_token"`
+	TokenType string `json:"token_type"`
+}
+
+type oidcIDTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	ExpiresAt         int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+type oidcProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+// ログインを始めただけで戻ってこなかった分が溜まらないよう、期限切れの行を合わせて消す
+var insertOIDCLoginState = func(state oidcLoginState) error {
+	var linkUserID sql.NullString
+	if state.LinkUserID != "" {
+		linkUserID = sql.NullString{String: state.LinkUserID, Valid: true}
+	}
+
+	_, err := db.Exec(
+		`WITH expired AS (
+		   DELETE FROM oidc_login_states WHERE expires_at <= NOW()
+		 )
+		 INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, link_user_id, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		state.StateHash, state.Provider, state.Nonce, state.CodeVerifier, linkUserID, state.ExpiresAt,
+	)
+	return err
+}
+
+var consumeOIDCLoginState = func(stateHash string) (oidcLoginState, error) {
+	var state oidcLoginState
+	var linkUserID sql.NullString
+	err := db.QueryRow(
+		`DELETE FROM oidc_login_states
+		 WHERE state_hash = $1 AND expires_at > NOW()
+		 RETURNING state_hash, provider, nonce, code_verifier, link_user_id, expires_at`,
+		stateHash,
+	).Scan(&state.StateHash, &state.Provider, &state.Nonce, &state.CodeVerifier, &linkUserID, &state.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return oidcLoginState{}, errOIDCStateInvalid
+		}
+		return oidcLoginState{}, err
+	}
+
+	state.LinkUserID = linkUserID.String
+	return state, nil
+}
+
+var findUserByIdentity = func(provider string, subject string) (user, error) {
+	var dbUser user
+	err := db.QueryRow(
+		`SELECT u.id, u.username
+		 FROM user_identities i
+		 JOIN users u ON u.id = i.user_id
+		 WHERE i.provider = $1 AND i.subject = $2`,
+		provider, subject,
+	).Scan(&dbUser.ID, &dbUser.Username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return user{}, errOIDCIdentityUnknown
+		}
+		return user{}, err
+	}
+	return dbUser, nil
+}
+
+var linkIdentity = func(provider string, subject string, userID string, email string) (user, error) {
+	var dbUser user
+	err := db.QueryRow(
+		`WITH linked AS (
+		   INSERT INTO user_identities (provider, subject, user_id, email)
+		   VALUES ($1, $2, $3, $4)
+		   RETURNING user_id
+		 )
+		 SELECT u.id, u.username FROM users u JOIN linked l ON l.user_id = u.id`,
+		provider, subject, userID, email,
+	).Scan(&dbUser.ID, &dbUser.Username)
+	if err != nil {
+		return user{}, err
+	}
+	return dbUser, nil
+}
+
+// パスワードログインできないユーザーを作成し、ID プロバイダのアカウントと紐付ける
+var provisionOIDCUser = func(username string, provider string, subject string, email string) (user, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		candidate := username
+		if attempt > 0 {
+			suffix, err := generateSessionToken()
+			if err != nil {
+				return user{}, err
+			}
+			candidate = fmt.Sprintf("%s-%s", truncateUsername(username, 27), suffix[:4])
+		}
+
+		created, err := insertOIDCUser(candidate, provider, subject, email)
+		if errors.Is(err, errUsernameTaken) {
+			continue
+		}
+		return created, err
+	}
+	return user{}, errUsernameTaken
+}
+
+func insertOIDCUser(username string, provider string, subject string, email string) (user, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return user{}, err
+	}
+	defer tx.Rollback()
+
+	var created user
+	err = tx.QueryRow(
+		`INSERT INTO users (username, password_hash, email)
+		 VALUES ($1, '!', NULLIF($2, ''))
+		 RETURNING id, username`,
+		username, email,
+	).Scan(&created.ID, &created.Username)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return user{}, errUsernameTaken
+		}
+		return user{}, err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO user_identities (provider, subject, user_id, email)
+		 VALUES ($1, $2, $3, $4)`,
+		provider, subject, created.ID, email,
+	); err != nil {
+		return user{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return user{}, err
+	}
+	return created, nil
+}
+
+func loadOIDCProvidersFromEnv() (map[string]*oidcProvider, error) {
+	providers := map[string]*oidcProvider{}
+
+	names := strings.Split(os.Getenv("OIDC_PROVIDERS"), ",")
+	for _, name := range names {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := &oidcProvider{
+			Name:          name,
+			Issuer:        strings.TrimRight(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:      os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:  os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:   os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:        []string{"openid", "email", "profile"},
+			AutoProvision: os.Getenv(prefix+"AUTO_PROVISION") == "true",
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			provider.Scopes = strings.Fields(scopes)
+		}
+
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			return nil, fmt.Errorf("%sISSUER, %sCLIENT_ID and %sREDIRECT_URL are required", prefix, prefix, prefix)
+		}
+
+		providers[name] = provider
+	}
+
+	return providers, nil
+}
+
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := fetchJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc discovery document: %w", err)
+	}
+
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery issuer mismatch: %s", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document is incomplete")
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// 未知の kid が来たときは鍵のローテーションとみなして JWKS を取り直す
+func (p *oidcProvider) findKey(ctx context.Context, header jwtHeader) (jsonWebKey, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return jsonWebKey{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, err := p.keys.find(header); err == nil {
+		return key, nil
+	}
+
+	var keys jsonWebKeySet
+	if err := fetchJSON(ctx, discovery.JWKSURI, &keys); err != nil {
+		return jsonWebKey{}, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	p.keys = keys
+
+	return p.keys.find(header)
+}
+
+func (p *oidcProvider) exchangeCode(ctx context.Context, code string, codeVerifier string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var token oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBodyBytes)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response does not contain id_token")
+	}
+	return token.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, rawIDToken string, nonce string, now time.Time) (oidcIDTokenClaims, error) {
+	header, claimsJSON, signingInput, signature, err := parseJWT(rawIDToken)
+	if err != nil {
+		return oidcIDTokenClaims{}, err
+	}
+
+	key, err := p.findKey(ctx, header)
+	if err != nil {
+		return oidcIDTokenClaims{}, err
+	}
+
+	if err := verifyJWTSignature(header, signingInput, signature, key); err != nil {
+		return oidcIDTokenClaims{}, err
+	}
+
+	var claims oidcIDTokenClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return oidcIDTokenClaims{}, errMalformedJWT
+	}
+
+	if strings.TrimRight(claims.Issuer, "/") != p.Issuer {
+		return oidcIDTokenClaims{}, errors.New("id token issuer mismatch")
+	}
+
+	audiences, err := parseAudience(claims.Audience)
+	if err != nil {
+		return oidcIDTokenClaims{}, err
+	}
+	if !slices.Contains(audiences, p.ClientID) {
+		return oidcIDTokenClaims{}, errors.New("id token audience mismatch")
+	}
+	if len(audiences) > 1 && claims.AuthorizedParty != p.ClientID {
+		return oidcIDTokenClaims{}, errors.New("id token authorized party mismatch")
+	}
+
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)) {
+		return oidcIDTokenClaims{}, errors.New("id token is expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return oidcIDTokenClaims{}, errors.New("id token is issued in the future")
+	}
+
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return oidcIDTokenClaims{}, errors.New("id token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return oidcIDTokenClaims{}, errors.New("id token subject is missing")
+	}
+
+	return claims, nil
+}
+
+func oidcProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	writeJSON(w, http.StatusOK, oidcProvidersResponse{Providers: names})
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "provider not found")
+		return
+	}
+
+	discovery, err := provider.getDiscovery(r.Context())
+	if err != nil {
+		log.Printf("oidc discovery failed for %s: %v", provider.Name, err)
+		writeError(w, http.StatusBadGateway, "identity provider is unavailable")
+		return
+	}
+
+	state, err := generateSessionToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	nonce, err := generateSessionToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	codeVerifier, err := generateSessionToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	// ログイン済みで開始した場合は既存アカウントへの紐付けとして扱う
+	linkUserID := ""
+	if token, err := readSessionToken(r); err == nil {
+		if userID, err := findActiveSessionUserID(token); err == nil {
+			linkUserID = userID
+		}
+	}
+
+	if err := insertOIDCLoginState(oidcLoginState{
+		StateHash:    hashSessionToken(state),
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(oidcLoginStateTTL),
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	setOIDCStateCookie(w, provider, state)
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", provider.RedirectURL)
+	query.Set("scope", strings.Join(provider.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	authorizationURL := discovery.AuthorizationEndpoint
+	if strings.Contains(authorizationURL, "?") {
+		authorizationURL += "&" + query.Encode()
+	} else {
+		authorizationURL += "?" + query.Encode()
+	}
+
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "provider not found")
+		return
+	}
+
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		writeError(w, http.StatusUnauthorized, "authorization was denied by the identity provider")
+		return
+	}
+
+	code := query.Get("code")
+	state := query.Get("state")
+	if code == "" || state == "" {
+		writeError(w, http.StatusBadRequest, "code and state are required")
+		return
+	}
+
+	// ログインを始めたブラウザ以外から state を持ち込まれても受け付けない
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		writeError(w, http.StatusBadRequest, "invalid or expired state")
+		return
+	}
+	// セッション Cookie は SameSite=Strict なので IdP からのリダイレクトでは送られない。
+	// 紐付けでは今のセッションを確かめるため、同一サイトの遷移として読み込み直させる
+	if _, err := readSessionToken(r); err != nil && cookieSameSite() == http.SameSiteStrictMode && query.Get(oidcResumeParam) == "" {
+		resumeOIDCCallback(w, query)
+		return
+	}
+	clearOIDCStateCookie(w, provider)
+
+	loginState, err := consumeOIDCLoginState(hashSessionToken(state))
+	if err != nil {
+		if errors.Is(err, errOIDCStateInvalid) {
+			writeError(w, http.StatusBadRequest, "invalid or expired state")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if loginState.Provider != provider.Name {
+		writeError(w, http.StatusBadRequest, "invalid or expired state")
+		return
+	}
+	if loginState.LinkUserID != "" {
+		sessionUserID := ""
+		if token, err := readSessionToken(r); err == nil {
+			sessionUserID, _ = findActiveSessionUserID(token)
+		}
+		if sessionUserID != loginState.LinkUserID {
+			writeError(w, http.StatusForbidden, "sign in to the account being linked and try again")
+			return
+		}
+	}
+
+	rawIDToken, err := provider.exchangeCode(r.Context(), code, loginState.CodeVerifier)
+	if err != nil {
+		log.Printf("oidc code exchange failed for %s: %v", provider.Name, err)
+		writeError(w, http.StatusBadGateway, "failed to exchange authorization code")
+		return
+	}
+
+	claims, err := provider.verifyIDToken(r.Context(), rawIDToken, loginState.Nonce, time.Now())
+	if err != nil {
+		log.Printf("oidc id token verification failed for %s: %v", provider.Name, err)
+		writeError(w, http.StatusUnauthorized, "invalid id token")
+		return
+	}
+
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	dbUser, err := resolveOIDCUser(provider, loginState, claims, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCIdentityUnknown):
+			writeError(w, http.StatusForbidden, "no account is linked to this identity")
+		case errors.Is(err, errUsernameTaken):
+			writeError(w, http.StatusConflict, "could not allocate a username")
+		default:
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}
+		return
+	}
+
+	if err := startSession(w, dbUser.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+
+	recordAudit(r, dbUser.ID, auditEventLogin, auditOutcomeSuccess, map[string]string{
+		"method":   "oidc",
+		"provider": provider.Name,
+	})
+	http.Redirect(w, r, oidcPostLoginURL(), http.StatusFound)
+}
+
+// IdP からのリダイレクト (別サイトからの遷移) でも送られるよう SameSite=Lax にする
+func setOIDCStateCookie(w http.ResponseWriter, provider *oidcProvider, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     oidcCallbackPath(provider),
+		HttpOnly: true,
+		Secure:   isProduction() || isCrossOrigin(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginStateTTL / time.Second),
+	})
+}
+
+func clearOIDCStateCookie(w http.ResponseWriter, provider *oidcProvider) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     oidcCallbackPath(provider),
+		HttpOnly: true,
+		Secure:   isProduction() || isCrossOrigin(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+		Expires:  time.Unix(0, 0),
+	})
+}
+
+// ブラウザがコールバックに来るときのパス (RedirectURL のもの)
+func oidcCallbackPath(provider *oidcProvider) string {
+	if parsed, err := url.Parse(provider.RedirectURL); err == nil && parsed.Path != "" {
+		return parsed.Path
+	}
+	return "/api/auth/oidc/" + provider.Name + "/callback"
+}
+
+// 同じ URL を自サイトのページから開き直させる。code を Referer に載せない
+func resumeOIDCCallback(w http.ResponseWriter, query url.Values) {
+	query.Set(oidcResumeParam, "1")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<!DOCTYPE html><meta http-equiv="refresh" content="0;url=%s">`, html.EscapeString("?"+query.Encode()))
+}
+
+func resolveOIDCUser(provider *oidcProvider, loginState oidcLoginState, claims oidcIDTokenClaims, email string) (user, error) {
+	dbUser, err := findUserByIdentity(provider.Name, claims.Subject)
+	if err == nil {
+		return dbUser, nil
+	}
+	if !errors.Is(err, errOIDCIdentityUnknown) {
+		return user{}, err
+	}
+
+	if loginState.LinkUserID != "" {
+		return linkIdentity(provider.Name, claims.Subject, loginState.LinkUserID, email)
+	}
+
+	if !provider.AutoProvision {
+		return user{}, errOIDCIdentityUnknown
+	}
+
+	return provisionOIDCUser(oidcUsername(claims), provider.Name, claims.Subject, email)
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+func oidcUsername(claims oidcIDTokenClaims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" && claims.Email != "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	candidate = invalidUsernameChars.ReplaceAllString(candidate, "")
+	candidate = strings.TrimLeft(candidate, "_.-")
+	candidate = truncateUsername(candidate, 32)
+	if validateUsername(candidate) != nil {
+		return "user"
+	}
+	return candidate
+}
+
+func truncateUsername(username string, max int) string {
+	if len(username) > max {
+		return username[:max]
+	}
+	return username
+}
+
+func oidcPostLoginURL() string {
+	if target := os.Getenv("OIDC_POST_LOGIN_URL"); target != "" {
+		return target
+	}
+	if origin := os.Getenv("CORS_ORIGIN"); origin != "" {
+		return origin
+	}
+	return "/"
+}
+
+func parseAudience(raw json.RawMessage) ([]string, error) {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(raw, &multiple); err != nil {
+		return nil, errors.New("id token audience is invalid")
+	}
+	return multiple, nil
+}
+
+func fetchJSON(ctx context.Context, target string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, target)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxBodyBytes)).Decode(out)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// テスト用の最小限の ID プロバイダ
+type fakeIdentityProvider struct {
+	t          *testing.T
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	clientID   string
+	challenges map[string]string
+	nonces     map[string]string
+	subject    string
+	issuer     string
+}
+
+func newFakeIdentityProvider(t *testing.T, clientID string) *fakeIdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+
+	idp := &fakeIdentityProvider{
+		t:          t,
+		key:        key,
+		clientID:   clientID,
+		challenges: map[string]string{},
+		nonces:     map[string]string{},
+		subject:    "idp-user-1",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jsonWebKeySet{Keys: []jsonWebKey{{
+			KeyType: "RSA",
+			KeyID:   "key-1",
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+
+		code := r.PostForm.Get("code")
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if idp.challenges[code] != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			http.Error(w, "invalid code_verifier", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, oidcTokenResponse{
+			IDToken:   idp.signIDToken(idp.nonces[code]),
+			TokenType: "Bearer",
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdentityProvider) signIDToken(nonce string) string {
+	header, _ := json.Marshal(jwtHeader{Algorithm: "RS256", KeyID: "key-1", Type: "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":                idp.issuer,
+		"sub":                idp.subject,
+		"aud":                idp.clientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              nonce,
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatalf("failed to sign id token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize エンドポイントへのリダイレクト URL を受け取り、ユーザーが同意した体で code を払い出す
+func (idp *fakeIdentityProvider) authorize(authorizationURL string) (string, string) {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		idp.t.Fatalf("failed to parse authorization url: %v", err)
+	}
+
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		idp.t.Fatalf("expected PKCE S256, got %q", query.Get("code_challenge_method"))
+	}
+
+	code := "code-" + query.Get("state")[:8]
+	idp.challenges[code] = query.Get("code_challenge")
+	idp.nonces[code] = query.Get("nonce")
+	return code, query.Get("state")
+}
+
+func stubOIDCStorage(t *testing.T, provider *oidcProvider) *[]string {
+	t.Helper()
+
+	originalProviders := oidcProviders
+	originalInsertState := insertOIDCLoginState
+	originalConsumeState := consumeOIDCLoginState
+	originalFindUser := findUserByIdentity
+	originalProvision := provisionOIDCUser
+	originalInsertSession := insertSession
+	t.Cleanup(func() {
+		oidcProviders = originalProviders
+		insertOIDCLoginState = originalInsertState
+		consumeOIDCLoginState = originalConsumeState
+		findUserByIdentity = originalFindUser
+		provisionOIDCUser = originalProvision
+		insertSession = originalInsertSession
+	})
+
+	oidcProviders = map[string]*oidcProvider{provider.Name: provider}
+
+	states := map[string]oidcLoginState{}
+	insertOIDCLoginState = func(state oidcLoginState) error {
+		states[state.StateHash] = state
+		return nil
+	}
+	consumeOIDCLoginState = func(stateHash string) (oidcLoginState, error) {
+		state, ok := states[stateHash]
+		if !ok {
+			return oidcLoginState{}, errOIDCStateInvalid
+		}
+		delete(states, stateHash)
+		return state, nil
+	}
+	findUserByIdentity = func(provider string, subject string) (user, error) {
+		return user{}, errOIDCIdentityUnknown
+	}
+	provisioned := &[]string{}
+	provisionOIDCUser = func(username string, provider string, subject string, email string) (user, error) {
+		*provisioned = append(*provisioned, username+"|"+provider+"|"+subject+"|"+email)
+		return user{ID: "user-1", Username: username}, nil
+	}
+	insertSession = func(tokenHash string, userID string, expiresAt time.Time) error {
+		return nil
+	}
+
+	return provisioned
+}
+
+func newOIDCTestRouter() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/api/auth/oidc/{provider}/login", oidcLoginHandler)
+	router.Get("/api/auth/oidc/{provider}/callback", oidcCallbackHandler)
+	return router
+}
+
+// ログインで受け取った Cookie を付けてコールバックを呼ぶ
+func newOIDCCallbackRequest(loginRecorder *httptest.ResponseRecorder, code string, state string, resumed bool) *http.Request {
+	target := "/api/auth/oidc/corp/callback?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(state)
+	if resumed {
+		target += "&" + oidcResumeParam + "=1"
+	}
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range loginRecorder.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+func TestOIDCLogin_ProvisionsUserAndIssuesSessionAgainstLocalIdP(t *testing.T) {
+	idp := newFakeIdentityProvider(t, "futto-client")
+	provider := &oidcProvider{
+		Name:          "corp",
+		Issuer:        idp.issuer,
+		ClientID:      "futto-client",
+		RedirectURL:   "http://localhost:8080/api/auth/oidc/corp/callback",
+		Scopes:        []string{"openid", "email"},
+		AutoProvision: true,
+	}
+	provisioned := stubOIDCStorage(t, provider)
+	t.Setenv("OIDC_POST_LOGIN_URL", "http://localhost:3000/")
+	router := newOIDCTestRouter()
+
+	loginRecorder := httptest.NewRecorder()
+	router.ServeHTTP(loginRecorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/corp/login", nil))
+	if loginRecorder.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d", http.StatusFound, loginRecorder.Code)
+	}
+
+	code, state := idp.authorize(loginRecorder.Header().Get("Location"))
+
+	stateCookies := loginRecorder.Result().Cookies()
+	if len(stateCookies) != 1 || stateCookies[0].Name != oidcStateCookieName || stateCookies[0].Value != state ||
+		!stateCookies[0].HttpOnly || stateCookies[0].SameSite != http.SameSiteLaxMode || stateCookies[0].Path != "/api/auth/oidc/corp/callback" {
+		t.Fatalf("expected state cookie to be set, got %+v", stateCookies)
+	}
+
+	// IdP からのリダイレクトではセッション Cookie が送られないので、自サイトから開き直させる
+	bounceRecorder := httptest.NewRecorder()
+	router.ServeHTTP(bounceRecorder, newOIDCCallbackRequest(loginRecorder, code, state, false))
+	if bounceRecorder.Code != http.StatusOK || !strings.Contains(bounceRecorder.Body.String(), "resume=1") {
+		t.Fatalf("expected callback to be reloaded from the same site, got %d: %s", bounceRecorder.Code, bounceRecorder.Body.String())
+	}
+
+	callbackRecorder := httptest.NewRecorder()
+	router.ServeHTTP(callbackRecorder, newOIDCCallbackRequest(loginRecorder, code, state, true))
+
+	if callbackRecorder.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusFound, callbackRecorder.Code, callbackRecorder.Body.String())
+	}
+
+	if location := callbackRecorder.Header().Get("Location"); location != "http://localhost:3000/" {
+		t.Fatalf("unexpected redirect: %s", location)
+	}
+
+	if len(*provisioned) != 1 || (*provisioned)[0] != "alice|corp|idp-user-1|alice@example.com" {
+		t.Fatalf("unexpected provisioning: %v", *provisioned)
+	}
+
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range callbackRecorder.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	if cookies[sessionCookieName] == nil || cookies[sessionCookieName].Value == "" {
+		t.Fatalf("expected session cookie to be set, got %v", cookies)
+	}
+	if cookies[oidcStateCookieName] == nil || cookies[oidcStateCookieName].MaxAge >= 0 {
+		t.Fatalf("expected state cookie to be cleared, got %v", cookies)
+	}
+
+	replayRecorder := httptest.NewRecorder()
+	router.ServeHTTP(replayRecorder, newOIDCCallbackRequest(loginRecorder, code, state, true))
+	if replayRecorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected replayed state to be rejected, got %d", replayRecorder.Code)
+	}
+}
+
+func TestOIDCCallback_RejectsUnlinkedIdentityWithoutAutoProvision(t *testing.T) {
+	idp := newFakeIdentityProvider(t, "futto-client")
+	provider := &oidcProvider{
+		Name:        "corp",
+		Issuer:      idp.issuer,
+		ClientID:    "futto-client",
+		RedirectURL: "http://localhost:8080/api/auth/oidc/corp/callback",
+		Scopes:      []string{"openid"},
+	}
+	provisioned := stubOIDCStorage(t, provider)
+	router := newOIDCTestRouter()
+
+	loginRecorder := httptest.NewRecorder()
+	router.ServeHTTP(loginRecorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/corp/login", nil))
+	code, state := idp.authorize(loginRecorder.Header().Get("Location"))
+
+	callbackRecorder := httptest.NewRecorder()
+	router.ServeHTTP(callbackRecorder, newOIDCCallbackRequest(loginRecorder, code, state, true))
+
+	if callbackRecorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, callbackRecorder.Code)
+	}
+
+	if len(*provisioned) != 0 {
+		t.Fatalf("expected no user to be provisioned, got %v", *provisioned)
+	}
+}
+
+func TestOIDCCallback_RejectsStateNotBoundToBrowser(t *testing.T) {
+	idp := newFakeIdentityProvider(t, "futto-client")
+	provider := &oidcProvider{
+		Name:          "corp",
+		Issuer:        idp.issuer,
+		ClientID:      "futto-client",
+		RedirectURL:   "http://localhost:8080/api/auth/oidc/corp/callback",
+		Scopes:        []string{"openid"},
+		AutoProvision: true,
+	}
+	provisioned := stubOIDCStorage(t, provider)
+	router := newOIDCTestRouter()
+
+	loginRecorder := httptest.NewRecorder()
+	router.ServeHTTP(loginRecorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/corp/login", nil))
+	code, state := idp.authorize(loginRecorder.Header().Get("Location"))
+
+	// 攻撃者が自分で始めたログインの code と state を、被害者のブラウザに踏ませる
+	otherRecorder := httptest.NewRecorder()
+	router.ServeHTTP(otherRecorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/corp/login", nil))
+
+	target := "/api/auth/oidc/corp/callback?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(state) + "&resume=1"
+	missing := httptest.NewRequest(http.MethodGet, target, nil)
+	mismatched := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range otherRecorder.Result().Cookies() {
+		mismatched.AddCookie(cookie)
+	}
+
+	for name, request := range map[string]*http.Request{"missing": missing, "mismatched": mismatched} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s cookie: expected status %d, got %d", name, http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if len(*provisioned) != 0 {
+		t.Fatalf("expected no user to be provisioned, got %v", *provisioned)
+	}
+
+	// state は消費されていないので、本人のブラウザからは続けられる
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, newOIDCCallbackRequest(loginRecorder, code, state, true))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusFound, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOIDCCallback_LinkRequiresSameSessionUser(t *testing.T) {
+	idp := newFakeIdentityProvider(t, "futto-client")
+	provider := &oidcProvider{
+		Name:        "corp",
+		Issuer:      idp.issuer,
+		ClientID:    "futto-client",
+		RedirectURL: "http://localhost:8080/api/auth/oidc/corp/callback",
+		Scopes:      []string{"openid"},
+	}
+	stubOIDCStorage(t, provider)
+	originalFindSession := findActiveSessionUserID
+	originalLink := linkIdentity
+	t.Cleanup(func() {
+		findActiveSessionUserID = originalFindSession
+		linkIdentity = originalLink
+	})
+	findActiveSessionUserID = func(token string) (string, error) {
+		return strings.TrimSuffix(token, "-token"), nil
+	}
+	linked := make([]string, 0)
+	linkIdentity = func(provider string, subject string, userID string, email string) (user, error) {
+		linked = append(linked, userID)
+		return user{ID: userID, Username: userID}, nil
+	}
+	router := newOIDCTestRouter()
+
+	for _, tc := range []struct {
+		callbackSession string
+		status          int
+	}{
+		{"", http.StatusForbidden},
+		{"mallory-token", http.StatusForbidden},
+		{"alice-token", http.StatusFound},
+	} {
+		loginRequest := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/corp/login", nil)
+		loginRequest.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "alice-token"})
+		loginRecorder := httptest.NewRecorder()
+		router.ServeHTTP(loginRecorder, loginRequest)
+		code, state := idp.authorize(loginRecorder.Header().Get("Location"))
+
+		request := newOIDCCallbackRequest(loginRecorder, code, state, true)
+		if tc.callbackSession != "" {
+			request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tc.callbackSession})
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != tc.status {
+			t.Fatalf("session %q: expected status %d, got %d: %s", tc.callbackSession, tc.status, recorder.Code, recorder.Body.String())
+		}
+	}
+	if len(linked) != 1 || linked[0] != "alice" {
+		t.Fatalf("expected identity to be linked only to alice, got %v", linked)
+	}
+}
+
+func TestOIDCProviderVerifyIDToken_RejectsWrongNonceAndAudience(t *testing.T) {
+	idp := newFakeIdentityProvider(t, "futto-client")
+	provider := &oidcProvider{Name: "corp", Issuer: idp.issuer, ClientID: "futto-client"}
+
+	token := idp.signIDToken("nonce-1")
+	if _, err := provider.verifyIDToken(t.Context(), token, "nonce-1", time.Now()); err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+
+	if _, err := provider.verifyIDToken(t.Context(), token, "nonce-2", time.Now()); err == nil {
+		t.Fatalf("expected nonce mismatch to be rejected")
+	}
+
+	otherClient := &oidcProvider{Name: "corp", Issuer: idp.issuer, ClientID: "other-client"}
+	if _, err := otherClient.verifyIDToken(t.Context(), token, "nonce-1", time.Now()); err == nil {
+		t.Fatalf("expected audience mismatch to be rejected")
+	}
+
+	if _, err := provider.verifyIDToken(t.Context(), token, "nonce-1", time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatalf("expected expired token to be rejected")
+	}
+
+	tampered := token[:len(token)-4] + "AAAA"
+	if _, err := provider.verifyIDToken(t.Context(), tampered, "nonce-1", time.Now()); err == nil {
+		t.Fatalf("expected tampered signature to be rejected")
+	}
+}
+
+func TestOIDCUsername_DerivesValidUsername(t *testing.T) {
+	cases := map[string]oidcIDTokenClaims{
+		"alice":      {PreferredUsername: "alice"},
+		"bob.smith":  {Email: "bob.smith@example.com"},
+		"taro_yamad": {PreferredUsername: "__taro_yamad!!"},
+		"user":       {PreferredUsername: "山田"},
+	}
+
+	for expected, claims := range cases {
+		if got := oidcUsername(claims); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"futto-note/backend/passwordhash"
+)
+
+const (
+	minPasswordLength        = 8
+	maxPasswordLength        = 1024
+	passwordResetTokenTTL    = 30 * time.Minute
+	passwordResetMailTimeout = 30 * time.Second
+)
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type passwordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type passwordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+var errInvalidResetToken = errors.New("password reset token is invalid or expired")
+
+var passwordHasher = passwordhash.New()
+
+var hashPassword = func(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+var verifyPassword = func(hash string, password string) (bool, bool) {
+	ok, needsRehash, err := passwordHasher.Verify(hash, password)
+	if err != nil {
+		log.Printf("failed to verify password hash: %v", err)
+		return false, false
+	}
+	return ok, needsRehash
+}
+
+var updatePasswordHash = func(userID string, passwordHash string) error {
+	_, err := db.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2",
+		passwordHash, userID,
+	)
+	return err
+}
+
+func rehashPassword(userID string, password string) {
+	newHash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("failed to rehash password: %v", err)
+		return
+	}
+
+	if err := updatePasswordHash(userID, newHash); err != nil {
+		log.Printf("failed to store rehashed password: %v", err)
+	}
+}
+
+var findPasswordHashByUserID = func(userID string) (string, error) {
+	var passwordHash string
+	err := db.QueryRow(
+		"SELECT password_hash FROM users WHERE id = $1",
+		userID,
+	).Scan(&passwordHash)
+	if err != nil {
+		return "", err
+	}
+	return passwordHash, nil
+}
+
+var changeUserPassword = func(userID string, passwordHash string, keepSessionTokenHash string) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(
+			"UPDATE users SET password_hash = $1 WHERE id = $2",
+			passwordHash, userID,
+		); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			"DELETE FROM sessions WHERE user_id = $1 AND token_hash <> $2",
+			userID, keepSessionTokenHash,
+		)
+		return err
+	})
+}
+
+var findUserEmailByUsername = func(username string) (string, string, error) {
+	var userID string
+	var email sql.NullString
+	err := db.QueryRow(
+		"SELECT id, email FROM users WHERE username = $1",
+		username,
+	).Scan(&userID, &email)
+	if err != nil {
+		return "", "", err
+	}
+	return userID, email.String, nil
+}
+
+var insertPasswordResetToken = func(userID string, tokenHash string, expiresAt time.Time) error {
+	_, err := db.Exec(
+		`INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		 VALUES ($1, $2, $3)`,
+		tokenHash, userID, expiresAt,
+	)
+	return err
+}
+
+// トークンの消費・パスワード更新・全セッション破棄を 1 トランザクションで行う
+var resetPasswordWithToken = func(tokenHash string, passwordHash string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(
+		`UPDATE password_reset_tokens
+		 SET used_at = NOW()
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		tokenHash,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errInvalidResetToken
+		}
+		return "", err
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2",
+		passwordHash, userID,
+	); err != nil {
+		return "", err
+	}
+
+	if err := setScope(tx, currentUserIDSetting, userID); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec(
+		"DELETE FROM password_reset_tokens WHERE user_id = $1 AND token_hash <> $2",
+		userID, tokenHash,
+	); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func validateNewPassword(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	token, err := readSessionToken(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req changePasswordRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		writeError(w, http.StatusBadRequest, "current_password and new_password are required")
+		return
+	}
+
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	currentHash, err := findPasswordHashByUserID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if ok, _ := verifyPassword(currentHash, req.CurrentPassword); !ok {
+		recordAudit(r, userID, auditEventPasswordChange, auditOutcomeFailure, nil)
+		writeError(w, http.StatusForbidden, "current password is incorrect")
+		return
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if err := changeUserPassword(userID, newHash, hashSessionToken(token)); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	recordAudit(r, userID, auditEventPasswordChange, auditOutcomeSuccess, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ユーザーの存在有無を推測されないよう、結果にかかわらず 202 を返す
+func requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	username := strings.TrimSpace(req.Username)
+	if username == "" {
+		writeError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	startPasswordReset(username)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// 応答を返してから処理する。実在するユーザーだけトークンの保存とメール送信を行うので、
+// 同期的に行うと応答時間からユーザー名の有無が分かってしまう
+var startPasswordReset = func(username string) {
+	go sendPasswordReset(username)
+}
+
+func sendPasswordReset(username string) {
+	userID, email, err := findUserEmailByUsername(username)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("failed to look up user for password reset: %v", err)
+		}
+		return
+	}
+	if email == "" {
+		return
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		log.Printf("failed to generate password reset token: %v", err)
+		return
+	}
+
+	if err := insertPasswordResetToken(userID, hashSessionToken(token), time.Now().Add(passwordResetTokenTTL)); err != nil {
+		log.Printf("failed to save password reset token: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), passwordResetMailTimeout)
+	defer cancel()
+	if err := mailer.Send(ctx, passwordResetMail(email, token)); err != nil {
+		log.Printf("failed to send password reset mail: %v", err)
+	}
+}
+
+func confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetConfirmRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	token := strings.TrimSpace(req.Token)
+	if token == "" || req.NewPassword == "" {
+		writeError(w, http.StatusBadRequest, "token and new_password are required")
+		return
+	}
+
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	userID, err := resetPasswordWithToken(hashSessionToken(token), newHash)
+	if err != nil {
+		if errors.Is(err, errInvalidResetToken) {
+			recordAudit(r, "", auditEventPasswordReset, auditOutcomeFailure, nil)
+			writeError(w, http.StatusBadRequest, "invalid or expired token")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	recordAudit(r, userID, auditEventPasswordReset, auditOutcomeSuccess, nil)
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func passwordResetMail(to string, token string) mailMessage {
+	return mailMessage{
+		To:      to,
+		Subject: "パスワード再設定のご案内",
+		Body: fmt.Sprintf(
+			"以下のリンクから %d 分以内にパスワードを再設定してください。\n\n%s\n\nこのメールに心当たりがない場合は破棄してください。\n",
+			int(passwordResetTokenTTL.Minutes()),
+			passwordResetURL(token),
+		),
+	}
+}
+
+func passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = strings.TrimRight(os.Getenv("CORS_ORIGIN"), "/") + "/reset-password"
+	}
+	return base + "?token=" + token
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingMailSender struct {
+	messages []mailMessage
+}
+
+func (s *recordingMailSender) Send(ctx context.Context, message mailMessage) error {
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestChangePasswordHandler_RejectsIncorrectCurrentPassword(t *testing.T) {
+	originalFind := findPasswordHashByUserID
+	originalVerify := verifyPassword
+	originalChange := changeUserPassword
+	t.Cleanup(func() {
+		findPasswordHashByUserID = originalFind
+		verifyPassword = originalVerify
+		changeUserPassword = originalChange
+	})
+
+	findPasswordHashByUserID = func(userID string) (string, error) {
+		return "stored-hash", nil
+	}
+	verifyPassword = func(hash string, password string) (bool, bool) {
+		return password == "correct-password", false
+	}
+	wasCalled := false
+	changeUserPassword = func(userID string, passwordHash string, keepSessionTokenHash string) error {
+		wasCalled = true
+		return nil
+	}
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/me/password",
+		strings.NewReader(`{"current_password":"wrong-password","new_password":"new-password"}`),
+	)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-1"})
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	changePasswordHandler(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	if wasCalled {
+		t.Fatalf("changeUserPassword should not be called for incorrect current password")
+	}
+}
+
+func TestChangePasswordHandler_KeepsCurrentSessionAndRevokesOthers(t *testing.T) {
+	originalFind := findPasswordHashByUserID
+	originalVerify := verifyPassword
+	originalHash := hashPassword
+	originalChange := changeUserPassword
+	t.Cleanup(func() {
+		findPasswordHashByUserID = originalFind
+		verifyPassword = originalVerify
+		hashPassword = originalHash
+		changeUserPassword = originalChange
+	})
+
+	findPasswordHashByUserID = func(userID string) (string, error) {
+		return "stored-hash", nil
+	}
+	verifyPassword = func(hash string, password string) (bool, bool) {
+		return true, false
+	}
+	hashPassword = func(password string) (string, error) {
+		return "hashed:" + password, nil
+	}
+	gotUserID := ""
+	gotHash := ""
+	gotKeep := ""
+	changeUserPassword = func(userID string, passwordHash string, keepSessionTokenHash string) error {
+		gotUserID = userID
+		gotHash = passwordHash
+		gotKeep = keepSessionTokenHash
+		return nil
+	}
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/me/password",
+		strings.NewReader(`{"current_password":"old-password","new_password":"new-password"}`),
+	)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-1"})
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	changePasswordHandler(recorder, request)
+
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	if gotUserID != "user-1" || gotHash != "hashed:new-password" {
+		t.Fatalf("unexpected arguments: user_id=%s hash=%s", gotUserID, gotHash)
+	}
+
+	if gotKeep != hashSessionToken("session-1") {
+		t.Fatalf("expected current session to be kept, got %s", gotKeep)
+	}
+}
+
+func TestChangePasswordHandler_RejectsShortPassword(t *testing.T) {
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/me/password",
+		strings.NewReader(`{"current_password":"old-password","new_password":"short"}`),
+	)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-1"})
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	changePasswordHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"password must be at least 8 characters\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+// ハンドラが応答した後に行う処理を、テストではその場で実行する
+func runPasswordResetInline(t *testing.T) {
+	t.Helper()
+
+	original := startPasswordReset
+	t.Cleanup(func() {
+		startPasswordReset = original
+	})
+	startPasswordReset = sendPasswordReset
+}
+
+func TestRequestPasswordResetHandler_RespondsBeforeLookingUpUser(t *testing.T) {
+	originalStart := startPasswordReset
+	originalFind := findUserEmailByUsername
+	t.Cleanup(func() {
+		startPasswordReset = originalStart
+		findUserEmailByUsername = originalFind
+	})
+
+	started := make([]string, 0)
+	startPasswordReset = func(username string) {
+		started = append(started, username)
+	}
+	findUserEmailByUsername = func(username string) (string, string, error) {
+		t.Fatalf("user lookup must not run before the response")
+		return "", "", nil
+	}
+
+	for _, username := range []string{"alice", "nobody"} {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/api/password-reset",
+			strings.NewReader(`{"username":"`+username+`"}`),
+		)
+		recorder := httptest.NewRecorder()
+		requestPasswordResetHandler(recorder, request)
+
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d", http.StatusAccepted, recorder.Code)
+		}
+	}
+	if len(started) != 2 || started[0] != "alice" || started[1] != "nobody" {
+		t.Fatalf("expected a reset to be started for each request, got %v", started)
+	}
+}
+
+func TestRequestPasswordResetHandler_AcceptsUnknownUserWithoutSendingMail(t *testing.T) {
+	runPasswordResetInline(t)
+	originalFind := findUserEmailByUsername
+	originalMailer := mailer
+	t.Cleanup(func() {
+		findUserEmailByUsername = originalFind
+		mailer = originalMailer
+	})
+
+	findUserEmailByUsername = func(username string) (string, string, error) {
+		return "", "", sql.ErrNoRows
+	}
+	sender := &recordingMailSender{}
+	mailer = sender
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/password-reset",
+		strings.NewReader(`{"username":"nobody"}`),
+	)
+	recorder := httptest.NewRecorder()
+	requestPasswordResetHandler(recorder, request)
+
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, recorder.Code)
+	}
+
+	if len(sender.messages) != 0 {
+		t.Fatalf("expected no mail to be sent, got %d", len(sender.messages))
+	}
+}
+
+func TestRequestPasswordResetHandler_SendsSingleUseTokenByMail(t *testing.T) {
+	runPasswordResetInline(t)
+	originalFind := findUserEmailByUsername
+	originalInsert := insertPasswordResetToken
+	originalMailer := mailer
+	t.Cleanup(func() {
+		findUserEmailByUsername = originalFind
+		insertPasswordResetToken = originalInsert
+		mailer = originalMailer
+	})
+	t.Setenv("PASSWORD_RESET_URL", "https://note.example.com/reset")
+
+	findUserEmailByUsername = func(username string) (string, string, error) {
+		return "user-1", "alice@example.com", nil
+	}
+	gotTokenHash := ""
+	gotExpiresAt := time.Time{}
+	insertPasswordResetToken = func(userID string, tokenHash string, expiresAt time.Time) error {
+		gotTokenHash = tokenHash
+		gotExpiresAt = expiresAt
+		return nil
+	}
+	sender := &recordingMailSender{}
+	mailer = sender
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/password-reset",
+		strings.NewReader(`{"username":"alice"}`),
+	)
+	recorder := httptest.NewRecorder()
+	requestPasswordResetHandler(recorder, request)
+
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, recorder.Code)
+	}
+
+	if len(sender.messages) != 1 || sender.messages[0].To != "alice@example.com" {
+		t.Fatalf("expected one mail to alice@example.com, got %v", sender.messages)
+	}
+
+	_, token, found := strings.Cut(sender.messages[0].Body, "https://note.example.com/reset?token=")
+	if !found {
+		t.Fatalf("reset link not found in mail body: %s", sender.messages[0].Body)
+	}
+	token = strings.Fields(token)[0]
+
+	if gotTokenHash != hashSessionToken(token) {
+		t.Fatalf("expected stored token hash to match mailed token")
+	}
+
+	if time.Until(gotExpiresAt) > passwordResetTokenTTL {
+		t.Fatalf("unexpected expiry: %s", gotExpiresAt)
+	}
+}
+
+func TestConfirmPasswordResetHandler_RejectsInvalidToken(t *testing.T) {
+	originalReset := resetPasswordWithToken
+	t.Cleanup(func() {
+		resetPasswordWithToken = originalReset
+	})
+
+	resetPasswordWithToken = func(tokenHash string, passwordHash string) (string, error) {
+		return "", errInvalidResetToken
+	}
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/password-reset/confirm",
+		strings.NewReader(`{"token":"used-token","new_password":"new-password"}`),
+	)
+	recorder := httptest.NewRecorder()
+	confirmPasswordResetHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invalid or expired token\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestFileMailSender_WritesMessageToDirectory(t *testing.T) {
+	dir := t.TempDir()
+	sender := fileMailSender{dir: dir}
+
+	if err := sender.Send(context.Background(), mailMessage{To: "alice@example.com", Subject: "hello", Body: "body"}); err != nil {
+		t.Fatalf("failed to send mail: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(entries))
+	}
+}
+
+func TestNewMailSenderFromEnv_RequiresExplicitSenderInProduction(t *testing.T) {
+	t.Setenv("APP_ENV", "production")
+	for _, value := range []string{"", "log"} {
+		t.Setenv("MAIL_SENDER", value)
+		if _, err := newMailSenderFromEnv(); err == nil {
+			t.Fatalf("expected MAIL_SENDER=%q to be rejected in production", value)
+		}
+	}
+
+	t.Setenv("MAIL_SENDER", "file")
+	if _, err := newMailSenderFromEnv(); err != nil {
+		t.Fatalf("expected file sender to be allowed, got %v", err)
+	}
+
+	t.Setenv("APP_ENV", "")
+	t.Setenv("MAIL_SENDER", "")
+	if sender, err := newMailSenderFromEnv(); err != nil || sender != (logMailSender{}) {
+		t.Fatalf("expected log sender outside production, got %v, %v", sender, err)
+	}
+}
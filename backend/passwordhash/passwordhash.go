@@ -0,0 +1,327 @@
+// Package passwordhash はパスワードのハッシュ化と検証を行う。
+// サーバーとユーザー作成ツールで同じ設定を共有するため、main から切り出している。
+package passwordhash
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+
+	// ペッパーを使ったハッシュは "$pepper$<ID>" に続けて元の形式で保存する
+	pepperPrefix     = "$pepper$"
+	defaultPepperID  = "1"
+	pepperListSep    = ","
+	pepperIDValueSep = "="
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrInvalidHash      = errors.New("invalid password hash format")
+	ErrUnknownPepper    = errors.New("password hash uses an unknown pepper")
+	pepperIDPattern     = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+)
+
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Pepper を設定すると、ハッシュにその PepperID を記録する。ID が今のものと違うハッシュは
+// PreviousPeppers で検証し、再ハッシュが必要と返す (次回ログインで今のペッパーへ移行する)。
+// ペッパーを外すときも、古い値を PreviousPeppers に残しておくこと
+type Hasher struct {
+	Algorithm       string
+	Argon2          Argon2Params
+	BcryptCost      int
+	Pepper          []byte
+	PepperID        string
+	PreviousPeppers map[string][]byte
+}
+
+func New() Hasher {
+	return Hasher{
+		Algorithm:  AlgorithmArgon2id,
+		Argon2:     DefaultArgon2Params,
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+func NewFromEnv() (Hasher, error) {
+	h := New()
+
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		if algorithm != AlgorithmArgon2id && algorithm != AlgorithmBcrypt {
+			return Hasher{}, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, algorithm)
+		}
+		h.Algorithm = algorithm
+	}
+
+	if err := readUintEnv("ARGON2_MEMORY_KIB", 32, func(v uint64) { h.Argon2.Memory = uint32(v) }); err != nil {
+		return Hasher{}, err
+	}
+	if err := readUintEnv("ARGON2_ITERATIONS", 32, func(v uint64) { h.Argon2.Iterations = uint32(v) }); err != nil {
+		return Hasher{}, err
+	}
+	if err := readUintEnv("ARGON2_PARALLELISM", 8, func(v uint64) { h.Argon2.Parallelism = uint8(v) }); err != nil {
+		return Hasher{}, err
+	}
+	if err := readUintEnv("BCRYPT_COST", 8, func(v uint64) { h.BcryptCost = int(v) }); err != nil {
+		return Hasher{}, err
+	}
+
+	if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+		return Hasher{}, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if h.Argon2.Memory == 0 || h.Argon2.Iterations == 0 || h.Argon2.Parallelism == 0 {
+		return Hasher{}, errors.New("argon2 parameters must be positive")
+	}
+
+	if pepper := os.Getenv("PASSWORD_PEPPER"); pepper != "" {
+		h.Pepper = []byte(pepper)
+		h.PepperID = defaultPepperID
+	}
+	if id := os.Getenv("PASSWORD_PEPPER_ID"); id != "" {
+		if !pepperIDPattern.MatchString(id) {
+			return Hasher{}, errors.New("PASSWORD_PEPPER_ID must be 1-32 characters of A-Z, a-z, 0-9, _ or -")
+		}
+		h.PepperID = id
+	}
+	previous, err := parsePreviousPeppers(os.Getenv("PASSWORD_PREVIOUS_PEPPERS"))
+	if err != nil {
+		return Hasher{}, err
+	}
+	h.PreviousPeppers = previous
+
+	return h, nil
+}
+
+// "<ID>=<ペッパー>" をカンマ区切りで並べる (例: "1=old-secret")。値にカンマは使えない
+func parsePreviousPeppers(value string) (map[string][]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	peppers := make(map[string][]byte)
+	for _, entry := range strings.Split(value, pepperListSep) {
+		id, pepper, ok := strings.Cut(entry, pepperIDValueSep)
+		if !ok || !pepperIDPattern.MatchString(id) || pepper == "" {
+			return nil, errors.New("PASSWORD_PREVIOUS_PEPPERS must be a comma-separated list of <id>=<pepper>")
+		}
+		peppers[id] = []byte(pepper)
+	}
+	return peppers, nil
+}
+
+func (h Hasher) Hash(password string) (string, error) {
+	var encoded string
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		hash, err := h.hashArgon2id(pepperArgon2id(h.Pepper, password))
+		if err != nil {
+			return "", err
+		}
+		encoded = hash
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword(pepperBcrypt(h.Pepper, password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		encoded = string(hash)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownAlgorithm, h.Algorithm)
+	}
+
+	if id := h.currentPepperID(); id != "" {
+		return pepperPrefix + id + encoded, nil
+	}
+	return encoded, nil
+}
+
+// Verify はパスワードが一致するかと、現在の設定で再ハッシュすべきかを返す
+func (h Hasher) Verify(encoded string, password string) (bool, bool, error) {
+	if rest, ok := strings.CutPrefix(encoded, pepperPrefix); ok {
+		end := strings.IndexByte(rest, '$')
+		if end <= 0 {
+			return false, false, ErrInvalidHash
+		}
+		id := rest[:end]
+		pepper, ok := h.pepperByID(id)
+		if !ok {
+			return false, false, fmt.Errorf("%w: %s", ErrUnknownPepper, id)
+		}
+
+		matched, needsRehash, err := h.verify(rest[end:], pepper, password)
+		return matched, needsRehash || id != h.currentPepperID(), err
+	}
+
+	matched, needsRehash, err := h.verify(encoded, nil, password)
+	return matched, needsRehash || h.currentPepperID() != "", err
+}
+
+func (h Hasher) verify(encoded string, pepper []byte, password string) (bool, bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false, err
+		}
+
+		derived := argon2.IDKey(pepperArgon2id(pepper, password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(derived, key) != 1 {
+			return false, false, nil
+		}
+
+		needsRehash := h.Algorithm != AlgorithmArgon2id ||
+			params.Memory != h.Argon2.Memory ||
+			params.Iterations != h.Argon2.Iterations ||
+			params.Parallelism != h.Argon2.Parallelism ||
+			uint32(len(salt)) != h.Argon2.SaltLength ||
+			params.KeyLength != h.Argon2.KeyLength
+		return true, needsRehash, nil
+
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(encoded), pepperBcrypt(pepper, password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, false, err
+		}
+		needsRehash := h.Algorithm != AlgorithmBcrypt || cost < h.BcryptCost
+		return true, needsRehash, nil
+
+	default:
+		return false, false, ErrInvalidHash
+	}
+}
+
+func (h Hasher) hashArgon2id(password []byte) (string, error) {
+	salt := make([]byte, h.Argon2.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := h.Argon2
+	key := argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Hasher) currentPepperID() string {
+	if len(h.Pepper) == 0 {
+		return ""
+	}
+	if h.PepperID == "" {
+		return defaultPepperID
+	}
+	return h.PepperID
+}
+
+func (h Hasher) pepperByID(id string) ([]byte, bool) {
+	if id == h.currentPepperID() {
+		return h.Pepper, true
+	}
+	pepper, ok := h.PreviousPeppers[id]
+	return pepper, ok
+}
+
+func pepperArgon2id(pepper []byte, password string) []byte {
+	if len(pepper) == 0 {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// bcrypt は 72 バイトで切り詰め、NUL を含む入力を扱えない実装もあるので base64 にして渡す
+func pepperBcrypt(pepper []byte, password string) []byte {
+	if len(pepper) == 0 {
+		return []byte(password)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(pepperArgon2id(pepper, password)))
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrInvalidHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func readUintEnv(name string, bitSize int, set func(uint64)) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	set(parsed)
+	return nil
+}
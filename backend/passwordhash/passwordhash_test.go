@@ -0,0 +1,206 @@
+package passwordhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHasher() Hasher {
+	h := New()
+	h.Argon2.Memory = 1024
+	h.Argon2.Iterations = 1
+	h.Argon2.Parallelism = 1
+	return h
+}
+
+func TestHasher_HashesWithArgon2idAndVerifies(t *testing.T) {
+	h := newTestHasher()
+
+	encoded, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected encoded hash: %s", encoded)
+	}
+
+	ok, needsRehash, err := h.Verify(encoded, "correct horse battery staple")
+	if err != nil || !ok || needsRehash {
+		t.Fatalf("expected match without rehash, got ok=%v rehash=%v err=%v", ok, needsRehash, err)
+	}
+
+	ok, _, err = h.Verify(encoded, "wrong password")
+	if err != nil || ok {
+		t.Fatalf("expected mismatch, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestHasher_LegacyBcryptHashNeedsRehash(t *testing.T) {
+	h := newTestHasher()
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to create bcrypt hash: %v", err)
+	}
+
+	ok, needsRehash, err := h.Verify(string(legacy), "password123")
+	if err != nil || !ok {
+		t.Fatalf("expected legacy hash to verify, got ok=%v err=%v", ok, err)
+	}
+
+	if !needsRehash {
+		t.Fatalf("expected bcrypt hash to need rehash when argon2id is configured")
+	}
+}
+
+func TestHasher_OutdatedArgon2ParamsNeedRehash(t *testing.T) {
+	old := newTestHasher()
+	encoded, err := old.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+
+	current := newTestHasher()
+	current.Argon2.Iterations = 2
+
+	ok, needsRehash, err := current.Verify(encoded, "password123")
+	if err != nil || !ok {
+		t.Fatalf("expected old hash to verify, got ok=%v err=%v", ok, err)
+	}
+
+	if !needsRehash {
+		t.Fatalf("expected outdated parameters to need rehash")
+	}
+}
+
+func TestHasher_PepperIsRequiredToVerify(t *testing.T) {
+	peppered := newTestHasher()
+	peppered.Pepper = []byte("server-secret")
+
+	encoded, err := peppered.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+
+	if !strings.HasPrefix(encoded, "$pepper$1$argon2id$") {
+		t.Fatalf("expected pepper id to be recorded, got %s", encoded)
+	}
+
+	ok, _, err := newTestHasher().Verify(encoded, "password123")
+	if !errors.Is(err, ErrUnknownPepper) || ok {
+		t.Fatalf("expected verification without pepper to fail, got ok=%v err=%v", ok, err)
+	}
+
+	ok, _, err = peppered.Verify(encoded, "password123")
+	if err != nil || !ok {
+		t.Fatalf("expected verification with pepper to succeed, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestHasher_RotatedPepperNeedsRehash(t *testing.T) {
+	old := newTestHasher()
+	old.Pepper = []byte("old-secret")
+	encoded, err := old.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+
+	current := newTestHasher()
+	current.Pepper = []byte("new-secret")
+	current.PepperID = "2"
+	current.PreviousPeppers = map[string][]byte{"1": []byte("old-secret")}
+
+	ok, needsRehash, err := current.Verify(encoded, "password123")
+	if err != nil || !ok || !needsRehash {
+		t.Fatalf("expected old pepper to verify and need rehash, got ok=%v rehash=%v err=%v", ok, needsRehash, err)
+	}
+
+	rehashed, err := current.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to rehash: %v", err)
+	}
+	ok, needsRehash, err = current.Verify(rehashed, "password123")
+	if err != nil || !ok || needsRehash || !strings.HasPrefix(rehashed, "$pepper$2$") {
+		t.Fatalf("expected rehashed password to use the new pepper, got %s ok=%v rehash=%v err=%v", rehashed, ok, needsRehash, err)
+	}
+
+	// ペッパーを外しても、古い値が残っていれば検証して移行できる
+	removed := newTestHasher()
+	removed.PreviousPeppers = map[string][]byte{"2": []byte("new-secret")}
+	ok, needsRehash, err = removed.Verify(rehashed, "password123")
+	if err != nil || !ok || !needsRehash {
+		t.Fatalf("expected removed pepper to need rehash, got ok=%v rehash=%v err=%v", ok, needsRehash, err)
+	}
+}
+
+func TestHasher_AddingPepperRehashesUnpepperedHashes(t *testing.T) {
+	plain, err := newTestHasher().Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to create bcrypt hash: %v", err)
+	}
+
+	peppered := newTestHasher()
+	peppered.Pepper = []byte("server-secret")
+	for _, encoded := range []string{plain, string(bcryptHash)} {
+		ok, needsRehash, err := peppered.Verify(encoded, "password123")
+		if err != nil || !ok || !needsRehash {
+			t.Fatalf("expected %s to verify and need rehash, got ok=%v rehash=%v err=%v", encoded, ok, needsRehash, err)
+		}
+	}
+}
+
+func TestHasher_PepperAppliesToBcrypt(t *testing.T) {
+	h := newTestHasher()
+	h.Algorithm = AlgorithmBcrypt
+	h.BcryptCost = bcrypt.MinCost
+	h.Pepper = []byte("server-secret")
+
+	encoded, err := h.Hash("password123")
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$pepper$1$2a$") {
+		t.Fatalf("expected peppered bcrypt hash, got %s", encoded)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(encoded, "$pepper$1")), []byte("password123")); err == nil {
+		t.Fatalf("expected bcrypt hash not to verify without the pepper")
+	}
+
+	ok, needsRehash, err := h.Verify(encoded, "password123")
+	if err != nil || !ok || needsRehash {
+		t.Fatalf("expected match without rehash, got ok=%v rehash=%v err=%v", ok, needsRehash, err)
+	}
+}
+
+func TestNewFromEnv_ReadsPepperRotation(t *testing.T) {
+	t.Setenv("PASSWORD_PEPPER", "new-secret")
+	t.Setenv("PASSWORD_PEPPER_ID", "2025")
+	t.Setenv("PASSWORD_PREVIOUS_PEPPERS", "1=old-secret,2=older=secret")
+
+	h, err := NewFromEnv()
+	if err != nil {
+		t.Fatalf("NewFromEnv returned error: %v", err)
+	}
+	if h.PepperID != "2025" || string(h.PreviousPeppers["1"]) != "old-secret" || string(h.PreviousPeppers["2"]) != "older=secret" {
+		t.Fatalf("unexpected pepper configuration: %+v", h)
+	}
+
+	t.Setenv("PASSWORD_PREVIOUS_PEPPERS", "old-secret")
+	if _, err := NewFromEnv(); err == nil {
+		t.Fatalf("expected malformed PASSWORD_PREVIOUS_PEPPERS to be rejected")
+	}
+}
+
+func TestHasher_RejectsUnknownFormat(t *testing.T) {
+	if _, _, err := newTestHasher().Verify("plaintext", "plaintext"); err != ErrInvalidHash {
+		t.Fatalf("expected ErrInvalidHash, got %v", err)
+	}
+}
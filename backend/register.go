@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 90 * 24 * time.Hour
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{2,31}$`)
+
+var (
+	errInvalidInvite = errors.New("invite code is invalid or expired")
+	errUsernameTaken = errors.New("username is already taken")
+)
+
+type registerRequest struct {
+	InviteCode string `json:"invite_code"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+}
+
+type createInviteRequest struct {
+	ExpiresInHours int `json:"expires_in_hours"`
+}
+
+type inviteResponse struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var isAdminUser = func(userID string) (bool, error) {
+	var isAdmin bool
+	err := db.QueryRow("SELECT is_admin FROM users WHERE id = $1", userID).Scan(&isAdmin)
+	if err != nil {
+		return false, err
+	}
+	return isAdmin, nil
+}
+
+var insertInvite = func(codeHash string, createdBy string, expiresAt time.Time) error {
+	_, err := db.Exec(
+		`INSERT INTO invites (code_hash, created_by, expires_at)
+		 VALUES ($1, $2, $3)`,
+		codeHash, createdBy, expiresAt,
+	)
+	return err
+}
+
+// 招待コードが空の場合はオープン登録として扱う。
+// ユーザー名の重複より先に招待コードを確かめ、招待を持たない人にユーザー名の有無を教えない
+var registerUser = func(codeHash string, username string, passwordHash string) (user, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return user{}, err
+	}
+	defer tx.Rollback()
+
+	if codeHash != "" {
+		// 同じ招待コードで同時に登録されても、使えるのは 1 回だけにする
+		var found string
+		err := tx.QueryRow(
+			`SELECT code_hash FROM invites
+			 WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+			 FOR UPDATE`,
+			codeHash,
+		).Scan(&found)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return user{}, errInvalidInvite
+			}
+			return user{}, err
+		}
+	}
+
+	var created user
+	err = tx.QueryRow(
+		`INSERT INTO users (username, password_hash)
+		 VALUES ($1, $2)
+		 RETURNING id, username`,
+		username, passwordHash,
+	).Scan(&created.ID, &created.Username)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return user{}, errUsernameTaken
+		}
+		return user{}, err
+	}
+
+	if codeHash != "" {
+		if _, err := tx.Exec(
+			"UPDATE invites SET used_at = NOW(), used_by = $1 WHERE code_hash = $2",
+			created.ID, codeHash,
+		); err != nil {
+			return user{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return user{}, err
+	}
+	return created, nil
+}
+
+func isOpenRegistration() bool {
+	return os.Getenv("REGISTRATION_MODE") == "open"
+}
+
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3-32 characters of letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+	return nil
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	inviteCode := strings.TrimSpace(req.InviteCode)
+	username := strings.TrimSpace(req.Username)
+	if username == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "username and password are required")
+		return
+	}
+
+	if inviteCode == "" && !isOpenRegistration() {
+		writeError(w, http.StatusBadRequest, "invite_code is required")
+		return
+	}
+
+	if err := validateUsername(username); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := validateNewPassword(req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	codeHash := ""
+	if inviteCode != "" {
+		codeHash = hashSessionToken(inviteCode)
+	}
+
+	created, err := registerUser(codeHash, username, passwordHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidInvite):
+			writeError(w, http.StatusBadRequest, "invalid or expired invite code")
+		case errors.Is(err, errUsernameTaken):
+			writeError(w, http.StatusConflict, "username is already taken")
+		default:
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}
+		return
+	}
+
+	if err := startSession(w, created.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, userResponse{User: created})
+}
+
+func createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	isAdmin, err := isAdminUser(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if !isAdmin {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var req createInviteRequest
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+
+	ttl := defaultInviteTTL
+	if req.ExpiresInHours != 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+		if ttl <= 0 || ttl > maxInviteTTL {
+			writeError(w, http.StatusBadRequest, "expires_in_hours is out of range")
+			return
+		}
+	}
+
+	code, err := generateSessionToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if err := insertInvite(hashSessionToken(code), userID, expiresAt); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, inviteResponse{Code: code, ExpiresAt: expiresAt})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stubRegistration(t *testing.T) *string {
+	t.Helper()
+
+	originalHash := hashPassword
+	originalRegister := registerUser
+	originalInsertSession := insertSession
+	t.Cleanup(func() {
+		hashPassword = originalHash
+		registerUser = originalRegister
+		insertSession = originalInsertSession
+	})
+
+	hashPassword = func(password string) (string, error) {
+		return "hashed:" + password, nil
+	}
+	insertSession = func(tokenHash string, userID string, expiresAt time.Time) error {
+		return nil
+	}
+
+	gotCodeHash := new(string)
+	registerUser = func(codeHash string, username string, passwordHash string) (user, error) {
+		*gotCodeHash = codeHash
+		return user{ID: "user-1", Username: username}, nil
+	}
+	return gotCodeHash
+}
+
+func TestRegisterHandler_RequiresInviteByDefault(t *testing.T) {
+	stubRegistration(t)
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/register",
+		strings.NewReader(`{"username":"alice","password":"password123"}`),
+	)
+	recorder := httptest.NewRecorder()
+	registerHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"invite_code is required\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestRegisterHandler_AllowsOpenRegistrationWithoutInvite(t *testing.T) {
+	gotCodeHash := stubRegistration(t)
+	t.Setenv("REGISTRATION_MODE", "open")
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/register",
+		strings.NewReader(`{"username":"alice","password":"password123"}`),
+	)
+	recorder := httptest.NewRecorder()
+	registerHandler(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+
+	if *gotCodeHash != "" {
+		t.Fatalf("expected no invite to be consumed, got %s", *gotCodeHash)
+	}
+}
+
+func TestRegisterHandler_ConsumesInviteAndStartsSession(t *testing.T) {
+	gotCodeHash := stubRegistration(t)
+
+	request := httptest.NewRequest(
+		http.MethodPost,
+		"/api/register",
+		strings.NewReader(`{"invite_code":"invite-1","username":"alice","password":"password123"}`),
+	)
+	recorder := httptest.NewRecorder()
+	registerHandler(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+
+	if *gotCodeHash != hashSessionToken("invite-1") {
+		t.Fatalf("expected invite code hash to be passed, got %s", *gotCodeHash)
+	}
+
+	var response userResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.User.Username != "alice" {
+		t.Fatalf("expected username alice, got %s", response.User.Username)
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+		t.Fatalf("expected session cookie to be set, got %v", cookies)
+	}
+}
+
+func TestRegisterHandler_RejectsInvalidUsername(t *testing.T) {
+	stubRegistration(t)
+
+	for _, username := range []string{"ab", "-alice", "alice bob", strings.Repeat("a", 33)} {
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/api/register",
+			strings.NewReader(`{"invite_code":"invite-1","username":"`+username+`","password":"password123"}`),
+		)
+		recorder := httptest.NewRecorder()
+		registerHandler(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("username %q: expected status %d, got %d", username, http.StatusBadRequest, recorder.Code)
+		}
+	}
+}
+
+func TestRegisterHandler_ReportsInvalidInviteAndTakenUsername(t *testing.T) {
+	stubRegistration(t)
+
+	cases := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{errInvalidInvite, http.StatusBadRequest, "{\"error\":\"invalid or expired invite code\"}\n"},
+		{errUsernameTaken, http.StatusConflict, "{\"error\":\"username is already taken\"}\n"},
+	}
+
+	for _, tc := range cases {
+		registerUser = func(codeHash string, username string, passwordHash string) (user, error) {
+			return user{}, tc.err
+		}
+
+		request := httptest.NewRequest(
+			http.MethodPost,
+			"/api/register",
+			strings.NewReader(`{"invite_code":"invite-1","username":"alice","password":"password123"}`),
+		)
+		recorder := httptest.NewRecorder()
+		registerHandler(recorder, request)
+
+		if recorder.Code != tc.status {
+			t.Fatalf("expected status %d, got %d", tc.status, recorder.Code)
+		}
+
+		if body := recorder.Body.String(); body != tc.body {
+			t.Fatalf("unexpected response body: %s", body)
+		}
+	}
+}
+
+func TestCreateInviteHandler_ForbiddenForNonAdmin(t *testing.T) {
+	originalIsAdmin := isAdminUser
+	originalInsert := insertInvite
+	t.Cleanup(func() {
+		isAdminUser = originalIsAdmin
+		insertInvite = originalInsert
+	})
+
+	isAdminUser = func(userID string) (bool, error) {
+		return false, nil
+	}
+	wasCalled := false
+	insertInvite = func(codeHash string, createdBy string, expiresAt time.Time) error {
+		wasCalled = true
+		return nil
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/invites", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	createInviteHandler(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, recorder.Code)
+	}
+
+	if wasCalled {
+		t.Fatalf("insertInvite should not be called for non-admin user")
+	}
+}
+
+func TestCreateInviteHandler_ReturnsCodeForAdmin(t *testing.T) {
+	originalIsAdmin := isAdminUser
+	originalInsert := insertInvite
+	t.Cleanup(func() {
+		isAdminUser = originalIsAdmin
+		insertInvite = originalInsert
+	})
+
+	isAdminUser = func(userID string) (bool, error) {
+		return true, nil
+	}
+	gotCodeHash := ""
+	insertInvite = func(codeHash string, createdBy string, expiresAt time.Time) error {
+		gotCodeHash = codeHash
+		return nil
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/invites", strings.NewReader(`{"expires_in_hours":24}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	createInviteHandler(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+
+	var response inviteResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if gotCodeHash != hashSessionToken(response.Code) {
+		t.Fatalf("expected stored hash to match returned code")
+	}
+
+	if time.Until(response.ExpiresAt) > 24*time.Hour {
+		t.Fatalf("unexpected expiry: %s", response.ExpiresAt)
+	}
+}
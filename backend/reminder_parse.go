@@ -0,0 +1,302 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/width"
+)
+
+// 日付だけで時刻がないときの既定の時刻
+const defaultReminderHour = 9
+
+type reminderTimeMatch struct {
+	At time.Time
+	// 時刻表現として解釈した部分 (全角英数字は半角にしたもの)
+	Text string
+}
+
+var (
+	relativeDurationPatterns = []struct {
+		pattern *regexp.Regexp
+		unit    func(n int) time.Duration
+	}{
+		{regexp.MustCompile(`(?i)\bin (\d+|an?|one) ?(?:minutes?|mins?)\b`), func(n int) time.Duration { return time.Duration(n) * time.Minute }},
+		{regexp.MustCompile(`(?i)\bin (\d+|an?|one) ?(?:hours?|hrs?)\b`), func(n int) time.Duration { return time.Duration(n) * time.Hour }},
+		{regexp.MustCompile(`(\d+)分後`), func(n int) time.Duration { return time.Duration(n) * time.Minute }},
+		{regexp.MustCompile(`(\d+)時間後`), func(n int) time.Duration { return time.Duration(n) * time.Hour }},
+	}
+
+	relativeDayPatterns = []struct {
+		pattern *regexp.Regexp
+		days    func(n int) int
+	}{
+		{regexp.MustCompile(`(?i)\bin (\d+|an?|one) ?days?\b`), func(n int) int { return n }},
+		{regexp.MustCompile(`(?i)\bin (\d+|an?|one) ?weeks?\b`), func(n int) int { return 7 * n }},
+		{regexp.MustCompile(`(\d+)日後`), func(n int) int { return n }},
+		{regexp.MustCompile(`(\d+)週間後`), func(n int) int { return 7 * n }},
+	}
+
+	dayWordPatterns = []struct {
+		pattern *regexp.Regexp
+		offset  int
+	}{
+		// 長い語を先に試す (明後日 を 明日 と誤認しない)
+		{regexp.MustCompile(`明後日|あさって`), 2},
+		{regexp.MustCompile(`(?i)\bday after tomorrow\b`), 2},
+		{regexp.MustCompile(`明日|あした|あす`), 1},
+		{regexp.MustCompile(`(?i)\btomorrow\b`), 1},
+		{regexp.MustCompile(`今日|本日|今夜|今晩`), 0},
+		{regexp.MustCompile(`(?i)\b(?:today|tonight)\b`), 0},
+	}
+
+	japaneseWeekdayPattern  = regexp.MustCompile(`(再来週|来週|今週)?の?([月火水木金土日])曜(?:日)?`)
+	japaneseNextWeekPattern = regexp.MustCompile(`再来週|来週`)
+	englishWeekdayPattern   = regexp.MustCompile(`(?i)\b(?:(next|this|on) )?(monday|tuesday|wednesday|thursday|friday|saturday|sunday|mon|tue|tues|wed|thu|thur|thurs|fri)\b`)
+	englishNextWeekPattern  = regexp.MustCompile(`(?i)\bnext week\b`)
+
+	japaneseTimePattern   = regexp.MustCompile(`(午前|午後)?(\d{1,2})時(?:(半)|(\d{1,2})分)?`)
+	englishClockPattern   = regexp.MustCompile(`(?i)\b(\d{1,2})(?::(\d{2}))? ?(am|pm|a\.m\.|p\.m\.)`)
+	twentyFourHourPattern = regexp.MustCompile(`\b(\d{1,2}):(\d{2})\b`)
+	englishAtHourPattern  = regexp.MustCompile(`(?i)\bat (\d{1,2})\b`)
+
+	dayPartPatterns = []struct {
+		pattern *regexp.Regexp
+		hour    int
+	}{
+		{regexp.MustCompile(`正午|(?i:\bnoon\b)`), 12},
+		{regexp.MustCompile(`(?i:\bmidnight\b)`), 0},
+		{regexp.MustCompile(`今夜|今晩|夜|(?i:\btonight\b)|(?i:\bevening\b)`), 20},
+		{regexp.MustCompile(`夕方`), 17},
+		{regexp.MustCompile(`(?i:\bafternoon\b)|午後`), 15},
+		{regexp.MustCompile(`昼`), 12},
+		{regexp.MustCompile(`朝|午前|(?i:\bmorning\b)`), defaultReminderHour},
+	}
+)
+
+var japaneseWeekdays = map[string]time.Weekday{
+	"日": time.Sunday, "月": time.Monday, "火": time.Tuesday, "水": time.Wednesday,
+	"木": time.Thursday, "金": time.Friday, "土": time.Saturday,
+}
+
+var englishWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type textSpan struct {
+	start int
+	end   int
+}
+
+// parseReminderTime は「明日10時」「来週月曜」「tomorrow 10am」「in 2 hours」のような表現を
+// location の暦で解釈し、now より後の時刻を返す。見つからなければ false
+func parseReminderTime(text string, now time.Time, location *time.Location) (reminderTimeMatch, bool) {
+	normalized := width.Fold.String(text)
+	now = now.In(location)
+	spans := make([]textSpan, 0)
+	mark := func(loc []int) {
+		spans = append(spans, textSpan{start: loc[0], end: loc[1]})
+	}
+
+	// 「2時間後」などは日付の解釈を挟まずに now からの差で決める
+	for _, relative := range relativeDurationPatterns {
+		if loc := relative.pattern.FindStringSubmatchIndex(normalized); loc != nil {
+			mark(loc)
+			at := now.Add(relative.unit(parseCount(normalized[loc[2]:loc[3]])))
+			return reminderTimeMatch{At: at.Truncate(time.Minute), Text: spanText(normalized, spans)}, true
+		}
+	}
+
+	date, hasDate := findReminderDate(normalized, now, location, mark)
+	hour, minute, hasTime := findReminderClock(normalized, mark)
+	if !hasDate && !hasTime {
+		return reminderTimeMatch{}, false
+	}
+
+	if !hasDate {
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	}
+	if !hasTime {
+		hour, minute = defaultReminderHour, 0
+	}
+	at := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, location)
+	// 時刻だけの指定で今日のその時刻を過ぎていれば翌日にする
+	if !hasDate && !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	if !at.After(now) {
+		return reminderTimeMatch{}, false
+	}
+	return reminderTimeMatch{At: at, Text: spanText(normalized, spans)}, true
+}
+
+func findReminderDate(text string, now time.Time, location *time.Location, mark func([]int)) (time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	for _, relative := range relativeDayPatterns {
+		if loc := relative.pattern.FindStringSubmatchIndex(text); loc != nil {
+			mark(loc)
+			return today.AddDate(0, 0, relative.days(parseCount(text[loc[2]:loc[3]]))), true
+		}
+	}
+
+	// 月曜始まりの週で数える
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	if loc := japaneseWeekdayPattern.FindStringSubmatchIndex(text); loc != nil {
+		mark(loc)
+		weekday := japaneseWeekdays[text[loc[4]:loc[5]]]
+		offset := (int(weekday) + 6) % 7
+		switch {
+		case loc[2] < 0:
+			return upcomingWeekday(today, weekday, false), true
+		case text[loc[2]:loc[3]] == "今週":
+			return monday.AddDate(0, 0, offset), true
+		case text[loc[2]:loc[3]] == "来週":
+			return monday.AddDate(0, 0, 7+offset), true
+		default:
+			return monday.AddDate(0, 0, 14+offset), true
+		}
+	}
+	if loc := englishWeekdayPattern.FindStringSubmatchIndex(text); loc != nil {
+		mark(loc)
+		weekday := englishWeekdays[strings.ToLower(text[loc[4]:loc[4]+3])]
+		includeToday := loc[2] >= 0 && strings.EqualFold(text[loc[2]:loc[3]], "this")
+		return upcomingWeekday(today, weekday, includeToday), true
+	}
+	if loc := japaneseNextWeekPattern.FindStringIndex(text); loc != nil {
+		mark(loc)
+		weeks := 1
+		if text[loc[0]:loc[1]] == "再来週" {
+			weeks = 2
+		}
+		return monday.AddDate(0, 0, 7*weeks), true
+	}
+	if loc := englishNextWeekPattern.FindStringIndex(text); loc != nil {
+		mark(loc)
+		return monday.AddDate(0, 0, 7), true
+	}
+
+	for _, day := range dayWordPatterns {
+		if loc := day.pattern.FindStringIndex(text); loc != nil {
+			mark(loc)
+			return today.AddDate(0, 0, day.offset), true
+		}
+	}
+
+	// 本文中の日付エンティティと同じ表記を使う。年のない日付は次に来るその日
+	for _, match := range findDates(text) {
+		var date time.Time
+		if strings.HasPrefix(match.value, "--") {
+			month, day := time.Month(atoiOrZero(match.value[2:4])), atoiOrZero(match.value[5:7])
+			// 2 月 29 日は次のうるう年まで進める
+			for year := today.Year(); ; year++ {
+				date = time.Date(year, month, day, 0, 0, 0, 0, location)
+				if !date.Before(today) && date.Day() == day {
+					break
+				}
+			}
+		} else {
+			parsed, err := time.ParseInLocation(time.DateOnly, match.value, location)
+			if err != nil {
+				continue
+			}
+			date = parsed
+		}
+		mark([]int{match.start, match.end})
+		return date, true
+	}
+	return time.Time{}, false
+}
+
+func findReminderClock(text string, mark func([]int)) (int, int, bool) {
+	// 「1時間」のような長さは時刻として扱わない
+	if loc := japaneseTimePattern.FindStringSubmatchIndex(text); loc != nil && !strings.HasPrefix(text[loc[1]:], "間") {
+		hour := atoiOrZero(text[loc[4]:loc[5]])
+		minute := 0
+		if loc[6] >= 0 {
+			minute = 30
+		} else if loc[8] >= 0 {
+			minute = atoiOrZero(text[loc[8]:loc[9]])
+		}
+		if loc[2] >= 0 && text[loc[2]:loc[3]] == "午後" && hour < 12 {
+			hour += 12
+		}
+		if validClock(hour, minute) {
+			mark(loc)
+			return hour, minute, true
+		}
+	}
+	if loc := englishClockPattern.FindStringSubmatchIndex(text); loc != nil {
+		hour := atoiOrZero(text[loc[2]:loc[3]])
+		minute := 0
+		if loc[4] >= 0 {
+			minute = atoiOrZero(text[loc[4]:loc[5]])
+		}
+		pm := strings.HasPrefix(strings.ToLower(text[loc[6]:loc[7]]), "p")
+		if hour >= 1 && hour <= 12 && minute < 60 {
+			hour %= 12
+			if pm {
+				hour += 12
+			}
+			mark(loc)
+			return hour, minute, true
+		}
+	}
+	if loc := twentyFourHourPattern.FindStringSubmatchIndex(text); loc != nil {
+		hour, minute := atoiOrZero(text[loc[2]:loc[3]]), atoiOrZero(text[loc[4]:loc[5]])
+		if validClock(hour, minute) {
+			mark(loc)
+			return hour, minute, true
+		}
+	}
+	if loc := englishAtHourPattern.FindStringSubmatchIndex(text); loc != nil {
+		if hour := atoiOrZero(text[loc[2]:loc[3]]); validClock(hour, 0) {
+			mark(loc)
+			return hour, 0, true
+		}
+	}
+	for _, part := range dayPartPatterns {
+		if loc := part.pattern.FindStringIndex(text); loc != nil {
+			mark(loc)
+			return part.hour, 0, true
+		}
+	}
+	return 0, 0, false
+}
+
+func upcomingWeekday(today time.Time, weekday time.Weekday, includeToday bool) time.Time {
+	days := (int(weekday) - int(today.Weekday()) + 7) % 7
+	if days == 0 && !includeToday {
+		days = 7
+	}
+	return today.AddDate(0, 0, days)
+}
+
+func validClock(hour int, minute int) bool {
+	return hour >= 0 && hour <= 24 && minute >= 0 && minute < 60 && !(hour == 24 && minute > 0)
+}
+
+func parseCount(value string) int {
+	switch strings.ToLower(value) {
+	case "a", "an", "one":
+		return 1
+	}
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// 解釈に使った部分を元の並びのまま 1 つの範囲として返す
+func spanText(text string, spans []textSpan) string {
+	if len(spans) == 0 {
+		return ""
+	}
+	start, end := spans[0].start, spans[0].end
+	for _, span := range spans[1:] {
+		start = min(start, span.start)
+		end = max(end, span.end)
+	}
+	return strings.TrimSpace(text[start:end])
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReminderTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+	// 2026-03-11 は水曜日
+	now := time.Date(2026, 3, 11, 14, 0, 0, 0, tokyo)
+
+	cases := map[string]string{
+		"明日10時":               "2026-03-12 10:00",
+		"来週月曜":                "2026-03-16 09:00",
+		"来週の金曜 午後3時半":         "2026-03-20 15:30",
+		"今週金曜日":               "2026-03-13 09:00",
+		"水曜":                  "2026-03-18 09:00",
+		"再来週":                 "2026-03-23 09:00",
+		"あさって朝":               "2026-03-13 09:00",
+		"3時間後":                "2026-03-11 17:00",
+		"10時":                 "2026-03-12 10:00",
+		"１５時":                 "2026-03-11 15:00",
+		"3月20日 18:00":         "2026-03-20 18:00",
+		"1月5日":                "2027-01-05 09:00",
+		"tomorrow at 10am":    "2026-03-12 10:00",
+		"next Monday":         "2026-03-16 09:00",
+		"in 30 minutes":       "2026-03-11 14:30",
+		"in 2 days at 8:15pm": "2026-03-13 20:15",
+		"tonight":             "2026-03-11 20:00",
+		"March 20 noon":       "2026-03-20 12:00",
+		"会議は1時間":              "",
+		"今日9時":                "",
+		"I sat in the sun":    "",
+	}
+	for text, want := range cases {
+		var got string
+		if match, ok := parseReminderTime(text, now, tokyo); ok {
+			got = match.At.In(tokyo).Format("2006-01-02 15:04")
+		}
+		if got != want {
+			t.Errorf("parseReminderTime(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestParseReminderTime_ReportsMatchedText(t *testing.T) {
+	now := time.Date(2026, 3, 11, 14, 0, 0, 0, time.UTC)
+
+	cases := map[string]string{
+		"明日10時に歯医者":                     "明日10時",
+		"資料を来週月曜までに":                    "来週月曜",
+		"call Bob tomorrow at 3pm, ok?": "tomorrow at 3pm",
+	}
+	for text, want := range cases {
+		match, ok := parseReminderTime(text, now, time.UTC)
+		if !ok || match.Text != want {
+			t.Errorf("parseReminderTime(%q) text = %q (ok=%v), want %q", text, match.Text, ok, want)
+		}
+	}
+}
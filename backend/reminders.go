@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	reminderStatusPending = "pending"
+	reminderStatusFiring  = "firing"
+	reminderStatusSent    = "sent"
+	reminderStatusFailed  = "failed"
+
+	defaultReminderPollSeconds = 15
+	reminderBatchSize          = 50
+	// firing のまま lease を過ぎた行は、配信中にプロセスが落ちたか配信に失敗したものとして取り直す
+	reminderLease            = 5 * time.Minute
+	reminderDeliveryTimeout  = 30 * time.Second
+	reminderMaxAttempts      = 5
+	reminderErrorMaxBytes    = 200
+	reminderNotificationBody = 500
+)
+
+type reminder struct {
+	ID        int        `json:"id"`
+	MessageID int        `json:"message_id"`
+	RemindAt  time.Time  `json:"remind_at"`
+	Status    string     `json:"status"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// remind_at と text はどちらか一方。どちらもなければメッセージ本文から時刻表現を探す
+type createReminderRequest struct {
+	RemindAt *time.Time `json:"remind_at"`
+	Text     *string    `json:"text"`
+}
+
+type createReminderResponse struct {
+	reminder
+	ParsedText string `json:"parsed_text,omitempty"`
+}
+
+type reminderListResponse struct {
+	MessageID int        `json:"message_id"`
+	Reminders []reminder `json:"reminders"`
+}
+
+type dueReminder struct {
+	ID        int
+	MessageID int
+	UserID    string
+	RemindAt  time.Time
+	Attempts  int
+}
+
+const reminderColumns = `id, message_id, remind_at, status, sent_at, created_at`
+
+func scanReminder(row rowScanner) (reminder, error) {
+	var r reminder
+	var sentAt sql.NullTime
+	err := row.Scan(&r.ID, &r.MessageID, &r.RemindAt, &r.Status, &sentAt, &r.CreatedAt)
+	if sentAt.Valid {
+		r.SentAt = &sentAt.Time
+	}
+	return r, err
+}
+
+// メッセージが存在しなければ sql.ErrNoRows
+var insertReminder = func(userID string, messageID int, remindAt time.Time) (reminder, error) {
+	var created reminder
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		created, err = scanReminder(tx.QueryRow(
+			`INSERT INTO reminders (message_id, user_id, remind_at)
+			 SELECT id, user_id, $3 FROM messages WHERE id = $1 AND user_id = $2
+			 RETURNING `+reminderColumns,
+			messageID,
+			userID,
+			remindAt,
+		))
+		return err
+	})
+	return created, err
+}
+
+// メッセージが存在しなければ sql.ErrNoRows
+var listReminders = func(messageID int, userID string) ([]reminder, error) {
+	reminders := make([]reminder, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND user_id = $2)",
+			messageID,
+			userID,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		rows, err := tx.Query(
+			`SELECT `+reminderColumns+`
+			 FROM reminders
+			 WHERE message_id = $1 AND user_id = $2
+			 ORDER BY remind_at, id`,
+			messageID,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			r, err := scanReminder(rows)
+			if err != nil {
+				return err
+			}
+			reminders = append(reminders, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reminders, nil
+}
+
+var deleteReminder = func(reminderID int, userID string) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM reminders WHERE id = $1 AND user_id = $2", reminderID, userID)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+var loadReminderMessageBody = func(messageID int, userID string) (string, error) {
+	var body string
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			"SELECT body FROM messages WHERE id = $1 AND user_id = $2",
+			messageID,
+			userID,
+		).Scan(&body)
+	})
+	return body, err
+}
+
+// 期限の来た行を firing にしてから返す。コミット後は他のインスタンスや再起動後のプロセスが
+// 同じ行を取らない。lease 切れで取り直しても、届いた通知先には reminder_deliveries を見て送り直さない
+var claimDueReminders = func(limit int) ([]dueReminder, error) {
+	due := make([]dueReminder, 0)
+	err := withReminderSchedulerScope(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`UPDATE reminders
+			 SET status = 'firing', claimed_at = NOW(), attempts = attempts + 1
+			 WHERE id IN (
+			     SELECT id FROM reminders
+			     WHERE remind_at <= NOW()
+			       AND (status = 'pending' OR (status = 'firing' AND claimed_at < NOW() - $1 * INTERVAL '1 second'))
+			     ORDER BY remind_at
+			     LIMIT $2
+			     FOR UPDATE SKIP LOCKED
+			 )
+			 RETURNING id, message_id, user_id, remind_at, attempts`,
+			int(reminderLease/time.Second),
+			limit,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var r dueReminder
+			if err := rows.Scan(&r.ID, &r.MessageID, &r.UserID, &r.RemindAt, &r.Attempts); err != nil {
+				return err
+			}
+			due = append(due, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+// 通知先ごとの配信済みの記録。再起動や lease 切れで取り直しても、届いた通知先には送らない
+var loadReminderDeliveries = func(reminderID int) (map[string]bool, error) {
+	delivered := make(map[string]bool)
+	err := withReminderSchedulerScope(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT notifier FROM reminder_deliveries WHERE reminder_id = $1", reminderID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			delivered[name] = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivered, nil
+}
+
+// 送ってすぐ記録するので、二重に届くのは送ってから記録するまでの間にプロセスが落ちた場合だけ
+var recordReminderDelivery = func(r dueReminder, notifierName string) error {
+	return withReminderSchedulerScope(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO reminder_deliveries (reminder_id, user_id, notifier)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (reminder_id, notifier) DO NOTHING`,
+			r.ID,
+			r.UserID,
+			notifierName,
+		)
+		return err
+	})
+}
+
+// status が firing のままなら lease が切れるまで取り直されない (失敗時の待ち時間を兼ねる)
+var completeReminder = func(reminderID int, status string, lastError string) error {
+	return withReminderSchedulerScope(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`UPDATE reminders
+			 SET status = $2, last_error = $3, sent_at = CASE WHEN $4 THEN NOW() ELSE sent_at END
+			 WHERE id = $1 AND status = 'firing'`,
+			reminderID,
+			status,
+			lastError,
+			status == reminderStatusSent,
+		)
+		return err
+	})
+}
+
+func reminderPollInterval() time.Duration {
+	seconds := defaultReminderPollSeconds
+	if value := os.Getenv("REMINDER_POLL_SECONDS"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			seconds = parsed
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func startReminderScheduler() {
+	go func() {
+		ticker := time.NewTicker(reminderPollInterval())
+		defer ticker.Stop()
+
+		for {
+			fireDueReminders()
+			<-ticker.C
+		}
+	}()
+}
+
+func fireDueReminders() {
+	for {
+		due, err := claimDueReminders(reminderBatchSize)
+		if err != nil {
+			log.Printf("failed to claim due reminders: %v", err)
+			return
+		}
+		for _, r := range due {
+			fireReminder(r)
+		}
+		if len(due) < reminderBatchSize {
+			return
+		}
+	}
+}
+
+func fireReminder(r dueReminder) {
+	status, lastError := reminderStatusSent, ""
+
+	body, err := loadReminderMessageBody(r.MessageID, r.UserID)
+	var delivered map[string]bool
+	if err == nil {
+		delivered, err = loadReminderDeliveries(r.ID)
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), reminderDeliveryTimeout)
+		err = dispatchNotification(ctx, notification{
+			UserID:    r.UserID,
+			Key:       fmt.Sprintf("reminder-%d", r.ID),
+			Title:     "リマインダー",
+			Body:      truncateString(body, reminderNotificationBody),
+			MessageID: r.MessageID,
+		}, delivered, func(name string) error {
+			return recordReminderDelivery(r, name)
+		})
+		cancel()
+	}
+	if err != nil {
+		lastError = truncateString(err.Error(), reminderErrorMaxBytes)
+		status = reminderStatusFiring
+		if errors.Is(err, sql.ErrNoRows) || r.Attempts >= reminderMaxAttempts {
+			status = reminderStatusFailed
+		}
+		log.Printf("failed to deliver reminder %d (attempt %d): %v", r.ID, r.Attempts, err)
+	}
+
+	if err := completeReminder(r.ID, status, lastError); err != nil {
+		log.Printf("failed to complete reminder %d: %v", r.ID, err)
+	}
+}
+
+func createReminderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	// 本文から読み取る場合は空のボディでよい
+	var req createReminderRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.RemindAt != nil && req.Text != nil {
+		writeError(w, http.StatusBadRequest, "remind_at and text cannot be combined")
+		return
+	}
+
+	now := time.Now()
+	var remindAt time.Time
+	var parsedText string
+	if req.RemindAt != nil {
+		remindAt = *req.RemindAt
+	} else {
+		location, status := resolveRequestLocation(userID, r.URL.Query().Get("tz"))
+		if status == http.StatusBadRequest {
+			writeError(w, http.StatusBadRequest, "invalid tz")
+			return
+		}
+		if status != http.StatusOK {
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		var source string
+		if req.Text != nil {
+			source = *req.Text
+		} else {
+			source, err = loadReminderMessageBody(messageID, userID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusNotFound, "message not found")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "internal server error")
+				return
+			}
+		}
+
+		match, ok := parseReminderTime(source, now, location)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "could not parse reminder time")
+			return
+		}
+		remindAt, parsedText = match.At, match.Text
+	}
+
+	if !remindAt.After(now) {
+		writeError(w, http.StatusBadRequest, "remind_at must be in the future")
+		return
+	}
+
+	created, err := insertReminder(userID, messageID, remindAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createReminderResponse{reminder: created, ParsedText: parsedText})
+}
+
+func listRemindersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	messageID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	reminders, err := listReminders(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, reminderListResponse{MessageID: messageID, Reminders: reminders})
+}
+
+func deleteReminderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	reminderID, err := strconv.Atoi(chi.URLParam(r, "reminderID"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid reminder id")
+		return
+	}
+
+	if err := deleteReminder(reminderID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "reminder not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type recordingNotifier struct {
+	name string
+	sent []notification
+	err  error
+}
+
+func (n *recordingNotifier) Name() string {
+	if n.name == "" {
+		return "recording"
+	}
+	return n.name
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, message notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, message)
+	return nil
+}
+
+func stubReminderStore(t *testing.T, body string) *[]reminder {
+	t.Helper()
+
+	originalInsert := insertReminder
+	originalBody := loadReminderMessageBody
+	t.Cleanup(func() {
+		insertReminder = originalInsert
+		loadReminderMessageBody = originalBody
+	})
+
+	created := make([]reminder, 0)
+	insertReminder = func(userID string, messageID int, remindAt time.Time) (reminder, error) {
+		if messageID != 1 {
+			return reminder{}, sql.ErrNoRows
+		}
+		r := reminder{ID: len(created) + 1, MessageID: messageID, RemindAt: remindAt, Status: reminderStatusPending}
+		created = append(created, r)
+		return r, nil
+	}
+	loadReminderMessageBody = func(messageID int, userID string) (string, error) {
+		if messageID != 1 {
+			return "", sql.ErrNoRows
+		}
+		return body, nil
+	}
+	return &created
+}
+
+func TestCreateReminderHandler(t *testing.T) {
+	stubReminderStore(t, "来週月曜に資料を提出")
+
+	router := chi.NewRouter()
+	router.Post("/api/messages/{id}/reminders", createReminderHandler)
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		status     int
+		parsedText string
+		errorBody  string
+	}{
+		{"text", "/api/messages/1/reminders?tz=Asia/Tokyo", `{"text":"明日10時"}`, http.StatusCreated, "明日10時", ""},
+		{"message body", "/api/messages/1/reminders?tz=Asia/Tokyo", "", http.StatusCreated, "来週月曜", ""},
+		{"explicit time", "/api/messages/1/reminders", `{"remind_at":"2999-01-01T00:00:00Z"}`, http.StatusCreated, "", ""},
+		{"past", "/api/messages/1/reminders", `{"remind_at":"2020-01-01T00:00:00Z"}`, http.StatusBadRequest, "", "remind_at must be in the future"},
+		{"unparseable", "/api/messages/1/reminders?tz=UTC", `{"text":"そのうち"}`, http.StatusBadRequest, "", "could not parse reminder time"},
+		{"both", "/api/messages/1/reminders", `{"remind_at":"2999-01-01T00:00:00Z","text":"明日"}`, http.StatusBadRequest, "", "remind_at and text cannot be combined"},
+		{"invalid tz", "/api/messages/1/reminders?tz=Mars/Base", `{"text":"明日"}`, http.StatusBadRequest, "", "invalid tz"},
+		{"missing message", "/api/messages/2/reminders?tz=UTC", "", http.StatusNotFound, "", "message not found"},
+		{"invalid id", "/api/messages/x/reminders", "", http.StatusBadRequest, "", "invalid message id"},
+	}
+	for _, tc := range cases {
+		request := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", tc.name, tc.status, recorder.Code, recorder.Body.String())
+		}
+		if tc.errorBody != "" {
+			if want := `{"error":"` + tc.errorBody + `"}` + "\n"; recorder.Body.String() != want {
+				t.Fatalf("%s: unexpected response body: %s", tc.name, strings.TrimSpace(recorder.Body.String()))
+			}
+			continue
+		}
+
+		var response struct {
+			RemindAt   time.Time `json:"remind_at"`
+			Status     string    `json:"status"`
+			ParsedText string    `json:"parsed_text"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tc.name, err)
+		}
+		if response.Status != reminderStatusPending || response.ParsedText != tc.parsedText || !response.RemindAt.After(time.Now()) {
+			t.Fatalf("%s: unexpected reminder: %+v", tc.name, response)
+		}
+	}
+}
+
+// claim / complete と配信済みの記録をメモリ上で再現する。claim 済みの行は再び返さない
+func stubReminderScheduler(t *testing.T, due []dueReminder, target notifier) map[int]string {
+	t.Helper()
+
+	originalClaim := claimDueReminders
+	originalComplete := completeReminder
+	originalLoadDeliveries := loadReminderDeliveries
+	originalRecordDelivery := recordReminderDelivery
+	originalNotifiers := notifiers
+	t.Cleanup(func() {
+		claimDueReminders = originalClaim
+		completeReminder = originalComplete
+		loadReminderDeliveries = originalLoadDeliveries
+		recordReminderDelivery = originalRecordDelivery
+		notifiers = originalNotifiers
+	})
+
+	statuses := make(map[int]string)
+	for _, r := range due {
+		statuses[r.ID] = reminderStatusPending
+	}
+	claimDueReminders = func(limit int) ([]dueReminder, error) {
+		claimed := make([]dueReminder, 0)
+		for _, r := range due {
+			if statuses[r.ID] == reminderStatusPending {
+				statuses[r.ID] = reminderStatusFiring
+				claimed = append(claimed, r)
+			}
+		}
+		return claimed, nil
+	}
+	completeReminder = func(reminderID int, status string, lastError string) error {
+		if statuses[reminderID] == reminderStatusFiring {
+			statuses[reminderID] = status
+		}
+		return nil
+	}
+	deliveries := make(map[int]map[string]bool)
+	loadReminderDeliveries = func(reminderID int) (map[string]bool, error) {
+		delivered := make(map[string]bool)
+		for name := range deliveries[reminderID] {
+			delivered[name] = true
+		}
+		return delivered, nil
+	}
+	recordReminderDelivery = func(r dueReminder, notifierName string) error {
+		if deliveries[r.ID] == nil {
+			deliveries[r.ID] = make(map[string]bool)
+		}
+		deliveries[r.ID][notifierName] = true
+		return nil
+	}
+	notifiers = []notifier{target}
+	return statuses
+}
+
+func TestFireDueReminders_DeliversOnce(t *testing.T) {
+	stubReminderStore(t, "明日10時に歯医者")
+	target := &recordingNotifier{}
+	statuses := stubReminderScheduler(t, []dueReminder{
+		{ID: 7, MessageID: 1, UserID: "user-1", Attempts: 1},
+		{ID: 8, MessageID: 2, UserID: "user-1", Attempts: 1},
+	}, target)
+
+	fireDueReminders()
+	fireDueReminders()
+
+	if len(target.sent) != 1 {
+		t.Fatalf("expected exactly one notification, got %+v", target.sent)
+	}
+	if sent := target.sent[0]; sent.Key != "reminder-7" || sent.Body != "明日10時に歯医者" || sent.UserID != "user-1" {
+		t.Fatalf("unexpected notification: %+v", sent)
+	}
+	if statuses[7] != reminderStatusSent {
+		t.Fatalf("expected reminder to be sent, got %q", statuses[7])
+	}
+	if statuses[8] != reminderStatusFailed {
+		t.Fatalf("expected reminder for deleted message to fail, got %q", statuses[8])
+	}
+}
+
+func TestFireReminder_RetriesUntilMaxAttempts(t *testing.T) {
+	stubReminderStore(t, "body")
+	statuses := stubReminderScheduler(t, nil, &recordingNotifier{err: errors.New("unavailable")})
+
+	statuses[1] = reminderStatusFiring
+	fireReminder(dueReminder{ID: 1, MessageID: 1, UserID: "user-1", Attempts: 1})
+	if statuses[1] != reminderStatusFiring {
+		t.Fatalf("expected failed delivery to stay firing for retry, got %q", statuses[1])
+	}
+
+	fireReminder(dueReminder{ID: 1, MessageID: 1, UserID: "user-1", Attempts: reminderMaxAttempts})
+	if statuses[1] != reminderStatusFailed {
+		t.Fatalf("expected reminder to fail after max attempts, got %q", statuses[1])
+	}
+}
+
+func TestDispatchNotification_RetriesOnlyFailedNotifiers(t *testing.T) {
+	originalNotifiers := notifiers
+	t.Cleanup(func() {
+		notifiers = originalNotifiers
+	})
+
+	flaky := &recordingNotifier{name: "flaky", err: errors.New("down")}
+	working := &recordingNotifier{name: "working"}
+	notifiers = []notifier{flaky, working}
+	delivered := make(map[string]bool)
+	markDelivered := func(name string) error {
+		delivered[name] = true
+		return nil
+	}
+	if err := dispatchNotification(context.Background(), notification{Key: "k"}, delivered, markDelivered); err == nil {
+		t.Fatalf("expected error so the failed notifier is retried")
+	}
+	if !delivered["working"] || delivered["flaky"] {
+		t.Fatalf("expected only the working notifier to be recorded, got %v", delivered)
+	}
+
+	flaky.err = nil
+	if err := dispatchNotification(context.Background(), notification{Key: "k"}, delivered, markDelivered); err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if len(flaky.sent) != 1 || len(working.sent) != 1 {
+		t.Fatalf("expected each notifier to deliver once, got %d and %d", len(flaky.sent), len(working.sent))
+	}
+
+	// 記録に失敗した通知先は届いていても失敗として扱い、再試行させる
+	err := dispatchNotification(context.Background(), notification{Key: "other"}, map[string]bool{}, func(name string) error {
+		return errors.New("db down")
+	})
+	if err == nil {
+		t.Fatalf("expected unrecorded delivery to be reported")
+	}
+}
+
+func TestFireReminder_SkipsNotifiersDeliveredBeforeCompletion(t *testing.T) {
+	stubReminderStore(t, "body")
+	target := &recordingNotifier{}
+	statuses := stubReminderScheduler(t, nil, target)
+
+	// 送った後に complete できなかった場合、lease 切れで取り直しても同じ通知は送らない
+	originalComplete := completeReminder
+	completeReminder = func(reminderID int, status string, lastError string) error {
+		return errors.New("connection lost")
+	}
+	statuses[1] = reminderStatusFiring
+	fireReminder(dueReminder{ID: 1, MessageID: 1, UserID: "user-1", Attempts: 1})
+
+	completeReminder = originalComplete
+	fireReminder(dueReminder{ID: 1, MessageID: 1, UserID: "user-1", Attempts: 2})
+
+	if len(target.sent) != 1 {
+		t.Fatalf("expected notification to be sent once, got %d", len(target.sent))
+	}
+	if statuses[1] != reminderStatusSent {
+		t.Fatalf("expected reminder to be sent, got %q", statuses[1])
+	}
+}
+
+func TestLogNotifier_OmitsBody(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	logNotifier{}.Notify(context.Background(), notification{UserID: "user-1", Key: "reminder-1", Title: "リマインダー", Body: "秘密のメモ"})
+
+	if logged := output.String(); !strings.Contains(logged, "key=reminder-1") || strings.Contains(logged, "秘密のメモ") {
+		t.Fatalf("unexpected log output: %q", logged)
+	}
+}
+
+func TestNewNotifiersFromEnv(t *testing.T) {
+	t.Setenv("NOTIFIERS", "log, mail,log")
+	configured, err := newNotifiersFromEnv()
+	if err != nil || len(configured) != 2 {
+		t.Fatalf("expected log and mail notifiers, got %v, %v", configured, err)
+	}
+
+	t.Setenv("NOTIFIERS", "pager")
+	if _, err := newNotifiersFromEnv(); err == nil {
+		t.Fatalf("expected unknown notifier to be rejected")
+	}
+}
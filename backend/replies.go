@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type messageThreadResponse struct {
+	Root    messageListItem   `json:"root"`
+	Replies []messageListItem `json:"replies"`
+}
+
+// スレッドは 1 階層だけ。返信への返信はその返信の親 (ルート) にぶら下げる
+var insertReply = func(parentID int, userID string, body string) (messageListItem, error) {
+	var message messageListItem
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		message, err = scanMessage(tx.QueryRow(
+			`INSERT INTO messages (user_id, body, parent_id, entities)
+			 SELECT $1, $2, COALESCE(parent.parent_id, parent.id), $4
+			 FROM messages parent
+			 WHERE parent.id = $3 AND parent.user_id = $1
+			 RETURNING `+messageColumns,
+			userID,
+			body,
+			parentID,
+			encodeEntities(body),
+		))
+		if err != nil {
+			return err
+		}
+		return saveMessageLinks(tx, userID, &message)
+	})
+	if err != nil {
+		return messageListItem{}, err
+	}
+
+	return message, nil
+}
+
+// id が返信ならそのルートのスレッドを返す
+var findMessageThread = func(id int, userID string) (messageThreadResponse, error) {
+	thread := messageThreadResponse{Replies: make([]messageListItem, 0)}
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var err error
+		thread.Root, err = scanMessage(tx.QueryRow(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE user_id = $2 AND id = (
+			   SELECT COALESCE(parent_id, id) FROM messages WHERE id = $1 AND user_id = $2
+			 )`,
+			id,
+			userID,
+		))
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(
+			`SELECT `+messageColumns+`
+			 FROM messages
+			 WHERE user_id = $1 AND parent_id = $2
+			 ORDER BY created_at ASC, id ASC`,
+			userID,
+			thread.Root.ID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			message, err := scanMessage(rows)
+			if err != nil {
+				return err
+			}
+			thread.Replies = append(thread.Replies, message)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return messageThreadResponse{}, err
+	}
+
+	return thread, nil
+}
+
+func createReplyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "id")
+	parentID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var req createMessageRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Body == "" {
+		writeError(w, http.StatusBadRequest, "body is required")
+		return
+	}
+
+	message, err := insertReply(parentID, userID, req.Body)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	enqueueLinkPreviews(message.Body)
+	enqueueMessageArchive(userID, message, false)
+
+	writeJSON(w, http.StatusCreated, message)
+}
+
+func getMessageThreadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	idParam := chi.URLParam(r, "id")
+	messageID, err := strconv.Atoi(idParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	thread, err := findMessageThread(messageID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "message not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, thread)
+}
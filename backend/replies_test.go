@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newReplyRouter() *chi.Mux {
+	router := chi.NewRouter()
+	router.Post("/api/messages/{id}/replies", createReplyHandler)
+	router.Get("/api/messages/{id}/thread", getMessageThreadHandler)
+	return router
+}
+
+func TestCreateReplyHandler_RejectsEmptyBody(t *testing.T) {
+	original := insertReply
+	t.Cleanup(func() {
+		insertReply = original
+	})
+
+	wasCalled := false
+	insertReply = func(parentID int, userID string, body string) (messageListItem, error) {
+		wasCalled = true
+		return messageListItem{}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/3/replies", strings.NewReader(`{"body":""}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	newReplyRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	if wasCalled {
+		t.Fatalf("insertReply should not be called for empty body")
+	}
+}
+
+func TestCreateReplyHandler_NotFoundForOtherUsersParent(t *testing.T) {
+	original := insertReply
+	t.Cleanup(func() {
+		insertReply = original
+	})
+
+	insertReply = func(parentID int, userID string, body string) (messageListItem, error) {
+		return messageListItem{}, sql.ErrNoRows
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/3/replies", strings.NewReader(`{"body":"update: bought it"}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	newReplyRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+
+	if body := recorder.Body.String(); body != "{\"error\":\"message not found\"}\n" {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestCreateReplyHandler_CreatesReply(t *testing.T) {
+	original := insertReply
+	t.Cleanup(func() {
+		insertReply = original
+	})
+
+	var gotParentID int
+	var gotBody string
+	insertReply = func(parentID int, userID string, body string) (messageListItem, error) {
+		gotParentID = parentID
+		gotBody = body
+		return messageListItem{
+			ID:        9,
+			Body:      body,
+			CreatedAt: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+			ParentID:  &parentID,
+		}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/messages/3/replies", strings.NewReader(`{"body":"update: bought it"}`))
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	newReplyRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+	}
+
+	if gotParentID != 3 || gotBody != "update: bought it" {
+		t.Fatalf("unexpected reply: parent=%d body=%q", gotParentID, gotBody)
+	}
+
+	expected := "{\"id\":9,\"body\":\"update: bought it\",\"created_at\":\"2026-03-10T12:00:00Z\",\"parent_id\":3}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestGetMessageThreadHandler_ReturnsRootAndReplies(t *testing.T) {
+	original := findMessageThread
+	t.Cleanup(func() {
+		findMessageThread = original
+	})
+
+	rootID := 3
+	findMessageThread = func(id int, userID string) (messageThreadResponse, error) {
+		return messageThreadResponse{
+			Root: messageListItem{ID: rootID, Body: "買うもの: 傘", CreatedAt: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), ReplyCount: 1},
+			Replies: []messageListItem{
+				{ID: id, Body: "買った", CreatedAt: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), ParentID: &rootID},
+			},
+		}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/9/thread", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	newReplyRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "{\"root\":{\"id\":3,\"body\":\"買うもの: 傘\",\"created_at\":\"2026-03-01T00:00:00Z\",\"reply_count\":1}," +
+		"\"replies\":[{\"id\":9,\"body\":\"買った\",\"created_at\":\"2026-03-02T00:00:00Z\",\"parent_id\":3}]}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestGetMessageThreadHandler_NotFound(t *testing.T) {
+	original := findMessageThread
+	t.Cleanup(func() {
+		findMessageThread = original
+	})
+
+	findMessageThread = func(id int, userID string) (messageThreadResponse, error) {
+		return messageThreadResponse{}, sql.ErrNoRows
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/messages/9/thread", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	newReplyRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Row Level Security のポリシーが参照する設定名。
+// SET LOCAL 相当 (set_config の第 3 引数 true) なのでトランザクション終了時に消える。
+const (
+	currentUserIDSetting    = "app.current_user_id"
+	sessionTokenHashSetting = "app.session_token_hash"
+	// リマインダーのスケジューラーが利用者をまたいで期限の来た行を取るときだけ使う
+	reminderSchedulerSetting = "app.reminder_scheduler"
+	// 起動時に処理待ちの画像を積み直すときだけ使う (processing の行を読むだけ)
+	imageSweepSetting = "app.image_sweep"
+)
+
+func withUserScope(userID string, fn func(tx *sql.Tx) error) error {
+	return withScopedTx(currentUserIDSetting, userID, fn)
+}
+
+func withSessionScope(tokenHash string, fn func(tx *sql.Tx) error) error {
+	return withScopedTx(sessionTokenHashSetting, tokenHash, fn)
+}
+
+func withReminderSchedulerScope(fn func(tx *sql.Tx) error) error {
+	return withScopedTx(reminderSchedulerSetting, "on", fn)
+}
+
+func withImageSweepScope(fn func(tx *sql.Tx) error) error {
+	return withScopedTx(imageSweepSetting, "on", fn)
+}
+
+func withScopedTx(setting string, value string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setScope(tx, setting, value); err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func setScope(tx *sql.Tx, setting string, value string) error {
+	_, err := tx.Exec("SELECT set_config($1, $2, true)", setting, value)
+	return err
+}
+
+type databaseRole struct {
+	Name      string
+	Superuser bool
+	BypassRLS bool
+}
+
+var findDatabaseRole = func() (databaseRole, error) {
+	var role databaseRole
+	err := db.QueryRow(
+		"SELECT rolname, rolsuper, rolbypassrls FROM pg_roles WHERE rolname = current_user",
+	).Scan(&role.Name, &role.Superuser, &role.BypassRLS)
+	return role, err
+}
+
+// superuser と BYPASSRLS のロールにはポリシーが効かないので、そのロールでは起動しない。
+// ALLOW_RLS_BYPASS=true なら警告だけ出して続ける (マイグレーション作業用)
+func checkDatabaseRole() error {
+	role, err := findDatabaseRole()
+	if err != nil {
+		return err
+	}
+	if !role.Superuser && !role.BypassRLS {
+		return nil
+	}
+
+	err = fmt.Errorf(
+		"database role %s bypasses row level security (superuser=%t, bypassrls=%t); connect as a role such as futto_app",
+		role.Name, role.Superuser, role.BypassRLS,
+	)
+	if os.Getenv("ALLOW_RLS_BYPASS") == "true" {
+		log.Printf("WARNING: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 実際の PostgreSQL に対して RLS ポリシーを検証する。
+// TEST_DATABASE_URL には init.sql を適用したデータベースへ、superuser ではないロール (futto_app など) で接続する DSN を指定する。
+func openRLSTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		// CI では DB を用意しているので、設定漏れで黙ってスキップしない
+		if os.Getenv("CI") != "" {
+			t.Fatal("TEST_DATABASE_URL is required in CI")
+		}
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("failed to connect database: %v", err)
+	}
+
+	originalDB := db
+	db = conn
+	t.Cleanup(func() {
+		db = originalDB
+		conn.Close()
+	})
+}
+
+func createRLSTestUser(t *testing.T, prefix string) string {
+	t.Helper()
+
+	suffix, err := generateSessionToken()
+	if err != nil {
+		t.Fatalf("failed to generate username suffix: %v", err)
+	}
+	username := prefix + "-" + suffix[:12]
+
+	var userID string
+	if err := db.QueryRow(
+		"INSERT INTO users (username, password_hash) VALUES ($1, '!') RETURNING id",
+		username,
+	).Scan(&userID); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM users WHERE id = $1", userID)
+	})
+	return userID
+}
+
+func TestRowLevelSecurity_TestRoleDoesNotBypassPolicies(t *testing.T) {
+	openRLSTestDB(t)
+
+	if err := checkDatabaseRole(); err != nil {
+		t.Fatalf("expected the test role to be subject to RLS: %v", err)
+	}
+}
+
+func TestCheckDatabaseRole_RefusesRolesThatBypassRLS(t *testing.T) {
+	original := findDatabaseRole
+	t.Cleanup(func() {
+		findDatabaseRole = original
+	})
+
+	for _, role := range []databaseRole{
+		{Name: "futto", Superuser: true},
+		{Name: "migrator", BypassRLS: true},
+	} {
+		findDatabaseRole = func() (databaseRole, error) {
+			return role, nil
+		}
+		t.Setenv("ALLOW_RLS_BYPASS", "")
+		if err := checkDatabaseRole(); err == nil {
+			t.Fatalf("expected role %+v to be refused", role)
+		}
+		t.Setenv("ALLOW_RLS_BYPASS", "true")
+		if err := checkDatabaseRole(); err != nil {
+			t.Fatalf("expected ALLOW_RLS_BYPASS to only warn, got %v", err)
+		}
+	}
+
+	findDatabaseRole = func() (databaseRole, error) {
+		return databaseRole{Name: "futto_app"}, nil
+	}
+	t.Setenv("ALLOW_RLS_BYPASS", "")
+	if err := checkDatabaseRole(); err != nil {
+		t.Fatalf("expected futto_app to be accepted, got %v", err)
+	}
+}
+
+func TestRowLevelSecurity_HidesOtherUsersMessagesWithoutFilter(t *testing.T) {
+	openRLSTestDB(t)
+
+	alice := createRLSTestUser(t, "rls-alice")
+	bob := createRLSTestUser(t, "rls-bob")
+
+	if _, err := insertMessage(alice, "alice のメモ"); err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+	if _, err := insertMessage(bob, "bob のメモ"); err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+
+	// user_id 条件を付け忘れたクエリでも自分の行しか見えない
+	var bodies []string
+	err := withUserScope(alice, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT body FROM messages")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var body string
+			if err := rows.Scan(&body); err != nil {
+				return err
+			}
+			bodies = append(bodies, body)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("failed to query messages: %v", err)
+	}
+
+	if len(bodies) != 1 || bodies[0] != "alice のメモ" {
+		t.Fatalf("expected only alice's message, got %v", bodies)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no rows without user scope, got %d", count)
+	}
+}
+
+func TestRowLevelSecurity_RejectsWritesForOtherUsers(t *testing.T) {
+	openRLSTestDB(t)
+
+	alice := createRLSTestUser(t, "rls-alice")
+	bob := createRLSTestUser(t, "rls-bob")
+
+	err := withUserScope(alice, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO messages (user_id, body) VALUES ($1, 'spoofed')", bob)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("expected insert for another user to be rejected")
+	}
+
+	message, err := insertMessage(bob, "bob のメモ")
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+
+	var rowsAffected int64
+	err = withUserScope(alice, func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM messages WHERE id = $1", message.ID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to run delete: %v", err)
+	}
+	if rowsAffected != 0 {
+		t.Fatalf("expected delete of another user's message to affect no rows, got %d", rowsAffected)
+	}
+}
+
+func TestRowLevelSecurity_SessionLookupSeesOnlyMatchingToken(t *testing.T) {
+	openRLSTestDB(t)
+
+	alice := createRLSTestUser(t, "rls-alice")
+	bob := createRLSTestUser(t, "rls-bob")
+
+	if err := insertSession(hashSessionToken("alice-token"), alice, time.Now().Add(sessionDuration())); err != nil {
+		t.Fatalf("failed to insert session: %v", err)
+	}
+	if err := insertSession(hashSessionToken("bob-token"), bob, time.Now().Add(sessionDuration())); err != nil {
+		t.Fatalf("failed to insert session: %v", err)
+	}
+
+	var count int
+	err := withSessionScope(hashSessionToken("alice-token"), func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count)
+	})
+	if err != nil {
+		t.Fatalf("failed to count sessions: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected only the matching session to be visible, got %d", count)
+	}
+
+	userID, err := findActiveSessionUserID("bob-token")
+	if err != nil || userID != bob {
+		t.Fatalf("expected bob's session to resolve, got %s (%v)", userID, err)
+	}
+}
+
+func TestImportMessages_SavesLinksLikeCreateMessage(t *testing.T) {
+	openRLSTestDB(t)
+
+	alice := createRLSTestUser(t, "rls-import")
+	createdAt := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	report, err := importMessages(alice, func(emit func(importedMessage) error) error {
+		for _, body := range []string{"https://example.com/a を読む #あとで", "リンクなし"} {
+			if err := emit(importedMessage{Item: body, Body: body, CreatedAt: createdAt}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || report.Imported != 2 {
+		t.Fatalf("unexpected import result: %+v, %v", report, err)
+	}
+
+	var links []string
+	var entities int
+	err = withUserScope(alice, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT l.url FROM message_links l JOIN messages m ON m.id = l.message_id
+			 WHERE m.user_id = $1 ORDER BY l.position`,
+			alice,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var link string
+			if err := rows.Scan(&link); err != nil {
+				return err
+			}
+			links = append(links, link)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return tx.QueryRow(
+			"SELECT COUNT(*) FROM messages WHERE user_id = $1 AND entities IS NOT NULL",
+			alice,
+		).Scan(&entities)
+	})
+	if err != nil {
+		t.Fatalf("failed to read imported messages: %v", err)
+	}
+	if len(links) != 1 || links[0] != "https://example.com/a" || entities != 2 {
+		t.Fatalf("expected links and entities for imported messages, got %v / %d", links, entities)
+	}
+}
+
+func TestRegisterUser_ChecksInviteBeforeUsername(t *testing.T) {
+	openRLSTestDB(t)
+
+	userID := createRLSTestUser(t, "taken")
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+		t.Fatalf("failed to load username: %v", err)
+	}
+
+	// 招待コードが無効なら、ユーザー名が使われているかどうかは答えない
+	if _, err := registerUser(hashSessionToken("no-such-invite"), username, "!"); !errors.Is(err, errInvalidInvite) {
+		t.Fatalf("expected invalid invite error, got %v", err)
+	}
+
+	code, err := generateSessionToken()
+	if err != nil {
+		t.Fatalf("failed to generate invite code: %v", err)
+	}
+	if err := insertInvite(hashSessionToken(code), userID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM invites WHERE code_hash = $1", hashSessionToken(code))
+	})
+	if _, err := registerUser(hashSessionToken(code), username, "!"); !errors.Is(err, errUsernameTaken) {
+		t.Fatalf("expected username taken error with a valid invite, got %v", err)
+	}
+
+	created, err := registerUser(hashSessionToken(code), username+"-new", "!")
+	if err != nil {
+		t.Fatalf("failed to register with invite: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM users WHERE id = $1", created.ID)
+	})
+	if _, err := registerUser(hashSessionToken(code), username+"-again", "!"); !errors.Is(err, errInvalidInvite) {
+		t.Fatalf("expected used invite to be rejected, got %v", err)
+	}
+}
+
+func TestInsertOIDCLoginState_RemovesExpiredStates(t *testing.T) {
+	openRLSTestDB(t)
+
+	expired := hashSessionToken("expired-" + time.Now().String())
+	if _, err := db.Exec(
+		`INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+		 VALUES ($1, 'test', 'nonce', 'verifier', NOW() - INTERVAL '1 minute')`,
+		expired,
+	); err != nil {
+		t.Fatalf("failed to insert expired state: %v", err)
+	}
+
+	current := hashSessionToken("current-" + time.Now().String())
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM oidc_login_states WHERE state_hash IN ($1, $2)", expired, current)
+	})
+	if err := insertOIDCLoginState(oidcLoginState{
+		StateHash:    current,
+		Provider:     "test",
+		Nonce:        "nonce",
+		CodeVerifier: "verifier",
+		ExpiresAt:    time.Now().Add(time.Minute),
+	}); err != nil {
+		t.Fatalf("failed to insert state: %v", err)
+	}
+
+	var remaining int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM oidc_login_states WHERE state_hash IN ($1, $2)",
+		expired, current,
+	).Scan(&remaining); err != nil {
+		t.Fatalf("failed to count states: %v", err)
+	}
+	if remaining != 1 {
+		t.Fatalf("expected only the new state to remain, got %d rows", remaining)
+	}
+}
+
+func TestMergeSettingOverrides_KeepsConcurrentUpdates(t *testing.T) {
+	openRLSTestDB(t)
+	userID := createRLSTestUser(t, "settings")
+
+	if _, err := mergeSettingOverrides(userID, map[string]json.RawMessage{"locale": json.RawMessage(`"en-US"`)}, nil); err != nil {
+		t.Fatalf("failed to merge settings: %v", err)
+	}
+
+	// 別々のキーを同時に更新しても、どちらも残る
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, set := range []map[string]json.RawMessage{
+		{"timezone": json.RawMessage(`"UTC"`)},
+		{"page_size": json.RawMessage(`100`)},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mergeSettingOverrides(userID, set, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to merge settings: %v", err)
+		}
+	}
+
+	overrides, err := mergeSettingOverrides(userID, nil, []string{"locale"})
+	if err != nil {
+		t.Fatalf("failed to remove setting: %v", err)
+	}
+	settings := resolveUserSettings(overrides)
+	if len(overrides) != 2 || settings.Timezone != "UTC" || settings.PageSize != 100 || settings.Locale != "ja-JP" {
+		t.Fatalf("unexpected overrides: %v", overrides)
+	}
+}
+
+func TestImportMessages_CommitsInBatchesAndCountsDuplicatesAcrossThem(t *testing.T) {
+	openRLSTestDB(t)
+
+	alice := createRLSTestUser(t, "rls-import-batch")
+	base := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	report, err := importMessages(alice, func(emit func(importedMessage) error) error {
+		for i := range importBatchSize + 1 {
+			body := fmt.Sprintf("メモ %d", i)
+			if err := emit(importedMessage{Item: body, Body: body, CreatedAt: base.Add(time.Duration(i) * time.Minute)}); err != nil {
+				return err
+			}
+		}
+		// 最初のバッチで取り込んだものと同じ内容
+		return emit(importedMessage{Item: "again", Body: "メモ 0", CreatedAt: base})
+	})
+	if err != nil || report.Imported != importBatchSize+1 || report.Duplicates != 1 {
+		t.Fatalf("unexpected import result: %+v, %v", report, err)
+	}
+}
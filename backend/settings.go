@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	minPageSize = 10
+	maxPageSize = 500
+)
+
+var supportedLocales = []string{"ja-JP", "en-US"}
+
+var supportedDateSeparatorFormats = []string{"yyyy/MM/dd", "yyyy-MM-dd", "MM/dd/yyyy", "dd/MM/yyyy"}
+
+type userSettings struct {
+	Timezone            string `json:"timezone"`
+	Locale              string `json:"locale"`
+	PageSize            int    `json:"page_size"`
+	DateSeparatorFormat string `json:"date_separator_format"`
+	// 本文中のリンク先を自動でアーカイブする (オプトイン)
+	ArchiveLinks bool `json:"archive_links"`
+}
+
+type settingsResponse struct {
+	Settings userSettings `json:"settings"`
+}
+
+type meResponse struct {
+	User     user         `json:"user"`
+	Settings userSettings `json:"settings"`
+}
+
+// 各キーの検証は userSettings へ値を書き込む。保存するのは既定値からの差分だけ
+var settingDefinitions = map[string]func(raw json.RawMessage, settings *userSettings) error{
+	"timezone": func(raw json.RawMessage, settings *userSettings) error {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return errors.New("timezone must be a string")
+		}
+		if _, err := loadTimezone(value); err != nil {
+			return fmt.Errorf("unknown timezone: %s", value)
+		}
+		settings.Timezone = value
+		return nil
+	},
+	"locale": func(raw json.RawMessage, settings *userSettings) error {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil || !slices.Contains(supportedLocales, value) {
+			return fmt.Errorf("locale must be one of %v", supportedLocales)
+		}
+		settings.Locale = value
+		return nil
+	},
+	"page_size": func(raw json.RawMessage, settings *userSettings) error {
+		var value int
+		if err := json.Unmarshal(raw, &value); err != nil || value < minPageSize || value > maxPageSize {
+			return fmt.Errorf("page_size must be an integer between %d and %d", minPageSize, maxPageSize)
+		}
+		settings.PageSize = value
+		return nil
+	},
+	"date_separator_format": func(raw json.RawMessage, settings *userSettings) error {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil || !slices.Contains(supportedDateSeparatorFormats, value) {
+			return fmt.Errorf("date_separator_format must be one of %v", supportedDateSeparatorFormats)
+		}
+		settings.DateSeparatorFormat = value
+		return nil
+	},
+	"archive_links": func(raw json.RawMessage, settings *userSettings) error {
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return errors.New("archive_links must be a boolean")
+		}
+		settings.ArchiveLinks = value
+		return nil
+	},
+}
+
+func defaultUserSettings() userSettings {
+	return userSettings{
+		Timezone:            "Asia/Tokyo",
+		Locale:              "ja-JP",
+		PageSize:            50,
+		DateSeparatorFormat: "yyyy/MM/dd",
+	}
+}
+
+var loadSettingOverrides = func(userID string) (map[string]json.RawMessage, error) {
+	overrides := map[string]json.RawMessage{}
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		var raw []byte
+		err := tx.QueryRow(
+			"SELECT settings FROM user_settings WHERE user_id = $1",
+			userID,
+		).Scan(&raw)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		return json.Unmarshal(raw, &overrides)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// 読み込んでから書き戻すと同時の更新が片方消えるので、1 つの文で差分を合わせる
+var mergeSettingOverrides = func(userID string, set map[string]json.RawMessage, removed []string) (map[string]json.RawMessage, error) {
+	if set == nil {
+		set = map[string]json.RawMessage{}
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+	encoded, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]json.RawMessage{}
+	err = withUserScope(userID, func(tx *sql.Tx) error {
+		var raw []byte
+		err := tx.QueryRow(
+			`INSERT INTO user_settings (user_id, settings, updated_at)
+			 VALUES ($1, $2::jsonb - $3::text[], NOW())
+			 ON CONFLICT (user_id) DO UPDATE
+			 SET settings = (user_settings.settings || $2::jsonb) - $3::text[], updated_at = NOW()
+			 RETURNING settings`,
+			userID, string(encoded), pq.Array(removed),
+		).Scan(&raw)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, &overrides)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// 保存済みの値が後から不正になった場合（キーの廃止など）は既定値に戻す
+func resolveUserSettings(overrides map[string]json.RawMessage) userSettings {
+	settings := defaultUserSettings()
+	for key, raw := range overrides {
+		apply, ok := settingDefinitions[key]
+		if !ok {
+			continue
+		}
+		candidate := settings
+		if err := apply(raw, &candidate); err == nil {
+			settings = candidate
+		}
+	}
+	return settings
+}
+
+func getUserSettings(userID string) (userSettings, error) {
+	overrides, err := loadSettingOverrides(userID)
+	if err != nil {
+		return userSettings{}, err
+	}
+	return resolveUserSettings(overrides), nil
+}
+
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown timezone: %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+func (s userSettings) location() *time.Location {
+	location, err := loadTimezone(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+var dateSeparatorLayoutReplacer = strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02")
+
+// タイムラインの日付区切りと同じ表記で日付を整形する
+func (s userSettings) formatSeparatorDate(t time.Time) string {
+	return t.Format(dateSeparatorLayoutReplacer.Replace(s.DateSeparatorFormat))
+}
+
+func getSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	settings, err := getUserSettings(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settingsResponse{Settings: settings})
+}
+
+// null を指定したキーは既定値に戻す
+func patchSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	keys := make([]string, 0, len(patch))
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	set := map[string]json.RawMessage{}
+	removed := make([]string, 0)
+	validated := defaultUserSettings()
+	for _, key := range keys {
+		apply, ok := settingDefinitions[key]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "unknown setting: "+key)
+			return
+		}
+
+		raw := patch[key]
+		if string(raw) == "null" {
+			removed = append(removed, key)
+			continue
+		}
+
+		if err := apply(raw, &validated); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		set[key] = raw
+	}
+
+	overrides, err := mergeSettingOverrides(userID, set, removed)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settingsResponse{Settings: resolveUserSettings(overrides)})
+}
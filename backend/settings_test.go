@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func stubSettingsStorage(t *testing.T, initial map[string]json.RawMessage) *map[string]json.RawMessage {
+	t.Helper()
+
+	originalLoad := loadSettingOverrides
+	originalMerge := mergeSettingOverrides
+	t.Cleanup(func() {
+		loadSettingOverrides = originalLoad
+		mergeSettingOverrides = originalMerge
+	})
+
+	stored := &initial
+	copyStored := func() map[string]json.RawMessage {
+		copied := map[string]json.RawMessage{}
+		for key, value := range *stored {
+			copied[key] = value
+		}
+		return copied
+	}
+	loadSettingOverrides = func(userID string) (map[string]json.RawMessage, error) {
+		return copyStored(), nil
+	}
+	mergeSettingOverrides = func(userID string, set map[string]json.RawMessage, removed []string) (map[string]json.RawMessage, error) {
+		merged := copyStored()
+		for key, value := range set {
+			merged[key] = value
+		}
+		for _, key := range removed {
+			delete(merged, key)
+		}
+		*stored = merged
+		return copyStored(), nil
+	}
+	return stored
+}
+
+func TestGetSettingsHandler_ReturnsDefaults(t *testing.T) {
+	stubSettingsStorage(t, map[string]json.RawMessage{})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/me/settings", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	getSettingsHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	expected := "{\"settings\":{\"timezone\":\"Asia/Tokyo\",\"locale\":\"ja-JP\",\"page_size\":50,\"date_separator_format\":\"yyyy/MM/dd\",\"archive_links\":false}}\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Fatalf("unexpected response body: %s", body)
+	}
+}
+
+func TestPatchSettingsHandler_StoresOnlyOverrides(t *testing.T) {
+	stored := stubSettingsStorage(t, map[string]json.RawMessage{"locale": json.RawMessage(`"en-US"`)})
+
+	request := httptest.NewRequest(
+		http.MethodPatch,
+		"/api/me/settings",
+		strings.NewReader(`{"timezone":"America/New_York","page_size":100,"locale":null}`),
+	)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	patchSettingsHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	var response settingsResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.Settings.Timezone != "America/New_York" || response.Settings.PageSize != 100 || response.Settings.Locale != "ja-JP" {
+		t.Fatalf("unexpected settings: %+v", response.Settings)
+	}
+
+	if _, ok := (*stored)["locale"]; ok {
+		t.Fatalf("expected locale override to be removed, got %v", *stored)
+	}
+
+	if len(*stored) != 2 {
+		t.Fatalf("expected 2 stored overrides, got %v", *stored)
+	}
+}
+
+func TestPatchSettingsHandler_RejectsInvalidValues(t *testing.T) {
+	cases := map[string]string{
+		`{"theme":"dark"}`:                   "{\"error\":\"unknown setting: theme\"}\n",
+		`{"timezone":"Mars/Olympus"}`:        "{\"error\":\"unknown timezone: Mars/Olympus\"}\n",
+		`{"page_size":5}`:                    "{\"error\":\"page_size must be an integer between 10 and 500\"}\n",
+		`{"date_separator_format":"yy.M.d"}`: "{\"error\":\"date_separator_format must be one of [yyyy/MM/dd yyyy-MM-dd MM/dd/yyyy dd/MM/yyyy]\"}\n",
+	}
+
+	for payload, expected := range cases {
+		stored := stubSettingsStorage(t, map[string]json.RawMessage{})
+
+		request := httptest.NewRequest(http.MethodPatch, "/api/me/settings", strings.NewReader(payload))
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		patchSettingsHandler(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", payload, http.StatusBadRequest, recorder.Code)
+		}
+
+		if body := recorder.Body.String(); body != expected {
+			t.Fatalf("%s: unexpected response body: %s", payload, body)
+		}
+
+		if len(*stored) != 0 {
+			t.Fatalf("%s: expected nothing to be stored, got %v", payload, *stored)
+		}
+	}
+}
+
+func TestResolveUserSettings_IgnoresInvalidStoredValues(t *testing.T) {
+	settings := resolveUserSettings(map[string]json.RawMessage{
+		"timezone":  json.RawMessage(`"Invalid/Zone"`),
+		"page_size": json.RawMessage(`30`),
+		"obsolete":  json.RawMessage(`true`),
+	})
+
+	if settings.Timezone != "Asia/Tokyo" || settings.PageSize != 30 {
+		t.Fatalf("unexpected settings: %+v", settings)
+	}
+}
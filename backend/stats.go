@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultStatsRangeDays = 365
+	maxStatsRangeDays     = 366 * 3
+)
+
+type dailyMessageStat struct {
+	Date        string
+	Count       int
+	TotalLength int
+}
+
+type statsDay struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+type statsHour struct {
+	Hour  int `json:"hour"`
+	Count int `json:"count"`
+}
+
+type statsResponse struct {
+	Timezone      string      `json:"timezone"`
+	From          string      `json:"from"`
+	To            string      `json:"to"`
+	Days          []statsDay  `json:"days"`
+	TotalMessages int         `json:"total_messages"`
+	ActiveDays    int         `json:"active_days"`
+	AverageLength float64     `json:"average_length"`
+	CurrentStreak int         `json:"current_streak"`
+	LongestStreak int         `json:"longest_streak"`
+	BusiestHours  []statsHour `json:"busiest_hours"`
+}
+
+// 全期間の日別集計を返す。連続記録は期間指定に関係なく全履歴から求めるため
+var listDailyMessageStats = func(userID string, timezone string) ([]dailyMessageStat, error) {
+	stats := make([]dailyMessageStat, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT to_char((created_at AT TIME ZONE $2)::date, 'YYYY-MM-DD') AS day,
+			        COUNT(*),
+			        COALESCE(SUM(char_length(body)), 0)
+			 FROM messages
+			 WHERE user_id = $1
+			 GROUP BY day
+			 ORDER BY day ASC`,
+			userID, timezone,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var stat dailyMessageStat
+			if err := rows.Scan(&stat.Date, &stat.Count, &stat.TotalLength); err != nil {
+				return err
+			}
+			stats = append(stats, stat)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+var countMessagesByHour = func(userID string, timezone string, from time.Time, to time.Time) ([24]int, error) {
+	var counts [24]int
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT EXTRACT(HOUR FROM created_at AT TIME ZONE $2)::int AS hour, COUNT(*)
+			 FROM messages
+			 WHERE user_id = $1 AND created_at >= $3 AND created_at < $4
+			 GROUP BY hour`,
+			userID, timezone, from, to,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hour, count int
+			if err := rows.Scan(&hour, &count); err != nil {
+				return err
+			}
+			if hour >= 0 && hour < 24 {
+				counts[hour] = count
+			}
+		}
+		return rows.Err()
+	})
+	return counts, err
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	query := r.URL.Query()
+	location, status := resolveRequestLocation(userID, query.Get("tz"))
+	if status == http.StatusBadRequest {
+		writeError(w, http.StatusBadRequest, "invalid tz")
+		return
+	}
+	if status != http.StatusOK {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	now := time.Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	to := today
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.ParseInLocation(time.DateOnly, value, location)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to")
+			return
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -(defaultStatsRangeDays - 1))
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.ParseInLocation(time.DateOnly, value, location)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from")
+			return
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	if daysBetween(from, to)+1 > maxStatsRangeDays {
+		writeError(w, http.StatusBadRequest, "date range is too large")
+		return
+	}
+
+	daily, err := listDailyMessageStats(userID, location.String())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	hours, err := countMessagesByHour(userID, location.String(), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	response := buildStats(daily, hours, from, to, today)
+	response.Timezone = location.String()
+	writeJSON(w, http.StatusOK, response)
+}
+
+func buildStats(daily []dailyMessageStat, hours [24]int, from time.Time, to time.Time, today time.Time) statsResponse {
+	byDate := make(map[string]dailyMessageStat, len(daily))
+	for _, stat := range daily {
+		byDate[stat.Date] = stat
+	}
+
+	response := statsResponse{
+		From:         from.Format(time.DateOnly),
+		To:           to.Format(time.DateOnly),
+		Days:         make([]statsDay, 0, daysBetween(from, to)+1),
+		BusiestHours: make([]statsHour, 0, 24),
+	}
+
+	totalLength := 0
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		stat := byDate[date]
+		response.Days = append(response.Days, statsDay{Date: date, Count: stat.Count})
+
+		response.TotalMessages += stat.Count
+		totalLength += stat.TotalLength
+		if stat.Count > 0 {
+			response.ActiveDays++
+		}
+	}
+
+	if response.TotalMessages > 0 {
+		response.AverageLength = float64(totalLength) / float64(response.TotalMessages)
+	}
+
+	response.CurrentStreak, response.LongestStreak = computeStreaks(daily, today)
+
+	for hour, count := range hours {
+		response.BusiestHours = append(response.BusiestHours, statsHour{Hour: hour, Count: count})
+	}
+
+	return response
+}
+
+// daily は日付昇順。今日まだ書いていなくても昨日まで続いていれば継続中とみなす
+func computeStreaks(daily []dailyMessageStat, today time.Time) (int, int) {
+	longest := 0
+	run := 0
+	var previous time.Time
+	for _, stat := range daily {
+		date, err := time.ParseInLocation(time.DateOnly, stat.Date, today.Location())
+		if err != nil || stat.Count == 0 {
+			continue
+		}
+
+		if run > 0 && daysBetween(previous, date) == 1 {
+			run++
+		} else {
+			run = 1
+		}
+		previous = date
+		longest = max(longest, run)
+	}
+
+	if run == 0 {
+		return 0, longest
+	}
+
+	gap := daysBetween(previous, today)
+	if gap == 0 || gap == 1 {
+		return run, longest
+	}
+	return 0, longest
+}
+
+// 夏時間で 1 日の長さが変わっても暦日の差を返す
+func daysBetween(from time.Time, to time.Time) int {
+	fromUTC := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toUTC := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toUTC.Sub(fromUTC).Hours() / 24)
+}
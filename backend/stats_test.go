@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComputeStreaks(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load location: %v", err)
+	}
+	today := time.Date(2026, 2, 10, 0, 0, 0, 0, tokyo)
+
+	daily := []dailyMessageStat{
+		{Date: "2026-01-01", Count: 1},
+		{Date: "2026-01-02", Count: 2},
+		{Date: "2026-01-03", Count: 1},
+		{Date: "2026-01-04", Count: 1},
+		{Date: "2026-02-08", Count: 1},
+		{Date: "2026-02-09", Count: 3},
+	}
+
+	current, longest := computeStreaks(daily, today)
+	if current != 2 || longest != 4 {
+		t.Fatalf("expected current=2 longest=4, got current=%d longest=%d", current, longest)
+	}
+
+	current, _ = computeStreaks(daily, today.AddDate(0, 0, 1))
+	if current != 0 {
+		t.Fatalf("expected streak to be broken after a missed day, got %d", current)
+	}
+}
+
+func TestBuildStats_FillsEmptyDaysAndAverages(t *testing.T) {
+	from := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 2, 3, 0, 0, 0, 0, time.UTC)
+
+	var hours [24]int
+	hours[9] = 2
+	hours[22] = 1
+
+	stats := buildStats([]dailyMessageStat{
+		{Date: "2026-01-31", Count: 5, TotalLength: 500},
+		{Date: "2026-02-01", Count: 2, TotalLength: 30},
+		{Date: "2026-02-03", Count: 1, TotalLength: 15},
+	}, hours, from, to, to)
+
+	if len(stats.Days) != 3 || stats.Days[1].Date != "2026-02-02" || stats.Days[1].Count != 0 {
+		t.Fatalf("unexpected days: %+v", stats.Days)
+	}
+
+	if stats.TotalMessages != 3 || stats.ActiveDays != 2 {
+		t.Fatalf("expected total=3 active=2, got total=%d active=%d", stats.TotalMessages, stats.ActiveDays)
+	}
+
+	if stats.AverageLength != 15 {
+		t.Fatalf("expected average length 15, got %f", stats.AverageLength)
+	}
+
+	if len(stats.BusiestHours) != 24 || stats.BusiestHours[9].Count != 2 {
+		t.Fatalf("unexpected busiest hours: %+v", stats.BusiestHours)
+	}
+}
+
+func TestStatsHandler_UsesRequestedRangeAndTimezone(t *testing.T) {
+	originalDaily := listDailyMessageStats
+	originalHours := countMessagesByHour
+	t.Cleanup(func() {
+		listDailyMessageStats = originalDaily
+		countMessagesByHour = originalHours
+	})
+
+	gotTimezone := ""
+	listDailyMessageStats = func(userID string, timezone string) ([]dailyMessageStat, error) {
+		gotTimezone = timezone
+		return []dailyMessageStat{{Date: "2026-02-09", Count: 4, TotalLength: 40}}, nil
+	}
+	var gotFrom, gotTo time.Time
+	countMessagesByHour = func(userID string, timezone string, from time.Time, to time.Time) ([24]int, error) {
+		gotFrom = from
+		gotTo = to
+		return [24]int{}, nil
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/stats?from=2026-02-01&to=2026-02-28&tz=Asia/Tokyo", nil)
+	request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+	recorder := httptest.NewRecorder()
+	statsHandler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	if gotTimezone != "Asia/Tokyo" {
+		t.Fatalf("expected timezone Asia/Tokyo, got %s", gotTimezone)
+	}
+
+	// 2026-02-01 00:00 JST = 2026-01-31 15:00 UTC
+	if !gotFrom.Equal(time.Date(2026, 1, 31, 15, 0, 0, 0, time.UTC)) || !gotTo.Equal(time.Date(2026, 2, 28, 15, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected hour range: %s - %s", gotFrom, gotTo)
+	}
+
+	var response statsResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if len(response.Days) != 28 || response.TotalMessages != 4 || response.AverageLength != 10 {
+		t.Fatalf("unexpected stats: days=%d total=%d average=%f", len(response.Days), response.TotalMessages, response.AverageLength)
+	}
+}
+
+func TestStatsHandler_RejectsInvalidRange(t *testing.T) {
+	cases := map[string]string{
+		"/api/stats?from=2026-03-01&to=2026-02-01&tz=UTC": "{\"error\":\"from must not be after to\"}\n",
+		"/api/stats?from=2020-01-01&to=2026-02-01&tz=UTC": "{\"error\":\"date range is too large\"}\n",
+		"/api/stats?from=yesterday&tz=UTC":                "{\"error\":\"invalid from\"}\n",
+	}
+
+	for target, expected := range cases {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request = request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+		recorder := httptest.NewRecorder()
+		statsHandler(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", target, http.StatusBadRequest, recorder.Code)
+		}
+
+		if body := recorder.Body.String(); body != expected {
+			t.Fatalf("%s: unexpected response body: %s", target, body)
+		}
+	}
+}
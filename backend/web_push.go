@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"futto-note/backend/webfetch"
+	"futto-note/backend/webpush"
+)
+
+const (
+	webPushTimeout           = 10 * time.Second
+	webPushTTL               = 24 * time.Hour
+	maxPushEndpointBytes     = 2048
+	vapidKeyRowID            = 1
+	webPushNotificationTitle = 120
+)
+
+// nil なら Web Push は無効 (WEB_PUSH_SUBJECT が未設定)
+var webPushSender *webpush.Sender
+
+var errWebPushDisabled = errors.New("web push is not configured")
+
+type pushSubscriptionKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// ブラウザの PushSubscription.toJSON() をそのまま受け取る。expirationTime は使わない
+type pushSubscriptionRequest struct {
+	Endpoint       string               `json:"endpoint"`
+	ExpirationTime *int64               `json:"expirationTime"`
+	Keys           pushSubscriptionKeys `json:"keys"`
+}
+
+type vapidPublicKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+type pushSubscription struct {
+	ID       int
+	Endpoint string
+	P256dh   string
+	Auth     string
+}
+
+func (s pushSubscription) webpush() webpush.Subscription {
+	return webpush.Subscription{Endpoint: s.Endpoint, P256dh: s.P256dh, Auth: s.Auth}
+}
+
+// フロントエンドの Service Worker が通知として表示する内容
+type webPushPayload struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Tag       string `json:"tag,omitempty"`
+	MessageID int    `json:"message_id,omitempty"`
+}
+
+// WEB_PUSH_SUBJECT (mailto: か https: の連絡先) を設定すると有効になる。
+// 鍵は VAPID_PRIVATE_KEY があればそれを使い、なければ DB に保存した鍵を使う (初回に生成する)
+func newWebPushSenderFromEnv() (*webpush.Sender, error) {
+	subject := os.Getenv("WEB_PUSH_SUBJECT")
+	if subject == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, fmt.Errorf("WEB_PUSH_SUBJECT must be a mailto: or https: URL")
+	}
+
+	var keys *webpush.VAPIDKeys
+	var err error
+	if value := os.Getenv("VAPID_PRIVATE_KEY"); value != "" {
+		keys, err = webpush.ParseVAPIDPrivateKey(value)
+	} else {
+		keys, err = loadOrCreateVAPIDKeys()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return webpush.NewSender(webpush.Options{
+		// 購読のエンドポイントは利用者が送ってくる URL なので、内部ネットワークには送らない
+		Client:  webfetch.NewClient(webfetch.Options{Timeout: webPushTimeout}),
+		Keys:    keys,
+		Subject: subject,
+		TTL:     webPushTTL,
+	}), nil
+}
+
+// 複数のインスタンスが同時に起動しても、最初に保存された鍵を全員が使う
+var loadOrCreateVAPIDKeys = func() (*webpush.VAPIDKeys, error) {
+	generated, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(
+		"INSERT INTO web_push_keys (id, private_key) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING",
+		vapidKeyRowID,
+		generated.PrivateKey(),
+	); err != nil {
+		return nil, err
+	}
+
+	var privateKey string
+	if err := db.QueryRow("SELECT private_key FROM web_push_keys WHERE id = $1", vapidKeyRowID).Scan(&privateKey); err != nil {
+		return nil, err
+	}
+	return webpush.ParseVAPIDPrivateKey(privateKey)
+}
+
+// セッションごとに 1 件。ログアウトなどでセッションが消えると購読も消える
+var savePushSubscription = func(userID string, tokenHash string, subscription webpush.Subscription) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO web_push_subscriptions (user_id, session_token_hash, endpoint, p256dh, auth)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (session_token_hash) DO UPDATE
+			 SET endpoint = EXCLUDED.endpoint, p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth, updated_at = NOW()`,
+			userID,
+			tokenHash,
+			subscription.Endpoint,
+			subscription.P256dh,
+			subscription.Auth,
+		)
+		return err
+	})
+}
+
+var deletePushSubscription = func(userID string, tokenHash string) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"DELETE FROM web_push_subscriptions WHERE user_id = $1 AND session_token_hash = $2",
+			userID,
+			tokenHash,
+		)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// 期限切れのセッションの購読には送らない
+var listPushSubscriptions = func(userID string) ([]pushSubscription, error) {
+	subscriptions := make([]pushSubscription, 0)
+	err := withUserScope(userID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`SELECT p.id, p.endpoint, p.p256dh, p.auth
+			 FROM web_push_subscriptions p
+			 JOIN sessions s ON s.token_hash = p.session_token_hash
+			 WHERE p.user_id = $1 AND s.expires_at > NOW()
+			 ORDER BY p.id`,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var s pushSubscription
+			if err := rows.Scan(&s.ID, &s.Endpoint, &s.P256dh, &s.Auth); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, s)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+var removePushSubscription = func(userID string, subscriptionID int) error {
+	return withUserScope(userID, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM web_push_subscriptions WHERE id = $1 AND user_id = $2", subscriptionID, userID)
+		return err
+	})
+}
+
+// 端末のどれか 1 つに届けば成功とする。プッシュサービスが無効と返した購読は消す
+type webPushNotifier struct{}
+
+func (webPushNotifier) Name() string {
+	return "webpush"
+}
+
+func (webPushNotifier) Notify(ctx context.Context, n notification) error {
+	if webPushSender == nil {
+		return errWebPushDisabled
+	}
+
+	subscriptions, err := listPushSubscriptions(n.UserID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(webPushPayload{
+		Title:     truncateString(n.Title, webPushNotificationTitle),
+		Body:      n.Body,
+		Tag:       n.Key,
+		MessageID: n.MessageID,
+	})
+	if err != nil {
+		return err
+	}
+
+	delivered := 0
+	errs := make([]error, 0)
+	for _, subscription := range subscriptions {
+		err := webPushSender.Send(ctx, subscription.webpush(), webpush.Message{Payload: payload, Topic: n.Key})
+		switch {
+		case err == nil:
+			delivered++
+		case errors.Is(err, webpush.ErrSubscriptionGone), errors.Is(err, webpush.ErrInvalidSubscription):
+			if err := removePushSubscription(n.UserID, subscription.ID); err != nil {
+				log.Printf("failed to remove push subscription %d: %v", subscription.ID, err)
+			}
+		default:
+			errs = append(errs, err)
+		}
+	}
+	if delivered == 0 && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func vapidPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if webPushSender == nil {
+		writeError(w, http.StatusServiceUnavailable, errWebPushDisabled.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, vapidPublicKeyResponse{PublicKey: webPushSender.PublicKey()})
+}
+
+// 今のセッションの購読を登録する。同じセッションで登録し直すと置き換える
+func putPushSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if webPushSender == nil {
+		writeError(w, http.StatusServiceUnavailable, errWebPushDisabled.Error())
+		return
+	}
+	token, err := readSessionToken(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var req pushSubscriptionRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	endpoint, err := url.Parse(req.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" || len(req.Endpoint) > maxPushEndpointBytes {
+		writeError(w, http.StatusBadRequest, "endpoint must be an https URL")
+		return
+	}
+	subscription := webpush.Subscription{Endpoint: req.Endpoint, P256dh: req.Keys.P256dh, Auth: req.Keys.Auth}
+	if err := subscription.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid subscription keys")
+		return
+	}
+
+	if err := savePushSubscription(userID, hashSessionToken(token), subscription); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deletePushSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserIDFromContext(r.Context())
+	if !ok || userID == "" {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	token, err := readSessionToken(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if err := deletePushSubscription(userID, hashSessionToken(token)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "push subscription not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
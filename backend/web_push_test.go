@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"futto-note/backend/webpush"
+)
+
+func stubWebPushSender(t *testing.T) {
+	t.Helper()
+
+	original := webPushSender
+	t.Cleanup(func() {
+		webPushSender = original
+	})
+
+	keys, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("failed to generate VAPID keys: %v", err)
+	}
+	webPushSender = webpush.NewSender(webpush.Options{
+		Keys:          keys,
+		Subject:       "mailto:ops@example.com",
+		RetryDelay:    time.Millisecond,
+		AllowInsecure: true,
+	})
+}
+
+func newTestPushKeys(t *testing.T) pushSubscriptionKeys {
+	t.Helper()
+
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatalf("failed to generate auth secret: %v", err)
+	}
+	return pushSubscriptionKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes()),
+		Auth:   base64.RawURLEncoding.EncodeToString(auth),
+	}
+}
+
+func newPushSubscriptionRequest(method string, body string) *http.Request {
+	request := httptest.NewRequest(method, "/api/push/subscription", strings.NewReader(body))
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "session-token"})
+	return request.WithContext(context.WithValue(request.Context(), userIDContextKey, "user-1"))
+}
+
+func TestPutPushSubscriptionHandler(t *testing.T) {
+	stubWebPushSender(t)
+	originalSave := savePushSubscription
+	t.Cleanup(func() {
+		savePushSubscription = originalSave
+	})
+
+	var saved []webpush.Subscription
+	savePushSubscription = func(userID string, tokenHash string, subscription webpush.Subscription) error {
+		if userID != "user-1" || tokenHash != hashSessionToken("session-token") {
+			t.Fatalf("unexpected owner %s / %s", userID, tokenHash)
+		}
+		saved = append(saved, subscription)
+		return nil
+	}
+
+	keys := newTestPushKeys(t)
+	valid := `{"endpoint":"https://push.example.com/send/abc","expirationTime":null,"keys":{"p256dh":"` + keys.P256dh + `","auth":"` + keys.Auth + `"}}`
+	cases := []struct {
+		body   string
+		status int
+		error  string
+	}{
+		{valid, http.StatusNoContent, ""},
+		{strings.Replace(valid, "https://", "http://", 1), http.StatusBadRequest, "endpoint must be an https URL"},
+		{strings.Replace(valid, keys.Auth, "AAAA", 1), http.StatusBadRequest, "invalid subscription keys"},
+		{`{"endpoint":"https://push.example.com","extra":1}`, http.StatusBadRequest, "invalid request body"},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		putPushSubscriptionHandler(recorder, newPushSubscriptionRequest(http.MethodPut, tc.body))
+
+		if recorder.Code != tc.status {
+			t.Fatalf("expected status %d, got %d: %s", tc.status, recorder.Code, recorder.Body.String())
+		}
+		if tc.error != "" {
+			if want := `{"error":"` + tc.error + `"}` + "\n"; recorder.Body.String() != want {
+				t.Fatalf("unexpected response body: %s", strings.TrimSpace(recorder.Body.String()))
+			}
+		}
+	}
+	if len(saved) != 1 || saved[0].Endpoint != "https://push.example.com/send/abc" {
+		t.Fatalf("expected one subscription to be saved, got %+v", saved)
+	}
+
+	webPushSender = nil
+	recorder := httptest.NewRecorder()
+	putPushSubscriptionHandler(recorder, newPushSubscriptionRequest(http.MethodPut, valid))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d when web push is disabled, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
+
+func TestDeletePushSubscriptionHandler(t *testing.T) {
+	originalDelete := deletePushSubscription
+	t.Cleanup(func() {
+		deletePushSubscription = originalDelete
+	})
+
+	subscribed := true
+	deletePushSubscription = func(userID string, tokenHash string) error {
+		if !subscribed {
+			return sql.ErrNoRows
+		}
+		subscribed = false
+		return nil
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		recorder := httptest.NewRecorder()
+		deletePushSubscriptionHandler(recorder, newPushSubscriptionRequest(http.MethodDelete, ""))
+		if recorder.Code != want {
+			t.Fatalf("expected status %d, got %d", want, recorder.Code)
+		}
+	}
+}
+
+// 購読ごとに状態コードを返すプッシュサービスの代わり
+func newStandInPushService(t *testing.T, statuses map[string]int) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+
+	var mu sync.Mutex
+	received := make([]*http.Request, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, r)
+		if status, ok := statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func TestWebPushNotifier_RemovesExpiredSubscriptions(t *testing.T) {
+	stubWebPushSender(t)
+	server, received := newStandInPushService(t, map[string]int{"/gone": http.StatusGone})
+
+	originalList := listPushSubscriptions
+	originalRemove := removePushSubscription
+	t.Cleanup(func() {
+		listPushSubscriptions = originalList
+		removePushSubscription = originalRemove
+	})
+
+	keys := newTestPushKeys(t)
+	listPushSubscriptions = func(userID string) ([]pushSubscription, error) {
+		return []pushSubscription{
+			{ID: 1, Endpoint: server.URL + "/gone", P256dh: keys.P256dh, Auth: keys.Auth},
+			{ID: 2, Endpoint: server.URL + "/phone", P256dh: keys.P256dh, Auth: keys.Auth},
+		}, nil
+	}
+	removed := make([]int, 0)
+	removePushSubscription = func(userID string, subscriptionID int) error {
+		removed = append(removed, subscriptionID)
+		return nil
+	}
+
+	err := webPushNotifier{}.Notify(context.Background(), notification{UserID: "user-1", Key: "reminder-7", Title: "リマインダー", Body: "歯医者"})
+	if err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+	if len(*received) != 2 {
+		t.Fatalf("expected 2 push requests, got %d", len(*received))
+	}
+	for _, request := range *received {
+		if request.Header.Get("Topic") != "reminder-7" || request.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Fatalf("unexpected push headers: %v", request.Header)
+		}
+	}
+	if len(removed) != 1 || removed[0] != 1 {
+		t.Fatalf("expected expired subscription to be removed, got %v", removed)
+	}
+}
+
+func TestWebPushNotifier_FailsWhenNoDeviceAccepts(t *testing.T) {
+	stubWebPushSender(t)
+	server, _ := newStandInPushService(t, map[string]int{"/down": http.StatusBadGateway})
+
+	originalList := listPushSubscriptions
+	t.Cleanup(func() {
+		listPushSubscriptions = originalList
+	})
+
+	keys := newTestPushKeys(t)
+	listPushSubscriptions = func(userID string) ([]pushSubscription, error) {
+		return []pushSubscription{{ID: 1, Endpoint: server.URL + "/down", P256dh: keys.P256dh, Auth: keys.Auth}}, nil
+	}
+
+	if err := (webPushNotifier{}).Notify(context.Background(), notification{UserID: "user-1", Key: "reminder-8"}); err == nil {
+		t.Fatalf("expected error so the reminder is retried")
+	}
+}
+
+func TestNewNotifiersFromEnv_IncludesWebPushWhenConfigured(t *testing.T) {
+	t.Setenv("NOTIFIERS", "")
+	stubWebPushSender(t)
+
+	configured, err := newNotifiersFromEnv()
+	if err != nil || len(configured) != 2 {
+		t.Fatalf("expected log and webpush notifiers, got %v, %v", configured, err)
+	}
+	if _, ok := configured[1].(webPushNotifier); !ok {
+		t.Fatalf("expected webpush notifier, got %T", configured[1])
+	}
+
+	webPushSender = nil
+	t.Setenv("NOTIFIERS", "webpush")
+	if _, err := newNotifiersFromEnv(); err == nil {
+		t.Fatalf("expected webpush notifier to require configuration")
+	}
+}
+
+func TestFireReminder_RetriesWhenPushFailsWithDefaultNotifiers(t *testing.T) {
+	t.Setenv("NOTIFIERS", "")
+	stubWebPushSender(t)
+	stubReminderStore(t, "歯医者")
+	statuses := stubReminderScheduler(t, nil, nil)
+	server, received := newStandInPushService(t, map[string]int{"/down": http.StatusBadGateway})
+
+	originalList := listPushSubscriptions
+	t.Cleanup(func() {
+		listPushSubscriptions = originalList
+	})
+	keys := newTestPushKeys(t)
+	endpoint := server.URL + "/down"
+	listPushSubscriptions = func(userID string) ([]pushSubscription, error) {
+		return []pushSubscription{{ID: 1, Endpoint: endpoint, P256dh: keys.P256dh, Auth: keys.Auth}}, nil
+	}
+
+	// 既定の構成 (log と webpush) では、ログに出せてもプッシュが失敗すれば再試行する
+	configured, err := newNotifiersFromEnv()
+	if err != nil {
+		t.Fatalf("failed to configure notifiers: %v", err)
+	}
+	notifiers = configured
+
+	statuses[9] = reminderStatusFiring
+	fireReminder(dueReminder{ID: 9, MessageID: 1, UserID: "user-1", Attempts: 1})
+	if statuses[9] != reminderStatusFiring {
+		t.Fatalf("expected reminder to stay firing for retry, got %q", statuses[9])
+	}
+
+	endpoint = server.URL + "/phone"
+	before := len(*received)
+	fireReminder(dueReminder{ID: 9, MessageID: 1, UserID: "user-1", Attempts: 2})
+	if statuses[9] != reminderStatusSent {
+		t.Fatalf("expected retried reminder to be sent, got %q", statuses[9])
+	}
+	if len(*received) != before+1 || (*received)[before].URL.Path != "/phone" {
+		t.Fatalf("expected one push on retry, got %d", len(*received)-before)
+	}
+}
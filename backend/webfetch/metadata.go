@@ -0,0 +1,141 @@
+package webfetch
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	maxTitleRunes       = 300
+	maxDescriptionRunes = 1000
+	maxSiteNameRunes    = 100
+)
+
+// プレビュー表示に使う項目。OpenGraph、Twitter Card、<title> の順に採用する
+type Metadata struct {
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
+// DecodeHTML は Content-Type と <meta charset> から文字コードを判定して UTF-8 で読めるようにする
+func DecodeHTML(resp *Response) io.Reader {
+	reader, err := charset.NewReader(bytes.NewReader(resp.Body), resp.ContentType)
+	if err != nil {
+		return bytes.NewReader(resp.Body)
+	}
+	return reader
+}
+
+func ParseMetadata(resp *Response) Metadata {
+	properties := make(map[string]string)
+	var title strings.Builder
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(DecodeHTML(resp))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return buildMetadata(properties, title.String(), resp.URL)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = title.Len() == 0
+			case atom.Meta:
+				key, content := metaProperty(token)
+				if key != "" {
+					if _, exists := properties[key]; !exists {
+						properties[key] = content
+					}
+				}
+			case atom.Body:
+				// メタデータは <head> にあるはずなので本文までは読まない
+				return buildMetadata(properties, title.String(), resp.URL)
+			}
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if token := tokenizer.Token(); token.DataAtom == atom.Title {
+				inTitle = false
+			}
+		}
+	}
+}
+
+func metaProperty(token html.Token) (string, string) {
+	var key, content string
+	for _, attr := range token.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(strings.TrimSpace(attr.Val))
+			}
+		case "content":
+			content = attr.Val
+		}
+	}
+	return key, content
+}
+
+func buildMetadata(properties map[string]string, title string, base *url.URL) Metadata {
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value := cleanText(properties[key]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	metadata := Metadata{
+		Title:       first("og:title", "twitter:title"),
+		Description: truncateRunes(first("og:description", "twitter:description", "description"), maxDescriptionRunes),
+		SiteName:    truncateRunes(first("og:site_name"), maxSiteNameRunes),
+	}
+	if metadata.Title == "" {
+		metadata.Title = cleanText(title)
+	}
+	metadata.Title = truncateRunes(metadata.Title, maxTitleRunes)
+
+	if image := first("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src"); image != "" {
+		metadata.ImageURL = ResolveURL(base, image)
+	}
+	return metadata
+}
+
+// ResolveURL はページ内の相対 URL を絶対 URL にする。http(s) 以外は空文字を返す
+func ResolveURL(base *url.URL, ref string) string {
+	parsed, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		parsed = base.ResolveReference(parsed)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ""
+	}
+	return parsed.String()
+}
+
+func cleanText(value string) string {
+	return strings.Join(strings.Fields(strings.ToValidUTF8(value, "")), " ")
+}
+
+func truncateRunes(value string, limit int) string {
+	if utf8.RuneCountInString(value) <= limit {
+		return value
+	}
+	return string([]rune(value)[:limit])
+}
@@ -0,0 +1,183 @@
+package webfetch
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// 本文とみなす段落の最低文字数。ナビゲーションの短いリンク列を拾わないため
+const minParagraphRunes = 25
+
+// 読み物として保存する内容
+type Article struct {
+	Title    string
+	Text     string
+	ImageURL string
+}
+
+// 本文を持たない要素。中身ごと読み飛ばす
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+	atom.Form: true, atom.Button: true, atom.Iframe: true, atom.Svg: true,
+}
+
+// 前後に改行を入れる要素
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Li: true, atom.Blockquote: true, atom.Pre: true, atom.Figcaption: true, atom.Tr: true,
+	atom.Br: true, atom.Hr: true, atom.Dd: true, atom.Dt: true,
+}
+
+// ExtractArticle はページから本文らしい部分のテキストと代表画像を取り出す。
+// <article> / <main> があればそれを、なければ段落の文字数が最も多く集まる要素を本文とする
+func ExtractArticle(resp *Response) (Article, error) {
+	document, err := html.Parse(DecodeHTML(resp))
+	if err != nil {
+		return Article{}, err
+	}
+
+	metadata := ParseMetadata(resp)
+	article := Article{Title: metadata.Title, ImageURL: metadata.ImageURL}
+
+	content := findContentRoot(document)
+	if content == nil {
+		return article, nil
+	}
+	article.Text = renderText(content)
+
+	if article.ImageURL == "" {
+		article.ImageURL = firstImage(content, resp)
+	}
+	return article, nil
+}
+
+func findContentRoot(document *html.Node) *html.Node {
+	var explicit *html.Node
+	scores := make(map[*html.Node]int)
+
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if skippedElements[node.DataAtom] {
+				return
+			}
+			if explicit == nil && (node.DataAtom == atom.Article || node.DataAtom == atom.Main || attr(node, "role") == "main") {
+				explicit = node
+			}
+			if node.DataAtom == atom.P || node.DataAtom == atom.Pre || node.DataAtom == atom.Blockquote {
+				if length := utf8.RuneCountInString(strings.TrimSpace(renderText(node))); length >= minParagraphRunes && node.Parent != nil {
+					scores[node.Parent] += length
+					if node.Parent.Parent != nil {
+						scores[node.Parent.Parent] += length / 2
+					}
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(document)
+
+	if explicit != nil {
+		return explicit
+	}
+
+	var best *html.Node
+	for node, score := range scores {
+		if best == nil || score > scores[best] {
+			best = node
+		}
+	}
+	if best == nil {
+		return findElement(document, atom.Body)
+	}
+	return best
+}
+
+// 段落ごとに空行で区切ったプレーンテキストにする
+func renderText(root *html.Node) string {
+	var builder strings.Builder
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		switch node.Type {
+		case html.TextNode:
+			builder.WriteString(node.Data)
+			return
+		case html.ElementNode:
+			if skippedElements[node.DataAtom] {
+				return
+			}
+		}
+
+		block := node.Type == html.ElementNode && blockElements[node.DataAtom]
+		if block {
+			builder.WriteString("\n")
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if block {
+			builder.WriteString("\n")
+		}
+	}
+	walk(root)
+
+	paragraphs := make([]string, 0)
+	for _, line := range strings.Split(builder.String(), "\n") {
+		if cleaned := cleanText(line); cleaned != "" {
+			paragraphs = append(paragraphs, cleaned)
+		}
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+func firstImage(root *html.Node, resp *Response) string {
+	var found string
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if found != "" {
+			return
+		}
+		if node.Type == html.ElementNode {
+			if skippedElements[node.DataAtom] {
+				return
+			}
+			if node.DataAtom == atom.Img {
+				found = ResolveURL(resp.URL, attr(node, "src"))
+				return
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+	return found
+}
+
+func findElement(node *html.Node, target atom.Atom) *html.Node {
+	if node.Type == html.ElementNode && node.DataAtom == target {
+		return node
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, target); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func attr(node *html.Node, key string) string {
+	for _, a := range node.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
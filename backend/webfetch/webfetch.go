@@ -0,0 +1,217 @@
+// Package webfetch は本文に書かれた URL をサーバー側から安全に取りに行く。
+// 接続先の IP をダイヤル時に検査して内部ネットワークへの到達 (SSRF) を防ぎ、
+// 時間・リダイレクト回数・読み込むサイズに上限を設ける。
+package webfetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedAddress     = errors.New("destination address is not allowed")
+	ErrUnsupportedScheme  = errors.New("only http and https URLs can be fetched")
+	ErrUnsupportedContent = errors.New("unsupported content type")
+	ErrTooManyRedirects   = errors.New("too many redirects")
+)
+
+// StatusError は 2xx 以外の応答
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.StatusCode)
+}
+
+type Options struct {
+	Timeout      time.Duration
+	MaxRedirects int
+	UserAgent    string
+	// ループバックやプライベートアドレスへの接続を許す。httptest を使うテスト専用
+	AllowPrivate bool
+}
+
+type Fetcher struct {
+	client    *http.Client
+	userAgent string
+}
+
+type Response struct {
+	// リダイレクト後の最終的な URL。相対 URL の解決に使う
+	URL         *url.URL
+	ContentType string
+	Body        []byte
+	// maxBytes で読むのを打ち切った
+	Truncated bool
+}
+
+func New(opts Options) *Fetcher {
+	return &Fetcher{client: NewClient(opts), userAgent: opts.UserAgent}
+}
+
+// NewClient は New と同じ接続先の検査をする http.Client を返す。GET 以外で外部に送るとき用
+func NewClient(opts Options) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: opts.Timeout,
+		// 名前解決後の実際の接続先で判定するので、DNS の付け替えでもすり抜けられない
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			if opts.AllowPrivate {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return ErrBlockedAddress
+			}
+			if isBlockedAddr(addrPort.Addr()) {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// 環境変数のプロキシを経由すると接続先の検査が効かなくなる
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          16,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrUnsupportedScheme
+			}
+			return nil
+		},
+	}
+}
+
+// accept は受け付ける Content-Type の前方一致 ("text/html", "image/" など)。
+// 本文は maxBytes で打ち切り、その場合は Truncated を立てる
+func (f *Fetcher) Get(ctx context.Context, rawURL string, maxBytes int64, accept ...string) (*Response, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	req.Header.Set("Accept", strings.Join(acceptHeader(accept), ", "))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrBlockedAddress) {
+			return nil, ErrBlockedAddress
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !acceptable(contentType, accept) {
+		return nil, ErrUnsupportedContent
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	truncated := int64(len(body)) > maxBytes
+	if truncated {
+		body = body[:maxBytes]
+	}
+
+	return &Response{
+		URL:         resp.Request.URL,
+		ContentType: contentType,
+		Body:        body,
+		Truncated:   truncated,
+	}, nil
+}
+
+func acceptHeader(accept []string) []string {
+	values := make([]string, 0, len(accept))
+	for _, prefix := range accept {
+		if strings.HasSuffix(prefix, "/") {
+			prefix += "*"
+		}
+		values = append(values, prefix)
+	}
+	if len(values) == 0 {
+		values = append(values, "*/*")
+	}
+	return values
+}
+
+func acceptable(contentType string, accept []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range accept {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// グローバルユニキャスト以外と、内部向けに予約された範囲を拒否する
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64 と 6to4 は IPv4 の内部アドレスに変換され得る
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+func isBlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package webfetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+func testFetcher(allowPrivate bool) *Fetcher {
+	return New(Options{Timeout: 2 * time.Second, MaxRedirects: 3, UserAgent: "test", AllowPrivate: allowPrivate})
+}
+
+func TestGet_BlocksLoopbackByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request should not reach the server")
+	}))
+	defer server.Close()
+
+	_, err := testFetcher(false).Get(context.Background(), server.URL, 1024)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("expected ErrBlockedAddress, got %v", err)
+	}
+}
+
+func TestIsBlockedAddr(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"::ffff:10.0.0.1": true,
+		"64:ff9b::a00:1":  true,
+		"93.184.216.34":   false,
+		"2606:4700::1111": false,
+	}
+	for address, want := range cases {
+		if got := isBlockedAddr(netip.MustParseAddr(address)); got != want {
+			t.Errorf("isBlockedAddr(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestGet_RejectsSchemesAndContentTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write([]byte("PK"))
+		}
+	}))
+	defer server.Close()
+
+	fetcher := testFetcher(true)
+	ctx := context.Background()
+
+	if _, err := fetcher.Get(ctx, "ftp://example.com/", 1024); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected ErrUnsupportedScheme, got %v", err)
+	}
+	if _, err := fetcher.Get(ctx, server.URL+"/file", 1024); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected redirect to file: to be rejected, got %v", err)
+	}
+	if _, err := fetcher.Get(ctx, server.URL+"/loop", 1024); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("expected ErrTooManyRedirects, got %v", err)
+	}
+	var statusErr *StatusError
+	if _, err := fetcher.Get(ctx, server.URL+"/missing", 1024); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 StatusError, got %v", err)
+	}
+	if _, err := fetcher.Get(ctx, server.URL+"/zip", 1024, "text/html"); !errors.Is(err, ErrUnsupportedContent) {
+		t.Fatalf("expected ErrUnsupportedContent, got %v", err)
+	}
+}
+
+func TestGet_TruncatesAtLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(bytes.Repeat([]byte("a"), 4096))
+	}))
+	defer server.Close()
+
+	resp, err := testFetcher(true).Get(context.Background(), server.URL, 100, "text/html")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if len(resp.Body) != 100 || !resp.Truncated {
+		t.Fatalf("expected body to be truncated to 100 bytes, got %d (truncated=%v)", len(resp.Body), resp.Truncated)
+	}
+}
+
+func TestGet_TimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fetcher := New(Options{Timeout: 100 * time.Millisecond, AllowPrivate: true})
+	started := time.Now()
+	if _, err := fetcher.Get(context.Background(), server.URL, 1024); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("expected request to time out quickly, took %v", elapsed)
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	page := `<!doctype html><html><head>
+		<title>  Fallback
+		title </title>
+		<meta property="og:title" content="OpenGraph &amp; Title">
+		<meta name="twitter:title" content="Twitter title">
+		<meta name="description" content="Plain description">
+		<meta property="og:image" content="/images/cover.png">
+		<meta property="og:site_name" content="Example">
+		</head><body><meta property="og:description" content="ignored"></body></html>`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	resp, err := testFetcher(true).Get(context.Background(), server.URL+"/articles/1", 1<<20, "text/html")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	metadata := ParseMetadata(resp)
+	if metadata.Title != "OpenGraph & Title" {
+		t.Fatalf("unexpected title: %q", metadata.Title)
+	}
+	if metadata.Description != "Plain description" {
+		t.Fatalf("unexpected description: %q", metadata.Description)
+	}
+	if metadata.ImageURL != server.URL+"/images/cover.png" {
+		t.Fatalf("expected image URL to be resolved, got %q", metadata.ImageURL)
+	}
+	if metadata.SiteName != "Example" {
+		t.Fatalf("unexpected site name: %q", metadata.SiteName)
+	}
+}
+
+func TestParseMetadata_FallsBackToTitleAndDecodesCharset(t *testing.T) {
+	encoded, err := japanese.ShiftJIS.NewEncoder().String(`<html><head><meta charset="shift_jis"><title>ふっとノート</title><meta property="og:image" content="javascript:alert(1)"></head></html>`)
+	if err != nil {
+		t.Fatalf("failed to encode Shift_JIS: %v", err)
+	}
+
+	metadata := ParseMetadata(&Response{ContentType: "text/html", Body: []byte(encoded)})
+	if metadata.Title != "ふっとノート" {
+		t.Fatalf("expected Shift_JIS title to be decoded, got %q", metadata.Title)
+	}
+	if metadata.ImageURL != "" {
+		t.Fatalf("expected non-http image URL to be dropped, got %q", metadata.ImageURL)
+	}
+}
+
+func TestParseMetadata_TruncatesLongValues(t *testing.T) {
+	body := `<meta property="og:title" content="` + strings.Repeat("あ", 500) + `">`
+	metadata := ParseMetadata(&Response{ContentType: "text/html; charset=utf-8", Body: []byte(body)})
+	if got := len([]rune(metadata.Title)); got != maxTitleRunes {
+		t.Fatalf("expected title to be truncated to %d runes, got %d", maxTitleRunes, got)
+	}
+}
+
+func TestExtractArticle_PrefersArticleElement(t *testing.T) {
+	page := `<html><head><meta property="og:title" content="Story"></head><body>
+		<header><h1>Site name</h1></header>
+		<article><h1>Story</h1><p>First line<br>second line</p><script>track()</script>
+		<img src="data:image/png;base64,AAAA"><img src="https://cdn.example.com/a.jpg"></article>
+		<aside><p>Related links that are long enough to look like a paragraph of text.</p></aside>
+		</body></html>`
+
+	article, err := ExtractArticle(&Response{ContentType: "text/html; charset=utf-8", Body: []byte(page)})
+	if err != nil {
+		t.Fatalf("ExtractArticle returned error: %v", err)
+	}
+	if article.Title != "Story" {
+		t.Fatalf("unexpected title: %q", article.Title)
+	}
+	if article.Text != "Story\n\nFirst line\n\nsecond line" {
+		t.Fatalf("unexpected text: %q", article.Text)
+	}
+	if article.ImageURL != "https://cdn.example.com/a.jpg" {
+		t.Fatalf("unexpected image URL: %q", article.ImageURL)
+	}
+}
@@ -0,0 +1,132 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// プッシュサービスが受け付ける本文は 4096 バイトまで (RFC 8291 §4)
+	recordSize       = 4096
+	saltLength       = 16
+	authSecretLength = 16
+	publicKeyLength  = 65
+	gcmTagLength     = 16
+	headerLength     = saltLength + 4 + 1 + publicKeyLength
+	// 平文の後ろに付ける区切り (最後のレコード)
+	lastRecordDelimiter = 0x02
+
+	// 1 レコードに収まる平文の上限
+	MaxPayloadSize = recordSize - headerLength - gcmTagLength - 1
+)
+
+var (
+	ErrInvalidSubscription = errors.New("invalid push subscription keys")
+	ErrPayloadTooLarge     = errors.New("push payload is too large")
+)
+
+// Subscription はブラウザの PushSubscription。P256dh と Auth は base64url
+type Subscription struct {
+	Endpoint string
+	P256dh   string
+	Auth     string
+}
+
+// Validate は鍵の形式だけを確かめる。エンドポイントの検査は呼び出し側で行う
+func (s Subscription) Validate() error {
+	_, _, err := s.keys()
+	return err
+}
+
+func (s Subscription) keys() (*ecdh.PublicKey, []byte, error) {
+	rawPublic, err := decodeBase64URL(s.P256dh)
+	if err != nil || len(rawPublic) != publicKeyLength {
+		return nil, nil, ErrInvalidSubscription
+	}
+	public, err := ecdh.P256().NewPublicKey(rawPublic)
+	if err != nil {
+		return nil, nil, ErrInvalidSubscription
+	}
+	authSecret, err := decodeBase64URL(s.Auth)
+	if err != nil || len(authSecret) != authSecretLength {
+		return nil, nil, ErrInvalidSubscription
+	}
+	return public, authSecret, nil
+}
+
+// Encrypt は RFC 8291 の aes128gcm 形式で暗号化した本文 (ヘッダー + 1 レコード) を返す
+func Encrypt(subscription Subscription, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	uaPublic, authSecret, err := subscription.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 送信ごとに使い捨ての鍵と salt を作る
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return encrypt(uaPublic, authSecret, asPrivate, salt, plaintext)
+}
+
+func encrypt(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte, plaintext []byte) ([]byte, error) {
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	// RFC 8291 §3.4: auth_secret と ECDH の共有鍵から IKM を作る
+	keyInfo := "WebPush: info\x00" + string(uaPublic.Bytes()) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8188 §2.2: salt と IKM から内容鍵と nonce を作る
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, headerLength, headerLength+len(plaintext)+1+gcmTagLength)
+	copy(body, salt)
+	binary.BigEndian.PutUint32(body[saltLength:], recordSize)
+	body[saltLength+4] = publicKeyLength
+	copy(body[saltLength+5:], asPublic)
+
+	record := append(append(make([]byte, 0, len(plaintext)+1), plaintext...), lastRecordDelimiter)
+	// レコードは 1 つだけなので、シーケンス番号 0 の nonce をそのまま使う
+	return gcm.Seal(body, nonce, record, nil), nil
+}
@@ -0,0 +1,108 @@
+// Package webpush はブラウザのプッシュサービス (RFC 8030) へ通知を送る。
+// ペイロードは RFC 8291 (aes128gcm) で購読ごとに暗号化し、送信元は VAPID (RFC 8292) で名乗る。
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrInvalidVAPIDKey = errors.New("invalid VAPID private key")
+
+// VAPIDKeys はアプリケーションサーバーの P-256 鍵。公開鍵はブラウザの
+// pushManager.subscribe に applicationServerKey として渡す
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+}
+
+func GenerateVAPIDKeys() (*VAPIDKeys, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{private: private}, nil
+}
+
+// ParseVAPIDPrivateKey は 32 バイトの秘密鍵を base64url にしたもの (PrivateKey の出力) を読む
+func ParseVAPIDPrivateKey(encoded string) (*VAPIDKeys, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, ErrInvalidVAPIDKey
+	}
+	// 範囲外の値を弾くため ecdh で一度読み、公開鍵もそこから求める
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, ErrInvalidVAPIDKey
+	}
+	public := key.PublicKey().Bytes()
+
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+	return &VAPIDKeys{private: private}, nil
+}
+
+func (k *VAPIDKeys) PrivateKey() string {
+	return base64.RawURLEncoding.EncodeToString(k.private.D.FillBytes(make([]byte, 32)))
+}
+
+// 非圧縮形式 (65 バイト) の公開鍵を base64url にしたもの
+func (k *VAPIDKeys) PublicKey() string {
+	public, err := k.private.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(public.Bytes())
+}
+
+// aud はプッシュサービスのオリジン。subject は連絡先 (mailto: か https: の URL)
+func (k *VAPIDKeys) authorization(endpoint *url.URL, subject string, expires time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": expires.Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS の ES256 署名は DER ではなく r と s を 32 バイトずつ並べたもの
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + k.PublicKey(), nil
+}
+
+// ブラウザの PushSubscription.toJSON はパディングなしの base64url を返す。
+// パディング付きや標準の base64 で送ってくるクライアントも受け付ける
+func decodeBase64URL(value string) ([]byte, error) {
+	value = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(value, "="))
+	return base64.RawURLEncoding.DecodeString(value)
+}
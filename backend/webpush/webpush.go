@@ -0,0 +1,200 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultTTL         = 24 * time.Hour
+	defaultMaxAttempts = 3
+	defaultRetryDelay  = time.Second
+	// Retry-After がこれより長ければ諦めて呼び出し側の再試行に任せる
+	maxRetryAfter = 30 * time.Second
+	// VAPID の JWT の有効期限は 24 時間以内 (RFC 8292 §2)
+	vapidTokenLifetime = 12 * time.Hour
+	maxErrorBodyBytes  = 512
+
+	UrgencyVeryLow = "very-low"
+	UrgencyLow     = "low"
+	UrgencyNormal  = "normal"
+	UrgencyHigh    = "high"
+)
+
+var (
+	// ErrSubscriptionGone はプッシュサービスが購読を無効と返した (404 / 410)。保存している購読は消してよい
+	ErrSubscriptionGone   = errors.New("push subscription is no longer valid")
+	ErrUnsupportedScheme  = errors.New("push endpoint must be an https URL")
+	ErrInvalidTopic       = errors.New("topic must be at most 32 URL-safe base64 characters")
+	topicPattern          = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	errRetryAfterTooLarge = errors.New("retry-after exceeds limit")
+)
+
+// StatusError は再試行しても成功しない、または再試行しきれなかった 2xx 以外の応答
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("push service returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("push service returned status %d: %s", e.StatusCode, e.Body)
+}
+
+type Options struct {
+	// 接続先の検査は呼び出し側のクライアントに任せる (webfetch.NewClient など)
+	Client  *http.Client
+	Keys    *VAPIDKeys
+	Subject string
+	// プッシュサービスが端末に届けられるまで保持する時間
+	TTL time.Duration
+	// 429 / 5xx / 通信エラーのときの試行回数と、初回の待ち時間 (以降は倍にする)
+	MaxAttempts int
+	RetryDelay  time.Duration
+	// http:// のエンドポイントを許す。httptest を使うテスト専用
+	AllowInsecure bool
+}
+
+type Sender struct {
+	opts Options
+}
+
+// Topic は同じ通知の差し替えに使う。Urgency は省略すると normal
+type Message struct {
+	Payload []byte
+	Topic   string
+	Urgency string
+}
+
+func NewSender(opts Options) *Sender {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultRetryDelay
+	}
+	return &Sender{opts: opts}
+}
+
+func (s *Sender) PublicKey() string {
+	return s.opts.Keys.PublicKey()
+}
+
+func (s *Sender) Send(ctx context.Context, subscription Subscription, message Message) error {
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return ErrUnsupportedScheme
+	}
+	if endpoint.Scheme != "https" && !(s.opts.AllowInsecure && endpoint.Scheme == "http") {
+		return ErrUnsupportedScheme
+	}
+	if message.Topic != "" && !topicPattern.MatchString(message.Topic) {
+		return ErrInvalidTopic
+	}
+
+	body, err := Encrypt(subscription, message.Payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := s.opts.Keys.authorization(endpoint, s.opts.Subject, time.Now().Add(vapidTokenLifetime))
+	if err != nil {
+		return err
+	}
+
+	delay := s.opts.RetryDelay
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := s.post(ctx, endpoint.String(), authorization, body, message)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if retryAfter < 0 || attempt >= s.opts.MaxAttempts {
+			return lastErr
+		}
+
+		wait := max(delay, retryAfter)
+		if wait > maxRetryAfter {
+			return errors.Join(lastErr, errRetryAfterTooLarge)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(lastErr, ctx.Err())
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// 再試行できない失敗なら retryAfter に負の値を返す
+func (s *Sender) post(ctx context.Context, endpoint string, authorization string, body []byte, message Message) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(s.opts.TTL/time.Second)))
+	urgency := message.Urgency
+	if urgency == "" {
+		urgency = UrgencyNormal
+	}
+	req.Header.Set("Urgency", urgency)
+	if message.Topic != "" {
+		req.Header.Set("Topic", message.Topic)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return 0, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return -1, ErrSubscriptionGone
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return -1, ErrPayloadTooLarge
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return parseRetryAfter(resp.Header.Get("Retry-After")), &StatusError{StatusCode: resp.StatusCode, Body: string(detail)}
+	default:
+		return -1, &StatusError{StatusCode: resp.StatusCode, Body: string(detail)}
+	}
+}
+
+// 秒数と HTTP 日付の両方の形式を受け付ける。読めなければ 0 (既定の待ち時間を使う)
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
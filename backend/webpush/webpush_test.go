@@ -0,0 +1,320 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ブラウザ側の購読。プッシュサービスの代わりに受け取った本文を復号する
+type testUserAgent struct {
+	private    *ecdh.PrivateKey
+	authSecret []byte
+}
+
+func newTestUserAgent(t *testing.T) *testUserAgent {
+	t.Helper()
+
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	authSecret := make([]byte, authSecretLength)
+	if _, err := rand.Read(authSecret); err != nil {
+		t.Fatalf("failed to generate auth secret: %v", err)
+	}
+	return &testUserAgent{private: private, authSecret: authSecret}
+}
+
+func (ua *testUserAgent) subscription(endpoint string) Subscription {
+	return Subscription{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(ua.private.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(ua.authSecret),
+	}
+}
+
+func (ua *testUserAgent) decrypt(body []byte) ([]byte, error) {
+	if len(body) < headerLength {
+		return nil, errors.New("body too short")
+	}
+	salt := body[:saltLength]
+	if size := binary.BigEndian.Uint32(body[saltLength:]); size != recordSize {
+		return nil, errors.New("unexpected record size")
+	}
+	if body[saltLength+4] != publicKeyLength {
+		return nil, errors.New("unexpected key id length")
+	}
+	asPublic, err := ecdh.P256().NewPublicKey(body[saltLength+5 : headerLength])
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := ua.private.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(ua.private.PublicKey().Bytes()) + string(asPublic.Bytes())
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, ua.authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, body[headerLength:], nil)
+	if err != nil {
+		return nil, err
+	}
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != lastRecordDelimiter {
+		return nil, errors.New("missing record delimiter")
+	}
+	return record[:len(record)-1], nil
+}
+
+// Authorization ヘッダーの JWT を送信元の公開鍵で検証し、クレームを返す
+func verifyVAPID(t *testing.T, header string, publicKey string) map[string]any {
+	t.Helper()
+
+	token, key, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !ok || key != publicKey {
+		t.Fatalf("unexpected authorization header: %q", header)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed jwt: %q", token)
+	}
+
+	rawKey, _ := base64.RawURLEncoding.DecodeString(key)
+	if len(rawKey) != publicKeyLength {
+		t.Fatalf("unexpected public key length %d", len(rawKey))
+	}
+	public := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(rawKey[1:33]),
+		Y:     new(big.Int).SetBytes(rawKey[33:]),
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(signature) != 64 {
+		t.Fatalf("unexpected signature length %d", len(signature))
+	}
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(public, digest[:], r, s) {
+		t.Fatalf("vapid signature is invalid")
+	}
+
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]any
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	return claims
+}
+
+type pushRequest struct {
+	header  http.Header
+	payload []byte
+}
+
+// 応答の状態コードを順に返すプッシュサービスの代わり
+func newStandInPushService(t *testing.T, ua *testUserAgent, statuses ...int) (*httptest.Server, *[]pushRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	received := make([]pushRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		payload, err := ua.decrypt(body)
+		if err != nil {
+			t.Errorf("failed to decrypt push message: %v", err)
+		}
+		received = append(received, pushRequest{header: r.Header.Clone(), payload: payload})
+
+		status := http.StatusCreated
+		if len(received) <= len(statuses) {
+			status = statuses[len(received)-1]
+		}
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func newTestSender(t *testing.T) *Sender {
+	t.Helper()
+
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("failed to generate VAPID keys: %v", err)
+	}
+	return NewSender(Options{
+		Keys:          keys,
+		Subject:       "mailto:ops@example.com",
+		TTL:           time.Hour,
+		RetryDelay:    time.Millisecond,
+		AllowInsecure: true,
+	})
+}
+
+func TestSend_EncryptsPayloadAndSignsRequest(t *testing.T) {
+	ua := newTestUserAgent(t)
+	server, received := newStandInPushService(t, ua)
+	sender := newTestSender(t)
+
+	payload := []byte(`{"title":"リマインダー","body":"明日10時に歯医者"}`)
+	err := sender.Send(context.Background(), ua.subscription(server.URL+"/push/abc"), Message{Payload: payload, Topic: "reminder-7", Urgency: UrgencyHigh})
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	if len(*received) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*received))
+	}
+	request := (*received)[0]
+	if !bytes.Equal(request.payload, payload) {
+		t.Fatalf("unexpected decrypted payload: %q", request.payload)
+	}
+	for name, want := range map[string]string{
+		"Content-Encoding": "aes128gcm",
+		"Ttl":              "3600",
+		"Urgency":          "high",
+		"Topic":            "reminder-7",
+	} {
+		if got := request.header.Get(name); got != want {
+			t.Fatalf("expected %s header %q, got %q", name, want, got)
+		}
+	}
+
+	claims := verifyVAPID(t, request.header.Get("Authorization"), sender.PublicKey())
+	if claims["aud"] != server.URL || claims["sub"] != "mailto:ops@example.com" {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+	if exp, _ := claims["exp"].(float64); time.Unix(int64(exp), 0).After(time.Now().Add(24 * time.Hour)) {
+		t.Fatalf("vapid token must expire within 24 hours, got %v", claims["exp"])
+	}
+}
+
+func TestSend_RetriesTransientFailures(t *testing.T) {
+	ua := newTestUserAgent(t)
+	server, received := newStandInPushService(t, ua, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	if err := newTestSender(t).Send(context.Background(), ua.subscription(server.URL), Message{Payload: []byte("hi")}); err != nil {
+		t.Fatalf("expected retries to succeed, got %v", err)
+	}
+	if len(*received) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(*received))
+	}
+}
+
+func TestSend_GivesUpAfterMaxAttempts(t *testing.T) {
+	ua := newTestUserAgent(t)
+	server, received := newStandInPushService(t, ua, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+	err := newTestSender(t).Send(context.Background(), ua.subscription(server.URL), Message{Payload: []byte("hi")})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 StatusError, got %v", err)
+	}
+	if len(*received) != defaultMaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", defaultMaxAttempts, len(*received))
+	}
+}
+
+func TestSend_ReportsExpiredSubscriptionWithoutRetry(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusGone} {
+		ua := newTestUserAgent(t)
+		server, received := newStandInPushService(t, ua, status)
+
+		err := newTestSender(t).Send(context.Background(), ua.subscription(server.URL), Message{Payload: []byte("hi")})
+		if !errors.Is(err, ErrSubscriptionGone) {
+			t.Fatalf("status %d: expected ErrSubscriptionGone, got %v", status, err)
+		}
+		if len(*received) != 1 {
+			t.Fatalf("status %d: expected no retry, got %d attempts", status, len(*received))
+		}
+	}
+}
+
+func TestSend_RejectsInvalidInput(t *testing.T) {
+	ua := newTestUserAgent(t)
+	sender := newTestSender(t)
+	sender.opts.AllowInsecure = false
+	ctx := context.Background()
+
+	if err := sender.Send(ctx, ua.subscription("http://push.example.com/x"), Message{}); !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected plain http endpoint to be rejected, got %v", err)
+	}
+	if err := sender.Send(ctx, ua.subscription("https://push.example.com/x"), Message{Topic: "has space"}); !errors.Is(err, ErrInvalidTopic) {
+		t.Fatalf("expected ErrInvalidTopic, got %v", err)
+	}
+	if err := sender.Send(ctx, ua.subscription("https://push.example.com/x"), Message{Payload: make([]byte, MaxPayloadSize+1)}); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	invalid := Subscription{Endpoint: "https://push.example.com/x", P256dh: "AAAA", Auth: "AAAA"}
+	if err := invalid.Validate(); !errors.Is(err, ErrInvalidSubscription) {
+		t.Fatalf("expected ErrInvalidSubscription, got %v", err)
+	}
+}
+
+func TestParseVAPIDPrivateKey_RoundTrips(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("failed to generate VAPID keys: %v", err)
+	}
+
+	parsed, err := ParseVAPIDPrivateKey(keys.PrivateKey())
+	if err != nil {
+		t.Fatalf("ParseVAPIDPrivateKey returned error: %v", err)
+	}
+	if parsed.PublicKey() != keys.PublicKey() {
+		t.Fatalf("expected public key %q, got %q", keys.PublicKey(), parsed.PublicKey())
+	}
+	if raw, _ := base64.RawURLEncoding.DecodeString(parsed.PublicKey()); len(raw) != publicKeyLength || raw[0] != 0x04 {
+		t.Fatalf("expected uncompressed public key, got %d bytes", len(raw))
+	}
+
+	if _, err := ParseVAPIDPrivateKey("not-a-key"); !errors.Is(err, ErrInvalidVAPIDKey) {
+		t.Fatalf("expected ErrInvalidVAPIDKey, got %v", err)
+	}
+}
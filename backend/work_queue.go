@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// 同時に動くジョブの数を workers 本に抑えるためのキュー。
+// 同じジョブが二重に積まれないよう、待ち行列と処理中のジョブを覚えておく
+type workQueue[T comparable] struct {
+	name    string
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []T
+	pending map[T]bool
+	process func(T) error
+}
+
+func newWorkQueue[T comparable](name string, process func(T) error) *workQueue[T] {
+	q := &workQueue[T]{
+		name:    name,
+		pending: make(map[T]bool),
+		process: process,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func readWorkerCountEnv(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err == nil && parsed > 0 {
+			return parsed
+		}
+		log.Printf("invalid %s %q, using default", name, value)
+	}
+	return fallback
+}
+
+func (q *workQueue[T]) start(workers int) {
+	for range workers {
+		go q.work()
+	}
+}
+
+func (q *workQueue[T]) enqueue(job T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[job] {
+		return
+	}
+	q.pending[job] = true
+	q.queue = append(q.queue, job)
+	q.cond.Signal()
+}
+
+func (q *workQueue[T]) work() {
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 {
+			q.cond.Wait()
+		}
+		job := q.queue[0]
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+
+		if err := q.process(job); err != nil {
+			log.Printf("failed to process %s %v: %v", q.name, job, err)
+		}
+
+		q.mu.Lock()
+		delete(q.pending, job)
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkQueue_BoundsWorkersAndDeduplicates(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	processed := make(map[int]int)
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(5)
+
+	queue := newWorkQueue("test job", func(job int) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		processed[job]++
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done.Done()
+		return nil
+	})
+
+	for id := 1; id <= 5; id++ {
+		queue.enqueue(id)
+	}
+	queue.enqueue(3)
+	queue.start(2)
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	if peak > 2 {
+		t.Fatalf("expected at most 2 concurrent jobs, got %d", peak)
+	}
+	for id := 1; id <= 5; id++ {
+		if processed[id] != 1 {
+			t.Fatalf("expected job %d to be processed once, got %d", id, processed[id])
+		}
+	}
+}
@@ -1,20 +1,304 @@
+-- アプリケーション用ロール。superuser は Row Level Security をバイパスするため、
+-- バックエンドはこのロールで接続する（パスワードはローカル開発用）。
+CREATE ROLE futto_app LOGIN PASSWORD 'futto_app';
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO futto_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO futto_app;
+
 CREATE TABLE users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     username VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    email VARCHAR(255),
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
 CREATE TABLE sessions (
-    token VARCHAR(64) PRIMARY KEY,
+    token_hash VARCHAR(64) PRIMARY KEY,
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    expires_at TIMESTAMP NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
 CREATE TABLE messages (
     id SERIAL PRIMARY KEY,
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     body TEXT NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    -- 親を削除すると返信は独立したメッセージとして残る
+    parent_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMPTZ,
+    starred_at TIMESTAMPTZ,
+    -- 保存時に抽出した URL・ハッシュタグなど。NULL なら読み出し時に計算する
+    entities JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- タイムラインの範囲指定とインポート時の重複判定で使う
+CREATE INDEX messages_user_id_created_at_idx ON messages (user_id, created_at, id);
+CREATE INDEX messages_parent_id_idx ON messages (parent_id, created_at, id) WHERE parent_id IS NOT NULL;
+CREATE INDEX messages_pinned_idx ON messages (user_id, pinned_at DESC) WHERE pinned_at IS NOT NULL;
+
+CREATE TABLE password_reset_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE invites (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    used_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE user_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE TABLE oidc_login_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(64) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    link_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    outcome VARCHAR(16) NOT NULL,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    details JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, id DESC);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+
+-- 監査ログは追記専用。保持期間を過ぎた行の削除のみ許可する
+CREATE FUNCTION reject_audit_event_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION reject_audit_event_update();
+
+-- ユーザー間の分離をデータベース側でも保証する。
+-- アプリは withUserScope / withSessionScope で app.current_user_id / app.session_token_hash を設定してから問い合わせる。
+-- superuser と BYPASSRLS 属性を持つロールには適用されないため、アプリはそれ以外のロールで接続すること。
+ALTER TABLE messages ENABLE ROW LEVEL SECURITY;
+ALTER TABLE messages FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY messages_owner ON messages
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+ALTER TABLE sessions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE sessions FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY sessions_owner ON sessions
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR token_hash = NULLIF(current_setting('app.session_token_hash', true), '')
+    )
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+CREATE TABLE user_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    settings JSONB NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE user_settings ENABLE ROW LEVEL SECURITY;
+ALTER TABLE user_settings FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY user_settings_owner ON user_settings
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+-- storage_key は blobstore 上のキー。行を消したらアプリ側でブロブも削除する
+CREATE TABLE attachments (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL UNIQUE,
+    filename TEXT NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    -- 画像は processing の間に EXIF を落として作り直し、ready になってから配信する
+    status VARCHAR(16) NOT NULL DEFAULT 'ready',
+    width INTEGER,
+    height INTEGER,
+    thumbnail_sizes INTEGER[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX attachments_message_id_idx ON attachments (message_id);
+CREATE INDEX attachments_user_id_idx ON attachments (user_id);
+
+ALTER TABLE attachments ENABLE ROW LEVEL SECURITY;
+ALTER TABLE attachments FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY attachments_owner ON attachments
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+-- 起動時の積み直しは withImageSweepScope で app.image_sweep を設定し、processing の行だけ読む
+CREATE POLICY attachments_image_sweep ON attachments
+    FOR SELECT
+    USING (status = 'processing' AND current_setting('app.image_sweep', true) = 'on');
+
+-- リンクプレビューは URL 単位のキャッシュで、ユーザーをまたいで共有する。
+-- どのメッセージに出てくるかは RLS の掛かった message_links で持つので、他人の URL は引けない
+CREATE TABLE link_previews (
+    url TEXT PRIMARY KEY,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    title TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    image_url TEXT NOT NULL DEFAULT '',
+    site_name TEXT NOT NULL DEFAULT '',
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
+
+CREATE TABLE message_links (
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX message_links_user_id_idx ON message_links (user_id);
+
+ALTER TABLE message_links ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_links FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY message_links_owner ON message_links
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+-- リンク先のスナップショット。本文テキストは DB に、代表画像は blobstore に置く。
+-- 保存できたもの (ready) は後から上書きしない。リンク切れ後も残すのが目的のため
+CREATE TABLE message_archives (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    final_url TEXT NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    image_key TEXT UNIQUE,
+    image_content_type VARCHAR(255) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (message_id, url)
+);
+
+CREATE INDEX message_archives_user_id_idx ON message_archives (user_id);
+
+ALTER TABLE message_archives ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_archives FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY message_archives_owner ON message_archives
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+-- メッセージに付けるリマインダー。スケジューラーは期限の来た行を firing にしてから配信し、
+-- 配信できたら sent にする。firing のまま claimed_at から一定時間たった行は取り直す
+CREATE TABLE reminders (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    remind_at TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    claimed_at TIMESTAMPTZ,
+    sent_at TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX reminders_message_id_idx ON reminders (message_id);
+CREATE INDEX reminders_due_idx ON reminders (remind_at) WHERE status IN ('pending', 'firing');
+
+ALTER TABLE reminders ENABLE ROW LEVEL SECURITY;
+ALTER TABLE reminders FORCE ROW LEVEL SECURITY;
+
+-- スケジューラーは withReminderSchedulerScope で app.reminder_scheduler を設定し、利用者をまたいで行を取る
+CREATE POLICY reminders_owner ON reminders
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    )
+    WITH CHECK (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    );
+
+-- リマインダーを届け終えた通知先。再試行や再起動のあとでも、届いた通知先には送り直さない
+CREATE TABLE reminder_deliveries (
+    reminder_id INTEGER NOT NULL REFERENCES reminders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notifier VARCHAR(32) NOT NULL,
+    delivered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (reminder_id, notifier)
+);
+
+ALTER TABLE reminder_deliveries ENABLE ROW LEVEL SECURITY;
+ALTER TABLE reminder_deliveries FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY reminder_deliveries_owner ON reminder_deliveries
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    )
+    WITH CHECK (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    );
+
+-- VAPID の秘密鍵。VAPID_PRIVATE_KEY を設定しない場合に、最初に起動したインスタンスが生成して保存する。
+-- 鍵が変わると既存の購読はすべて使えなくなるので、行は 1 つだけにして上書きしない
+CREATE TABLE web_push_keys (
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- ブラウザの Push 購読。セッションごとに 1 件で、セッションが消えると一緒に消える
+CREATE TABLE web_push_subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_token_hash VARCHAR(64) NOT NULL UNIQUE REFERENCES sessions(token_hash) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    p256dh TEXT NOT NULL,
+    auth TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX web_push_subscriptions_user_id_idx ON web_push_subscriptions (user_id);
+
+ALTER TABLE web_push_subscriptions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE web_push_subscriptions FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY web_push_subscriptions_owner ON web_push_subscriptions
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
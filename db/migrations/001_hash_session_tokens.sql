@@ -0,0 +1,6 @@
+-- セッショントークンを平文ではなく SHA-256 ダイジェストで保存する。
+-- 既存の平文トークンはその場でハッシュ化するため、発行済みの Cookie はそのまま有効。
+ALTER TABLE sessions RENAME COLUMN token TO token_hash;
+
+UPDATE sessions
+SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
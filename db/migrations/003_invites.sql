@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE invites (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    used_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
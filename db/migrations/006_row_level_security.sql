@@ -0,0 +1,35 @@
+-- ユーザー間の分離をデータベース側でも保証する。
+-- アプリは withUserScope / withSessionScope で app.current_user_id / app.session_token_hash を設定してから問い合わせる。
+-- superuser と BYPASSRLS 属性を持つロールには適用されないため、アプリはそれ以外のロールで接続すること。
+-- このマイグレーションはテーブルの所有者 (superuser) で実行する。
+-- init.sql と同じアプリケーション用ロールを用意する。パスワードはローカル開発用なので、
+-- 本番では ALTER ROLE futto_app PASSWORD '...' で変更すること。
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'futto_app') THEN
+        CREATE ROLE futto_app LOGIN PASSWORD 'futto_app';
+    END IF;
+END
+$$;
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO futto_app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO futto_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO futto_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO futto_app;
+
+ALTER TABLE messages ENABLE ROW LEVEL SECURITY;
+ALTER TABLE messages FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY messages_owner ON messages
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
+
+ALTER TABLE sessions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE sessions FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY sessions_owner ON sessions
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR token_hash = NULLIF(current_setting('app.session_token_hash', true), '')
+    )
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
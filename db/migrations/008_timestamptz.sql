@@ -0,0 +1,36 @@
+-- TIMESTAMP (タイムゾーンなし) の列を TIMESTAMPTZ に変換する。
+-- 既存の値は NOW() で書き込まれた時点のセッションタイムゾーンの現地時刻なので、
+-- 同じ TimeZone 設定のまま変換すれば正しい時刻になる。サーバーの既定と異なる場合は先に SET TIME ZONE すること。
+ALTER TABLE users
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE sessions
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at::timestamptz,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE messages
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE password_reset_tokens
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at::timestamptz,
+    ALTER COLUMN used_at TYPE TIMESTAMPTZ USING used_at::timestamptz,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE invites
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at::timestamptz,
+    ALTER COLUMN used_at TYPE TIMESTAMPTZ USING used_at::timestamptz,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE user_identities
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE oidc_login_states
+    ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at::timestamptz,
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+-- audit_events は UPDATE を拒否するトリガーがあるが、ALTER TABLE の書き換えはトリガーを発火しない
+ALTER TABLE audit_events
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at::timestamptz;
+
+ALTER TABLE user_settings
+    ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at::timestamptz;
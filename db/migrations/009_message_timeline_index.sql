@@ -0,0 +1,2 @@
+-- タイムラインの範囲指定とインポート時の重複判定で使う
+CREATE INDEX IF NOT EXISTS messages_user_id_created_at_idx ON messages (user_id, created_at, id);
@@ -0,0 +1,5 @@
+ALTER TABLE messages
+    ADD COLUMN pinned_at TIMESTAMPTZ,
+    ADD COLUMN starred_at TIMESTAMPTZ;
+
+CREATE INDEX messages_pinned_idx ON messages (user_id, pinned_at DESC) WHERE pinned_at IS NOT NULL;
@@ -0,0 +1,5 @@
+-- 親を削除すると返信は独立したメッセージとして残る
+ALTER TABLE messages
+    ADD COLUMN parent_id INTEGER REFERENCES messages(id) ON DELETE SET NULL;
+
+CREATE INDEX messages_parent_id_idx ON messages (parent_id, created_at, id) WHERE parent_id IS NOT NULL;
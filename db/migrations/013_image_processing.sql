@@ -0,0 +1,6 @@
+-- 画像は processing の間に EXIF を落として作り直し、ready になってから配信する
+ALTER TABLE attachments
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ready',
+    ADD COLUMN width INTEGER,
+    ADD COLUMN height INTEGER,
+    ADD COLUMN thumbnail_sizes INTEGER[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,28 @@
+-- リンクプレビューは URL 単位のキャッシュで、ユーザーをまたいで共有する。
+-- どのメッセージに出てくるかは RLS の掛かった message_links で持つので、他人の URL は引けない
+CREATE TABLE link_previews (
+    url TEXT PRIMARY KEY,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    title TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    image_url TEXT NOT NULL DEFAULT '',
+    site_name TEXT NOT NULL DEFAULT '',
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE message_links (
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    PRIMARY KEY (message_id, position)
+);
+
+CREATE INDEX message_links_user_id_idx ON message_links (user_id);
+
+ALTER TABLE message_links ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_links FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY message_links_owner ON message_links
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
@@ -0,0 +1,26 @@
+-- リンク先のスナップショット。本文テキストは DB に、代表画像は blobstore に置く。
+-- 保存できたもの (ready) は後から上書きしない。リンク切れ後も残すのが目的のため
+CREATE TABLE message_archives (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    final_url TEXT NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    image_key TEXT UNIQUE,
+    image_content_type VARCHAR(255) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (message_id, url)
+);
+
+CREATE INDEX message_archives_user_id_idx ON message_archives (user_id);
+
+ALTER TABLE message_archives ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_archives FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY message_archives_owner ON message_archives
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
@@ -0,0 +1,2 @@
+-- 保存時に抽出した URL・ハッシュタグなど。既存の行は NULL のままにして読み出し時に計算する
+ALTER TABLE messages ADD COLUMN entities JSONB;
@@ -0,0 +1,31 @@
+-- メッセージに付けるリマインダー。スケジューラーは期限の来た行を firing にしてから配信し、
+-- 配信できたら sent にする。firing のまま claimed_at から一定時間たった行は取り直す
+CREATE TABLE reminders (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    remind_at TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    claimed_at TIMESTAMPTZ,
+    sent_at TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX reminders_message_id_idx ON reminders (message_id);
+CREATE INDEX reminders_due_idx ON reminders (remind_at) WHERE status IN ('pending', 'firing');
+
+ALTER TABLE reminders ENABLE ROW LEVEL SECURITY;
+ALTER TABLE reminders FORCE ROW LEVEL SECURITY;
+
+-- スケジューラーは withReminderSchedulerScope で app.reminder_scheduler を設定し、利用者をまたいで行を取る
+CREATE POLICY reminders_owner ON reminders
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    )
+    WITH CHECK (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    );
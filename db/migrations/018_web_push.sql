@@ -0,0 +1,28 @@
+-- VAPID の秘密鍵。VAPID_PRIVATE_KEY を設定しない場合に、最初に起動したインスタンスが生成して保存する。
+-- 鍵が変わると既存の購読はすべて使えなくなるので、行は 1 つだけにして上書きしない
+CREATE TABLE web_push_keys (
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- ブラウザの Push 購読。セッションごとに 1 件で、セッションが消えると一緒に消える
+CREATE TABLE web_push_subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_token_hash VARCHAR(64) NOT NULL UNIQUE REFERENCES sessions(token_hash) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL,
+    p256dh TEXT NOT NULL,
+    auth TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX web_push_subscriptions_user_id_idx ON web_push_subscriptions (user_id);
+
+ALTER TABLE web_push_subscriptions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE web_push_subscriptions FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY web_push_subscriptions_owner ON web_push_subscriptions
+    USING (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid)
+    WITH CHECK (user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid);
@@ -0,0 +1,5 @@
+-- 起動時に処理待ちのまま取り残された画像を積み直すため、app.image_sweep を設定したトランザクションからは
+-- 利用者をまたいで processing の行だけ読めるようにする (書き込みは各利用者のスコープで行う)
+CREATE POLICY attachments_image_sweep ON attachments
+    FOR SELECT
+    USING (status = 'processing' AND current_setting('app.image_sweep', true) = 'on');
@@ -0,0 +1,21 @@
+-- リマインダーを届け終えた通知先。再試行や再起動のあとでも、届いた通知先には送り直さない
+CREATE TABLE reminder_deliveries (
+    reminder_id INTEGER NOT NULL REFERENCES reminders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    notifier VARCHAR(32) NOT NULL,
+    delivered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (reminder_id, notifier)
+);
+
+ALTER TABLE reminder_deliveries ENABLE ROW LEVEL SECURITY;
+ALTER TABLE reminder_deliveries FORCE ROW LEVEL SECURITY;
+
+CREATE POLICY reminder_deliveries_owner ON reminder_deliveries
+    USING (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    )
+    WITH CHECK (
+        user_id = NULLIF(current_setting('app.current_user_id', true), '')::uuid
+        OR current_setting('app.reminder_scheduler', true) = 'on'
+    );
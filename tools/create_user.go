@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"os"
 
-	"golang.org/x/crypto/bcrypt"
+	"futto-note/backend/passwordhash"
 )
 
 func main() {
 	username := flag.String("username", "", "Username for the new user")
 	password := flag.String("password", "", "Password for the new user")
+	email := flag.String("email", "", "Email address for password reset (optional)")
+	admin := flag.Bool("admin", false, "Allow the user to create invite codes")
 	flag.Parse()
 
 	if *username == "" {
@@ -23,11 +25,28 @@ func main() {
 		os.Exit(1)
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	hasher, err := passwordhash.NewFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring password hashing: %v\n", err)
+		os.Exit(1)
+	}
+
+	hash, err := hasher.Hash(*password)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error generating password hash: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("INSERT INTO users (username, password_hash) VALUES ('%s', '%s');\n", *username, string(hash))
+	columns := "username, password_hash"
+	values := fmt.Sprintf("'%s', '%s'", *username, hash)
+	if *email != "" {
+		columns += ", email"
+		values += fmt.Sprintf(", '%s'", *email)
+	}
+	if *admin {
+		columns += ", is_admin"
+		values += ", TRUE"
+	}
+
+	fmt.Printf("INSERT INTO users (%s) VALUES (%s);\n", columns, values)
 }
@@ -2,4 +2,11 @@ module futto-note/tools
 
 go 1.25.6
 
-require golang.org/x/crypto v0.47.0 // indirect
+require futto-note/backend v0.0.0
+
+require (
+	golang.org/x/crypto v0.48.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+)
+
+replace futto-note/backend => ../backend